@@ -0,0 +1,183 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+)
+
+/**
+* the header of sub-message in aggregate message, the FLV tag header,
+* 	1bytes message type,
+* 	3bytes payload length,
+* 	3bytes timestamp, 1bytes timestamp extended,
+* 	3bytes stream id.
+* the sub-message is followed by 4bytes back pointer, the size of header and payload.
+*/
+const aggregate_header_size = 11
+const aggregate_back_pointer_size = 4
+
+// whether the message can be the sub-message of aggregate message.
+func is_aggregatable(h *MessageHeader) (bool) {
+	return h.IsAudio() || h.IsVideo() || h.IsAmf0Data() || h.IsAmf3Data()
+}
+
+/**
+* demux the aggregate message to the audio/video/data sub-messages,
+* the payload of sub-messages reference the aggregate message, which is released.
+* 3.6. Aggregate message
+* The message stream ID of the aggregate message overrides the message
+* stream IDs for the sub-messages inside the aggregate.
+* The difference between the timestamps of the aggregate message and
+* the first sub-message is the offset used to renormalize the
+* timestamps of the sub-messages to the stream timescale. The offset
+* is added to each sub-message's timestamp to arrive at the normalized
+* stream time. The timestamp of the first sub-message SHOULD be the
+* same as the timestamp of aggregate message, so the offset SHOULD be zero.
+* The back pointer contains the size of the previous message including
+* its header. It is included to match the format of FLV file and is used
+* for backward seek.
+*/
+func demux_aggregate(msg *Message) (msgs []*Message, err error) {
+	defer msg.Release()
+	defer recover_decode(&err, ERROR_RTMP_AGGREGATE)
+
+	stream := NewRtmpStream(msg.Payload)
+	var offset int64
+	for i := 0; !stream.Empty(); i++ {
+		if !stream.Requires(aggregate_header_size) {
+			err = Error{code:ERROR_RTMP_AGGREGATE, desc:fmt.Sprintf("aggregate sub-message #%v requires %v bytes header, left %v bytes", i, aggregate_header_size, stream.Left())}
+			break
+		}
+		message_type := stream.ReadByte()
+		size := stream.ReadUInt24()
+		timestamp := int64(stream.ReadUInt24())
+		timestamp |= int64(stream.ReadByte()) << 24
+		stream.ReadUInt24()
+
+		if !stream.Requires(int(size) + aggregate_back_pointer_size) {
+			err = Error{code:ERROR_RTMP_AGGREGATE, desc:fmt.Sprintf("aggregate sub-message #%v requires %v bytes payload, left %v bytes", i, int(size) + aggregate_back_pointer_size, stream.Left())}
+			break
+		}
+		payload := stream.Read(int(size))
+		if back_pointer := stream.ReadUInt32(); back_pointer != aggregate_header_size + size {
+			err = Error{code:ERROR_RTMP_AGGREGATE, desc:fmt.Sprintf("aggregate sub-message #%v back pointer %v, expect %v", i, back_pointer, aggregate_header_size + size)}
+			break
+		}
+
+		// rebase the timestamps onto the aggregate message.
+		if i == 0 {
+			offset = int64(msg.Header.Timestamp) - timestamp
+		}
+		if timestamp += offset; timestamp < 0 {
+			err = Error{code:ERROR_RTMP_AGGREGATE, desc:fmt.Sprintf("aggregate sub-message #%v timestamp %v, offset %v", i, timestamp - offset, offset)}
+			break
+		}
+
+		sub := msg.Copy()
+		sub.Header.MessageType = message_type
+		sub.Header.PayloadLength = size
+		sub.Header.Timestamp = uint64(timestamp)
+		sub.Payload = payload
+		sub.ReceivedPayloadLength = int(size)
+		msgs = append(msgs, sub)
+
+		if !is_aggregatable(sub.Header) {
+			err = Error{code:ERROR_RTMP_AGGREGATE, desc:fmt.Sprintf("aggregate sub-message #%v invalid type %v", i, message_type)}
+			break
+		}
+	}
+
+	if err != nil {
+		for _, sub := range msgs {
+			sub.Release()
+		}
+		return nil, err
+	}
+	return
+}
+
+/**
+* mux the messages to aggregate messages, the consecutive audio/video/data
+* messages of the same stream are muxed to an aggregate message, until max_size,
+* or the timestamp decrease, for the send queue reorder the audio before video,
+* the payload of aggregate message is max_size at most, except the message
+* larger than it, which is never muxed.
+* the muxed messages are released, and the timestamp of aggregate message is
+* the timestamp of first sub-message, so the offset is zero.
+*/
+func mux_aggregate(msgs []*Message, max_size int) ([]*Message) {
+	out := msgs[:0]
+	for i := 0; i < len(msgs); {
+		// the messages msgs[i:j] to mux.
+		size, j := 0, i
+		for ; j < len(msgs); j++ {
+			h := msgs[j].Header
+			if !is_aggregatable(h) || h.StreamId != msgs[i].Header.StreamId || msgs[j].sent != nil {
+				break
+			}
+			// the audio is sent before the video, never mux the backward timestamp.
+			if j > i && h.Timestamp < msgs[j - 1].Header.Timestamp {
+				break
+			}
+			if size + aggregate_header_size + len(msgs[j].Payload) + aggregate_back_pointer_size > max_size {
+				break
+			}
+			size += aggregate_header_size + len(msgs[j].Payload) + aggregate_back_pointer_size
+		}
+
+		// never mux single message.
+		if j - i < 2 {
+			out = append(out, msgs[i])
+			i++
+			continue
+		}
+
+		first := msgs[i]
+		agg := NewMessage()
+		agg.Header.MessageType = RTMP_MSG_AggregateMessage
+		agg.Header.PayloadLength = uint32(size)
+		agg.Header.Timestamp = first.Header.Timestamp
+		agg.Header.StreamId = first.Header.StreamId
+		agg.PerferCid = first.PerferCid
+
+		stream := NewRtmpStream(make([]byte, size))
+		for _, msg := range msgs[i:j] {
+			h := msg.Header
+			stream.WriteByte(h.MessageType).WriteUInt24(uint32(len(msg.Payload)))
+			stream.WriteUInt24(uint32(h.Timestamp) & 0xffffff).WriteByte(byte(h.Timestamp >> 24))
+			stream.WriteUInt24(0).Write(msg.Payload)
+			stream.WriteUInt32(uint32(aggregate_header_size + len(msg.Payload)))
+			msg.Release()
+		}
+		agg.Payload = stream.WrittenBytes()
+
+		out = append(out, agg)
+		i = j
+	}
+
+	// never ref the muxed messages.
+	for k := len(out); k < len(msgs); k++ {
+		msgs[k] = nil
+	}
+	return out
+}
@@ -0,0 +1,324 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func new_aggregate_message(timestamp uint64, msgs ...*Message) (*Message) {
+	for _, msg := range msgs {
+		msg.Header.StreamId = 1
+	}
+	muxed := mux_aggregate(msgs, 64 * 1024)
+	if len(muxed) != 1 {
+		panic("expect one aggregate message")
+	}
+	agg := muxed[0]
+	agg.Header.Timestamp = timestamp
+	return agg
+}
+
+func TestAggregateDemux(t *testing.T) {
+	// the timestamp of first sub-message is 1000, rebased to 5000.
+	agg := new_aggregate_message(5000,
+		new_av_message(RTMP_MSG_AudioMessage, 1000, []byte{0xaf, 0x01, 0x11}),
+		new_av_message(RTMP_MSG_VideoMessage, 1040, []byte{0x17, 0x01, 0x22, 0x33}),
+		new_av_message(RTMP_MSG_AMF0DataMessage, 0x1000000 + 1000, []byte{0x02}),
+	)
+	if agg.Header.PayloadLength != 3 * 15 + 3 + 4 + 1 || len(agg.Payload) != int(agg.Header.PayloadLength) {
+		t.Fatalf("invalid aggregate size %v, payload %v", agg.Header.PayloadLength, len(agg.Payload))
+	}
+
+	msgs, err := demux_aggregate(agg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expects := []struct {
+		message_type byte
+		timestamp uint64
+		payload []byte
+	} {
+		{RTMP_MSG_AudioMessage, 5000, []byte{0xaf, 0x01, 0x11}},
+		{RTMP_MSG_VideoMessage, 5040, []byte{0x17, 0x01, 0x22, 0x33}},
+		{RTMP_MSG_AMF0DataMessage, 0x1000000 + 5000, []byte{0x02}},
+	}
+	if len(msgs) != len(expects) {
+		t.Fatalf("expect %v messages, actual %v", len(expects), len(msgs))
+	}
+	for i, e := range expects {
+		h := msgs[i].Header
+		if h.MessageType != e.message_type || h.Timestamp != e.timestamp || h.StreamId != 1 {
+			t.Errorf("#%v expect type=%v ts=%v, actual type=%v ts=%v sid=%v", i, e.message_type, e.timestamp, h.MessageType, h.Timestamp, h.StreamId)
+		}
+		if h.PayloadLength != uint32(len(e.payload)) || !bytes.Equal(msgs[i].Payload, e.payload) {
+			t.Errorf("#%v expect payload %v, actual %v", i, e.payload, msgs[i].Payload)
+		}
+	}
+}
+
+func TestAggregateDemuxInvalid(t *testing.T) {
+	valid := func() (*Message) {
+		return new_aggregate_message(0,
+			new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}),
+			new_av_message(RTMP_MSG_AudioMessage, 20, []byte{0xaf, 0x01}),
+		)
+	}
+
+	cases := map[string]func(msg *Message) {
+		"back pointer": func(msg *Message) {
+			msg.Payload[len(msg.Payload) - 1]++
+		},
+		"truncated header": func(msg *Message) {
+			msg.Payload = msg.Payload[:len(msg.Payload) - 4]
+			msg.Payload = append(msg.Payload[:len(msg.Payload) - 2], 0, 0, 0)
+		},
+		"truncated payload": func(msg *Message) {
+			msg.Payload = msg.Payload[:len(msg.Payload) - 1]
+		},
+		"nested aggregate": func(msg *Message) {
+			msg.Payload[0] = RTMP_MSG_AggregateMessage
+		},
+		"command": func(msg *Message) {
+			msg.Payload[17] = RTMP_MSG_AMF0CommandMessage
+		},
+		"negative timestamp": func(msg *Message) {
+			// the first is 40ms and offset is -40ms, the second is 20ms.
+			msg.Payload[6] = 40
+		},
+	}
+	for name, corrupt := range cases {
+		msg := valid()
+		corrupt(msg)
+		msgs, err := demux_aggregate(msg)
+		if err == nil {
+			t.Errorf("%v: expect error", name)
+		} else if err, ok := err.(Error); !ok || err.code != ERROR_RTMP_AGGREGATE {
+			t.Errorf("%v: expect aggregate error, actual %v", name, err)
+		}
+		if msgs != nil {
+			t.Errorf("%v: expect no messages, actual %v", name, len(msgs))
+		}
+	}
+}
+
+func TestAggregateMux(t *testing.T) {
+	data := new_av_message(RTMP_MSG_AMF0CommandMessage, 0, nil)
+	msgs := []*Message{
+		new_av_message(RTMP_MSG_AudioMessage, 0, make([]byte, 100)),
+		new_av_message(RTMP_MSG_VideoMessage, 0, make([]byte, 100)),
+		new_av_message(RTMP_MSG_AudioMessage, 20, make([]byte, 100)),
+		// the command is never muxed.
+		data,
+		new_av_message(RTMP_MSG_AudioMessage, 40, make([]byte, 100)),
+		// the large message is never muxed.
+		new_av_message(RTMP_MSG_VideoMessage, 40, make([]byte, 1000)),
+		new_av_message(RTMP_MSG_AudioMessage, 60, make([]byte, 100)),
+		new_av_message(RTMP_MSG_AudioMessage, 80, make([]byte, 100)),
+	}
+	msgs[7].Header.StreamId = 2
+
+	// the max size fits 3 sub-messages.
+	types := []byte{}
+	for _, msg := range mux_aggregate(msgs, 3 * 115) {
+		types = append(types, msg.Header.MessageType)
+	}
+	expect := []byte{
+		RTMP_MSG_AggregateMessage, RTMP_MSG_AMF0CommandMessage, RTMP_MSG_AudioMessage,
+		RTMP_MSG_VideoMessage, RTMP_MSG_AudioMessage, RTMP_MSG_AudioMessage,
+	}
+	if !bytes.Equal(types, expect) {
+		t.Errorf("expect %v, actual %v", expect, types)
+	}
+}
+
+func TestAggregateMuxMixed(t *testing.T) {
+	// the batch of send queue, the audio is popped before the video.
+	msgs := []*Message{
+		new_av_message(RTMP_MSG_AudioMessage, 100, []byte{0xaf, 0x01, 0x00}),
+		new_av_message(RTMP_MSG_AudioMessage, 120, []byte{0xaf, 0x01, 0x01}),
+		new_av_message(RTMP_MSG_VideoMessage, 80, []byte{0x27, 0x01, 0x02}),
+		new_av_message(RTMP_MSG_VideoMessage, 100, []byte{0x27, 0x01, 0x03}),
+		new_av_message(RTMP_MSG_VideoMessage, 120, []byte{0x27, 0x01, 0x04}),
+	}
+
+	// the video is muxed to another aggregate, for the timestamp decrease.
+	muxed := mux_aggregate(msgs, 64 * 1024)
+	if len(muxed) != 2 {
+		t.Fatalf("expect 2 aggregate messages, actual %v", len(muxed))
+	}
+
+	var timestamps []uint64
+	for _, agg := range muxed {
+		demuxed, err := demux_aggregate(agg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, msg := range demuxed {
+			if i > 0 && msg.Header.Timestamp < demuxed[i - 1].Header.Timestamp {
+				t.Errorf("timestamp decrease from %v to %v", demuxed[i - 1].Header.Timestamp, msg.Header.Timestamp)
+			}
+			timestamps = append(timestamps, msg.Header.Timestamp)
+		}
+	}
+	if expect := []uint64{100, 120, 80, 100, 120}; !reflect.DeepEqual(timestamps, expect) {
+		t.Errorf("expect %v, actual %v", expect, timestamps)
+	}
+}
+
+func TestAggregatePublish(t *testing.T) {
+	const nb_frames = 200
+	received := make(chan []*Message, 1)
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// the aggregate message is demuxed by the protocol stack.
+		var msgs []*Message
+		for len(msgs) < nb_frames + 2 {
+			msg, err := s.Protocol().RecvMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if msg.Header.IsAggregate() {
+				t.Error("got aggregate message")
+			}
+			if msg.Header.IsAudio() {
+				msgs = append(msgs, msg)
+			}
+		}
+
+		// the stats count the demuxed messages.
+		if stats := s.Protocol().Stats(); stats.RecvFrames.Audio != nb_frames + 2 || stats.RecvMessages["audio"] != nb_frames + 2 || stats.RecvMessages["aggregate"] != 0 {
+			t.Errorf("recv frames %+v, messages %v", stats.RecvFrames, stats.RecvMessages)
+		}
+		received <- msgs
+	})
+	defer close()
+
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+	c.Protocol().SetAggregate(64 * 1024)
+
+	stream_id, err := c.Publish("livestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the aggregate message generated by peer, the timestamp is rebased.
+	agg := new_aggregate_message(10000,
+		new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01, 0x00}),
+		new_av_message(RTMP_MSG_AudioMessage, 20, []byte{0xaf, 0x01, 0x01}),
+	)
+	if err = c.Protocol().SendMessage(agg, stream_id); err != nil {
+		t.Fatal(err)
+	}
+
+	// the frames queued are muxed to aggregate messages.
+	for i := 0; i < nb_frames; i++ {
+		msg := new_av_message(RTMP_MSG_AudioMessage, uint64(20000 + i * 20), []byte{0xaf, 0x01, byte(i)})
+		if err = c.Protocol().SendMessage(msg, stream_id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the aggregate message is queued as video, so maybe sent after the audio frames.
+	var peer, frames []*Message
+	received_msgs := <-received
+
+	// the stats count the messages sent by user, not the muxed aggregate messages.
+	if stats := c.Protocol().Stats(); stats.SendFrames.Audio != nb_frames || stats.SendMessages["audio"] != nb_frames || stats.SendMessages["aggregate"] != 1 {
+		t.Errorf("send frames %+v, messages %v", stats.SendFrames, stats.SendMessages)
+	}
+	for _, msg := range received_msgs {
+		if msg.Header.StreamId != stream_id {
+			t.Errorf("expect stream %v, actual %v", stream_id, msg.Header.StreamId)
+		}
+		if msg.Header.Timestamp < 20000 {
+			peer = append(peer, msg)
+		} else {
+			frames = append(frames, msg)
+		}
+	}
+	if len(peer) != 2 || len(frames) != nb_frames {
+		t.Fatalf("expect 2 and %v messages, actual %v and %v", nb_frames, len(peer), len(frames))
+	}
+	for i, msg := range peer {
+		if expect := uint64(10000 + i * 20); msg.Header.Timestamp != expect || !bytes.Equal(msg.Payload, []byte{0xaf, 0x01, byte(i)}) {
+			t.Errorf("#%v expect ts=%v, actual ts=%v payload=%v", i, expect, msg.Header.Timestamp, msg.Payload)
+		}
+	}
+	for i, msg := range frames {
+		if expect := uint64(20000 + i * 20); msg.Header.Timestamp != expect || !bytes.Equal(msg.Payload, []byte{0xaf, 0x01, byte(i)}) {
+			t.Errorf("#%v expect ts=%v, actual ts=%v payload=%v", i, expect, msg.Header.Timestamp, msg.Payload)
+		}
+	}
+}
+
+func TestAggregateSendRate(t *testing.T) {
+	const nb_frames = 200
+	received := make(chan int, 1)
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+			return
+		}
+		received <- len(recv_av_messages(t, s, nb_frames))
+	})
+	defer close()
+
+	// the tokens are enough, the rate limit never disable the aggregate.
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+	var w log_buffer
+	c.SetLogger(NewLogger(&w, LogLevelTrace))
+	c.Protocol().SetSendRate(100000)
+	c.Protocol().SetAggregate(64 * 1024)
+
+	stream_id, err := c.Publish("livestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < nb_frames; i++ {
+		msg := new_av_message(RTMP_MSG_AudioMessage, uint64(i * 20), []byte{0xaf, 0x01, byte(i)})
+		if err = c.Protocol().SendMessage(msg, stream_id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := <-received; v != nb_frames {
+		t.Fatalf("expect %v frames, actual %v", nb_frames, v)
+	}
+	if !strings.Contains(w.String(), fmt.Sprintf("type=%v,", RTMP_MSG_AggregateMessage)) {
+		t.Error("expect aggregate messages when rate limited")
+	}
+}
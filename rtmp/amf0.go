@@ -181,6 +181,9 @@ func (r *Amf0Object) Read(codec *Amf0Codec) (err error) {
 		if err = r.Set(property_name, &property_value); err != nil {
 			return
 		}
+		if err = codec.limits.check_amf0_properties(r.properties.Count()); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -281,6 +284,9 @@ func (r *Amf0EcmaArray) Read(codec *Amf0Codec) (err error) {
 		if err = r.Set(property_name, &property_value); err != nil {
 			return
 		}
+		if err = codec.limits.check_amf0_properties(r.properties.Count()); err != nil {
+			return
+		}
 	}
 	return
 }
@@ -408,6 +414,8 @@ func (r *Amf0Any) Write(codec *Amf0Codec) (err error) {
 	return
 }
 func (r *Amf0Any) Read(codec *Amf0Codec) (err error) {
+	defer recover_decode(&err, ERROR_RTMP_AMF0_DECODE)
+
 	// marker
 	if !codec.stream.Requires(1) {
 		err = Error{code:ERROR_RTMP_AMF0_DECODE, desc:"amf0 any requires 1bytes marker"}
@@ -475,10 +483,17 @@ func (r *Amf0Any) Boolean() (v bool, ok bool) {
 
 type Amf0Codec struct {
 	stream *Buffer
+	// the limits of nesting depth and properties.
+	limits *Limits
+	// the nesting depth of object or ecma array to read.
+	depth int
 }
 func NewAmf0Codec(stream *Buffer) (*Amf0Codec) {
 	r := Amf0Codec{}
 	r.stream = stream
+	if r.limits = stream.limits; r.limits == nil {
+		r.limits = default_limits
+	}
 	return &r
 }
 
@@ -660,7 +675,7 @@ func (r *Amf0Codec) WriteNull() (err error) {
 func (r *Amf0Codec) ReadNull() (err error) {
 	// marker
 	if !r.stream.Requires(1) {
-		err = Error{code:ERROR_RTMP_AMF0_ENCODE, desc:"amf0 read null marker failed"}
+		err = Error{code:ERROR_RTMP_AMF0_DECODE, desc:"amf0 read null marker failed"}
 		return
 	}
 	r.stream.ReadByte()
@@ -708,12 +723,24 @@ func (r *Amf0Codec) ReadBoolean() (v bool, err error) {
 }
 // srs_amf0_read_object
 func (r *Amf0Codec) ReadObject() (v *Amf0Object, err error) {
+	if err = r.limits.check_amf0_depth(r.depth + 1); err != nil {
+		return
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
 	// value
 	v = NewAmf0Object()
 	return v, v.Read(r)
 }
 // srs_amf0_read_ecma_array
 func (r *Amf0Codec) ReadEcmaArray() (v *Amf0EcmaArray, err error) {
+	if err = r.limits.check_amf0_depth(r.depth + 1); err != nil {
+		return
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
 	// value
 	v = NewAmf0EcmaArray()
 	return v, v.Read(r)
@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/**
+* the authenticator of client, invoked by server at connect, publish and play,
+* where the req is parsed, the Request.Param is the query of tcUrl,
+* and the Request.StreamParams is the query of stream.
+* return error to reject the client, the Error desc is sent to client as the description,
+* for example, NewAuthError("invalid token").
+ */
+type Authenticator interface {
+	// when ConnectApp, the stream is unknown.
+	OnConnect(req *Request) (err error)
+	// when StartFMLEPublish or StartFlashPublish.
+	OnPublish(req *Request) (err error)
+	// when StartPlay.
+	OnPlay(req *Request) (err error)
+}
+
+/**
+* create the error of authenticator, the desc is sent to client.
+ */
+func NewAuthError(desc string) (error) {
+	return Error{code:ERROR_GO_AUTH_REJECTED, desc:desc}
+}
+
+// get the description of auth error, to send to client.
+func auth_error_desc(err error) (string) {
+	if v, ok := err.(Error); ok {
+		return v.desc
+	}
+	return err.Error()
+}
+
+// get the param of stream, or tcUrl if not found in stream.
+func request_param(req *Request, name string) (string) {
+	if v := req.StreamParams.Get(name); v != "" {
+		return v
+	}
+	return req.Param.Get(name)
+}
+
+/**
+* the static key authenticator, the client must specifies one of keys,
+* for example, the OBS stream key "livestream?key=secret" for rtmp://host/live
+* the key is in the params of stream, or the params of tcUrl.
+ */
+type StaticKeyAuthenticator struct {
+	// the name of param, for example, "key"
+	Param string
+	// the valid keys.
+	Keys []string
+	// whether auth the play, only the publish is authed when false.
+	Play bool
+}
+func NewStaticKeyAuthenticator(param string, keys ...string) (*StaticKeyAuthenticator) {
+	r := &StaticKeyAuthenticator{}
+	r.Param = param
+	r.Keys = keys
+	return r
+}
+
+func (r *StaticKeyAuthenticator) OnConnect(req *Request) (err error) {
+	return
+}
+
+func (r *StaticKeyAuthenticator) OnPublish(req *Request) (err error) {
+	return r.auth(req)
+}
+
+func (r *StaticKeyAuthenticator) OnPlay(req *Request) (err error) {
+	if !r.Play {
+		return
+	}
+	return r.auth(req)
+}
+
+func (r *StaticKeyAuthenticator) auth(req *Request) (err error) {
+	key := request_param(req, r.Param)
+	if key == "" {
+		return NewAuthError(fmt.Sprintf("%v required", r.Param))
+	}
+
+	for _, v := range r.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(v)) == 1 {
+			return
+		}
+	}
+	return NewAuthError(fmt.Sprintf("invalid %v", r.Param))
+}
+
+/**
+* the expiring token authenticator, the client must specifies the token and expire,
+* for example, rtmp://host/live/livestream?expire=1400000000&token=xxx
+* where the expire is the unix time in seconds, and the token is signed by Sign().
+ */
+type TokenAuthenticator struct {
+	// the secret key of hmac.
+	Secret []byte
+	// whether auth the play and publish.
+	Play bool
+	Publish bool
+	// get the current time, for test, time.Now when nil.
+	now func() (time.Time)
+}
+func NewTokenAuthenticator(secret []byte) (*TokenAuthenticator) {
+	r := &TokenAuthenticator{}
+	r.Secret = secret
+	r.Play, r.Publish = true, true
+	r.now = time.Now
+	return r
+}
+
+/**
+* sign the token of stream, the hex of HMAC-SHA256(secret, "/app/stream?expire=N").
+* @param expire the unix time in seconds, the token is invalid after it.
+ */
+func (r *TokenAuthenticator) Sign(app string, stream string, expire int64) (string) {
+	h := hmac.New(sha256.New, r.Secret)
+	fmt.Fprintf(h, "/%v/%v?expire=%v", app, stream, expire)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *TokenAuthenticator) OnConnect(req *Request) (err error) {
+	return
+}
+
+func (r *TokenAuthenticator) OnPublish(req *Request) (err error) {
+	if !r.Publish {
+		return
+	}
+	return r.auth(req)
+}
+
+func (r *TokenAuthenticator) OnPlay(req *Request) (err error) {
+	if !r.Play {
+		return
+	}
+	return r.auth(req)
+}
+
+func (r *TokenAuthenticator) auth(req *Request) (err error) {
+	token, expire := request_param(req, "token"), request_param(req, "expire")
+	if token == "" || expire == "" {
+		return NewAuthError("token and expire required")
+	}
+
+	var v int64
+	if v, err = strconv.ParseInt(expire, 10, 64); err != nil {
+		return NewAuthError("invalid expire")
+	}
+	now := time.Now
+	if r.now != nil {
+		now = r.now
+	}
+	if now().Unix() > v {
+		return NewAuthError("token expired")
+	}
+
+	if !hmac.Equal([]byte(token), []byte(r.Sign(req.App, req.Stream, v))) {
+		return NewAuthError("invalid token")
+	}
+	return
+}
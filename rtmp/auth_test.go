@@ -0,0 +1,253 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRequestParams(t *testing.T) {
+	req := NewRequest()
+	req.TcUrl = "rtmp://127.0.0.1:1935/live?vhost=auth.test&token=abc"
+	if err := req.discovery_app(); err != nil {
+		t.Fatal(err)
+	}
+	if req.Vhost != "auth.test" || req.App != "live" || req.Param.Get("token") != "abc" {
+		t.Errorf("vhost=%v, app=%v, param=%v", req.Vhost, req.App, req.Param)
+	}
+
+	req.ParseStream("livestream?key=secret&expire=100")
+	if req.Stream != "livestream" || req.StreamParams.Get("key") != "secret" || req.StreamParams.Get("expire") != "100" {
+		t.Errorf("stream=%v, params=%v", req.Stream, req.StreamParams)
+	}
+	if req.StreamUrl() != "auth.test/live/livestream" {
+		t.Errorf("stream url %v", req.StreamUrl())
+	}
+
+	req.ParseStream("livestream")
+	if req.Stream != "livestream" || len(req.StreamParams) != 0 {
+		t.Errorf("stream=%v, params=%v", req.Stream, req.StreamParams)
+	}
+}
+
+func TestStaticKeyAuthenticator(t *testing.T) {
+	a := NewStaticKeyAuthenticator("key", "secret", "other")
+	req := NewRequest()
+
+	req.ParseStream("livestream?key=secret")
+	if err := a.OnPublish(req); err != nil {
+		t.Error(err)
+	}
+	req.ParseStream("livestream?key=bad")
+	if err := a.OnPublish(req); auth_error_desc(err) != "invalid key" {
+		t.Errorf("expect invalid key, actual %v", err)
+	}
+	if err := a.OnPlay(req); err != nil {
+		t.Error(err)
+	}
+
+	// the key in tcUrl.
+	a.Play = true
+	req.ParseStream("livestream")
+	if err := a.OnPlay(req); auth_error_desc(err) != "key required" {
+		t.Errorf("expect key required, actual %v", err)
+	}
+	req.Param = map[string][]string{"key":{"other"}}
+	if err := a.OnPlay(req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := NewTokenAuthenticator([]byte("secret"))
+	a.now = func() (time.Time) {
+		return time.Unix(1000, 0)
+	}
+
+	req := NewRequest()
+	req.App = "live"
+	token := a.Sign("live", "livestream", 1100)
+
+	for _, c := range []struct {
+		stream string
+		desc string
+	}{
+		{"livestream?expire=1100&token=" + token, ""},
+		{"livestream?expire=1100", "token and expire required"},
+		{"livestream?expire=900&token=" + a.Sign("live", "livestream", 900), "token expired"},
+		{"livestream?expire=1200&token=" + token, "invalid token"},
+		{"other?expire=1100&token=" + token, "invalid token"},
+		{"livestream?expire=x&token=" + token, "invalid expire"},
+	} {
+		req.ParseStream(c.stream)
+		err := a.OnPublish(req)
+		if c.desc == "" && err != nil || c.desc != "" && (err == nil || auth_error_desc(err) != c.desc) {
+			t.Errorf("stream %v, expect %v, actual %v", c.stream, c.desc, err)
+		}
+	}
+}
+
+func TestTokenAuthenticatorLiteral(t *testing.T) {
+	// the literal without clock uses the time.Now.
+	a := &TokenAuthenticator{Secret:[]byte("secret"), Publish:true}
+
+	req := NewRequest()
+	req.App = "live"
+	expire := time.Now().Add(time.Hour).Unix()
+	req.ParseStream(fmt.Sprintf("livestream?expire=%v&token=%v", expire, a.Sign("live", "livestream", expire)))
+	if err := a.OnPublish(req); err != nil {
+		t.Errorf("auth failed, %v", err)
+	}
+
+	expire = time.Now().Add(-time.Hour).Unix()
+	req.ParseStream(fmt.Sprintf("livestream?expire=%v&token=%v", expire, a.Sign("live", "livestream", expire)))
+	if err := a.OnPublish(req); err == nil || auth_error_desc(err) != "token expired" {
+		t.Errorf("expect expired, actual %v", err)
+	}
+}
+
+// the authenticator reject the connect.
+type reject_connect_authenticator struct {
+	StaticKeyAuthenticator
+}
+
+func (r *reject_connect_authenticator) OnConnect(req *Request) (err error) {
+	if req.Param.Get("token") != "abc" {
+		return NewAuthError("forbidden")
+	}
+	return
+}
+
+func TestAuthRejectConnect(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live?token=bad")))
+
+	responses := replay_session(t, c.b, 1, func(s Server) {
+		s.SetAuthenticator(&reject_connect_authenticator{})
+		err := s.ConnectApp(NewRequest())
+		if v, ok := err.(Error); !ok || v.Code() != ERROR_GO_AUTH_REJECTED {
+			t.Errorf("expect auth rejected, actual %v", err)
+		}
+	})
+
+	assert_responses(t, responses, []string{
+		`cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"forbidden"}`,
+	})
+}
+
+func TestAuthPublishAndPlay(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_RELEASE_STREAM, 2.0, nil, "livestream?key=bad"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_FC_PUBLISH, 3.0, nil, "livestream?key=bad"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 4.0, nil))
+	c.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 5.0, nil, "livestream?key=bad", "live"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 6.0, nil))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 2, seed_amf0(AMF0_COMMAND_PLAY, 7.0, nil, "livestream?key=secret"))
+
+	var req *Request
+	responses := replay_session(t, c.b, 6, func(s Server) {
+		s.SetAuthenticator(NewStaticKeyAuthenticator("key", "secret"))
+		req = NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream?key=bad")
+		err := s.StartFMLEPublish(1)
+		if v, ok := err.(Error); !ok || v.Code() != ERROR_GO_AUTH_REJECTED {
+			t.Errorf("expect auth rejected, actual %v", err)
+		}
+
+		if _, _, err = s.IdentifyClient(2); err != nil {
+			t.Error(err)
+		}
+		if err := s.StartPlay(2); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if req.Stream != "livestream" || req.StreamParams.Get("key") != "secret" {
+		t.Errorf("stream=%v, params=%v", req.Stream, req.StreamParams)
+	}
+	assert_responses(t, responses, []string{
+		fmle_publish_responses[0],
+		fmle_publish_responses[1],
+		fmle_publish_responses[2],
+		`cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Publish.BadName",description:"invalid key",clientid:"ASAICiss"}`,
+		`cid=3 sid=0 "_result",6,null,2`,
+		"cid=2 sid=0 UserControl(0,2)",
+	})
+}
+
+func TestAuthRejectThenDestroy(t *testing.T) {
+	connect := func(tc_url string) (*seed_session) {
+		c := new_seed_session()
+		c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+			"app", "live", "tcUrl", tc_url)))
+		return c
+	}
+
+	// the server is closed when auth failed, the client must got the rejection.
+	responses := replay_and_destroy(t, connect("rtmp://127.0.0.1/live?token=bad").b, func(s Server) {
+		s.SetAuthenticator(&reject_connect_authenticator{})
+		assert_error_code(t, s.ConnectApp(NewRequest()), ERROR_GO_AUTH_REJECTED)
+	})
+	assert_last_response(t, responses, `cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"forbidden"}`)
+
+	publish := connect("rtmp://127.0.0.1/live")
+	publish.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_RELEASE_STREAM, 2.0, nil, "livestream?key=bad"))
+	publish.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_FC_PUBLISH, 3.0, nil, "livestream?key=bad"))
+	publish.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 4.0, nil))
+	publish.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 5.0, nil, "livestream?key=bad", "live"))
+	responses = replay_and_destroy(t, publish.b, func(s Server) {
+		s.SetAuthenticator(NewStaticKeyAuthenticator("key", "secret"))
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream?key=bad")
+		assert_error_code(t, s.StartFMLEPublish(1), ERROR_GO_AUTH_REJECTED)
+	})
+	assert_last_response(t, responses, `cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Publish.BadName",description:"invalid key",clientid:"ASAICiss"}`)
+
+	play := connect("rtmp://127.0.0.1/live")
+	play.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	play.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "livestream?key=bad"))
+	responses = replay_and_destroy(t, play.b, func(s Server) {
+		auth := NewStaticKeyAuthenticator("key", "secret")
+		auth.Play = true
+		s.SetAuthenticator(auth)
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream?key=bad")
+		assert_error_code(t, s.StartPlay(1), ERROR_GO_AUTH_REJECTED)
+	})
+	assert_last_response(t, responses, `cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Play.StreamNotFound",description:"invalid key",details:"stream",clientid:"ASAICiss"}`)
+}
@@ -0,0 +1,288 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the default duration of play or publish test.
+const BANDWIDTH_DEFAULT_DURATION = 3 * time.Second
+// the default min interval between two checks, to avoid the check to be abused.
+const BANDWIDTH_DEFAULT_INTERVAL = 30 * time.Second
+// the default max kbps of play or publish test.
+const BANDWIDTH_DEFAULT_LIMIT_KBPS = 1000
+// the timeout to wait for the finalClientPacket, ignore when timeout.
+const bandwidth_final_timeout = 3 * time.Second
+// the filler of the onSrsBandCheckPlaying and onSrsBandCheckPublishing.
+var bandwidth_filler = strings.Repeat("SRS band check data.", 50)
+
+/**
+* the result of bandwidth check, the play is the downlink of client,
+* while the publish is the uplink of client.
+ */
+type BandwidthResult struct {
+	StartTime time.Time
+	EndTime time.Time
+	PlayKbps int
+	PlayBytes uint64
+	PlayTime time.Duration
+	PublishKbps int
+	PublishBytes uint64
+	PublishTime time.Duration
+}
+
+/**
+* the bandwidth checker, serve the bandwidth check of client, for example,
+* 		checker := NewBandwidthChecker("35c9b402c12a7246868752e2878f7e0e")
+* 		// for each connection:
+* 		s.ConnectApp(req)
+* 		if req.App == "bwcheck" {
+* 			result, err := checker.Check(ctx, s, req)
+* 		}
+* the client must connect with the key, for example, rtmp://server/bwcheck?key=xxx,
+* then the server push the filler data to client as the play test,
+* and recv the filler data from client as the publish test,
+* finally report the result in onSrsBandCheckFinished, @see Client.Bandwidth
+ */
+type BandwidthChecker struct {
+	// the key required in the tcUrl param, empty to allow all.
+	Key string
+	// the min interval between two checks, reject the check in the interval.
+	Interval time.Duration
+	// the duration of play test and publish test.
+	Duration time.Duration
+	// the max kbps of play test and publish test.
+	LimitKbps int
+	lock *sync.Mutex
+	last_check time.Time
+}
+func NewBandwidthChecker(key string) (*BandwidthChecker) {
+	r := &BandwidthChecker{}
+	r.Key = key
+	r.Interval = BANDWIDTH_DEFAULT_INTERVAL
+	r.Duration = BANDWIDTH_DEFAULT_DURATION
+	r.LimitKbps = BANDWIDTH_DEFAULT_LIMIT_KBPS
+	r.lock = &sync.Mutex{}
+	return r
+}
+
+/**
+* serve the bandwidth check of client, after ConnectApp, the connect is responsed by it.
+* @return ERROR_SYSTEM_BANDWIDTH_KEY when the key is invalid, and
+* 		ERROR_SYSTEM_BANDWIDTH_DENIED when checked in the interval,
+* 		the connect is rejected for both, user should close the connection.
+ */
+func (r *BandwidthChecker) Check(ctx context.Context, s Server, req *Request) (result *BandwidthResult, err error) {
+	if r.Key != "" && req.Param.Get("key") != r.Key {
+		err = Error{code:ERROR_SYSTEM_BANDWIDTH_KEY, desc:fmt.Sprintf("invalid bandwidth check key %v", req.Param.Get("key"))}
+	} else if err = r.acquire(); err == nil {
+		err = s.ReponseConnectApp(req, "", nil)
+	}
+	if err != nil {
+		if v, ok := err.(Error); ok && (v.code == ERROR_SYSTEM_BANDWIDTH_KEY || v.code == ERROR_SYSTEM_BANDWIDTH_DENIED) {
+			if err := s.RejectConnectApp(req, v.desc); err != nil {
+				return nil, err
+			}
+		}
+		return
+	}
+
+	p := s.Protocol()
+	result = &BandwidthResult{StartTime:time.Now()}
+	if result.PlayBytes, result.PlayTime, err = r.check_play(ctx, p); err != nil {
+		return
+	}
+	if result.PublishBytes, result.PublishTime, err = r.check_publish(ctx, p); err != nil {
+		return
+	}
+	result.PlayKbps = bandwidth_kbps(result.PlayBytes, result.PlayTime)
+	result.PublishKbps = bandwidth_kbps(result.PublishBytes, result.PublishTime)
+	result.EndTime = time.Now()
+
+	// report the result.
+	pkt := NewBandwidthPacket(SRS_BW_CHECK_FINISHED)
+	pkt.Set("code", 0).Set("start_time", int(result.StartTime.UnixNano() / int64(time.Millisecond)))
+	pkt.Set("end_time", int(result.EndTime.UnixNano() / int64(time.Millisecond)))
+	pkt.Set("play_kbps", result.PlayKbps).Set("play_bytes", int(result.PlayBytes))
+	pkt.Set("play_time", int(result.PlayTime / time.Millisecond))
+	pkt.Set("publish_kbps", result.PublishKbps).Set("publish_bytes", int(result.PublishBytes))
+	pkt.Set("publish_time", int(result.PublishTime / time.Millisecond))
+	if err = p.SendPacket(pkt, uint32(0)); err != nil {
+		return
+	}
+
+	// the flash send the final packet then close, so ignore the error.
+	final_ctx, cancel := context.WithTimeout(ctx, bandwidth_final_timeout)
+	defer cancel()
+	expect_bandwidth(final_ctx, p, SRS_BW_CHECK_FLASH_FINAL)
+	return
+}
+
+// reject the check in the interval, or update the last check time.
+func (r *BandwidthChecker) acquire() (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if !r.last_check.IsZero() && now.Sub(r.last_check) < r.Interval {
+		return Error{code:ERROR_SYSTEM_BANDWIDTH_DENIED, desc:fmt.Sprintf("bandwidth check rejected, retry in %v", r.Interval - now.Sub(r.last_check))}
+	}
+	r.last_check = now
+	return
+}
+
+// push the filler to client, return the bytes sent and the duration.
+func (r *BandwidthChecker) check_play(ctx context.Context, p Protocol) (bytes uint64, duration time.Duration, err error) {
+	if err = r.start(ctx, p, SRS_BW_CHECK_START_PLAY, SRS_BW_CHECK_STARTING_PLAY); err != nil {
+		return
+	}
+
+	// the filler is sent sync, paced by the link, so no filler is queued when the clock stop.
+	start, start_bytes := time.Now(), p.Stats().SendBytes
+	for sent := uint64(0); time.Since(start) < r.Duration; {
+		pkt := NewBandwidthPacket(SRS_BW_CHECK_PLAYING).Set("data", bandwidth_filler)
+		sent += uint64(pkt.GetSize())
+		if err = p.SendPacketSync(pkt, uint32(0)); err != nil {
+			return
+		}
+		if err = bandwidth_limit(ctx, start, sent, r.LimitKbps); err != nil {
+			return
+		}
+	}
+	bytes, duration = p.Stats().SendBytes - start_bytes, time.Since(start)
+
+	// the client response the stopped when all filler received.
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_STOP_PLAY), uint32(0)); err != nil {
+		return
+	}
+	if _, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_STOPPED_PLAY); err != nil {
+		return
+	}
+	return bytes, duration, nil
+}
+
+// recv the filler from client, return the bytes received and the duration.
+func (r *BandwidthChecker) check_publish(ctx context.Context, p Protocol) (bytes uint64, duration time.Duration, err error) {
+	if err = r.start(ctx, p, SRS_BW_CHECK_START_PUBLISH, SRS_BW_CHECK_STARTING_PUBLISH); err != nil {
+		return
+	}
+
+	start, start_bytes := time.Now(), p.Stats().RecvBytes
+	publish_ctx, cancel := context.WithTimeout(ctx, r.Duration)
+	defer cancel()
+	for {
+		var msg *Message
+		if msg, err = p.RecvMessageContext(publish_ctx); err != nil {
+			break
+		}
+		msg.Release()
+	}
+	if ctx.Err() != nil || publish_ctx.Err() == nil {
+		return
+	}
+	bytes, duration = p.Stats().RecvBytes - start_bytes, time.Since(start)
+
+	// the client stop publishing, the filler in flight is ignored.
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_STOP_PUBLISH), uint32(0)); err != nil {
+		return
+	}
+	if _, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_STOPPED_PUBLISH); err != nil {
+		return
+	}
+	return bytes, duration, nil
+}
+
+// send the start command with params, and expect the starting response.
+func (r *BandwidthChecker) start(ctx context.Context, p Protocol, command string, response string) (err error) {
+	pkt := NewBandwidthPacket(command)
+	pkt.Set("duration_ms", int(r.Duration / time.Millisecond)).Set("limit_kbps", r.LimitKbps)
+	if err = p.SendPacket(pkt, uint32(0)); err != nil {
+		return
+	}
+	_, err = expect_bandwidth(ctx, p, response)
+	return
+}
+
+// expect the bandwidth packet of command, ignore others, for example, the filler.
+func expect_bandwidth(ctx context.Context, p Protocol, command string) (pkt *BandwidthPacket, err error) {
+	for {
+		var msg *Message
+		if msg, err = p.RecvMessageContext(ctx); err != nil {
+			return
+		}
+
+		var v interface {}
+		v, err = p.DecodeMessage(msg)
+		msg.Release()
+		if err != nil {
+			return
+		}
+		if pkt, ok := v.(*BandwidthPacket); ok && pkt.CommandName == command {
+			return pkt, nil
+		}
+	}
+}
+
+// parse the report of onSrsBandCheckFinished.
+func bandwidth_report(data *Amf0Object) (result *BandwidthResult) {
+	number := func(k string) (int64) {
+		v, _ := data.GetPropertyNumber(k)
+		return int64(v)
+	}
+
+	result = &BandwidthResult{}
+	result.StartTime = time.Unix(0, number("start_time") * int64(time.Millisecond))
+	result.EndTime = time.Unix(0, number("end_time") * int64(time.Millisecond))
+	result.PlayKbps = int(number("play_kbps"))
+	result.PlayBytes = uint64(number("play_bytes"))
+	result.PlayTime = time.Duration(number("play_time")) * time.Millisecond
+	result.PublishKbps = int(number("publish_kbps"))
+	result.PublishBytes = uint64(number("publish_bytes"))
+	result.PublishTime = time.Duration(number("publish_time")) * time.Millisecond
+	return
+}
+
+// sleep util the kbps is under the limit, no limit when limit_kbps is not positive.
+// @remark compare the bits with the quota, for the kbps is zero in the first millisecond.
+func bandwidth_limit(ctx context.Context, start time.Time, bytes uint64, limit_kbps int) (err error) {
+	for limit_kbps > 0 && bytes * 8 > uint64(limit_kbps) * uint64(time.Since(start) / time.Millisecond) {
+		select {
+		case <-ctx.Done():
+			return context_error(ctx)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return
+}
+
+// the kbps of bytes in duration, that is, the bits per millisecond.
+func bandwidth_kbps(bytes uint64, duration time.Duration) (int) {
+	if ms := uint64(duration / time.Millisecond); ms > 0 {
+		return int(bytes * 8 / ms)
+	}
+	return 0
+}
@@ -0,0 +1,207 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bandwidth_served struct {
+	result *BandwidthResult
+	err error
+}
+
+func dial_bandwidth(t *testing.T, tc_url string) (c Client, err error) {
+	if c, err = DialClient(context.Background(), tc_url); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Handshake(); err != nil {
+		c.Destroy()
+		t.Fatal(err)
+	}
+
+	req := NewRequest()
+	req.TcUrl = tc_url
+	return c, c.ConnectApp(req)
+}
+
+func TestBandwidthCheck(t *testing.T) {
+	checker := NewBandwidthChecker("xxx")
+	checker.Duration = 100 * time.Millisecond
+	checker.LimitKbps = 8000
+
+	served := make(chan bandwidth_served, 1)
+	tc_url, close := serve_rtmp(t, "bwcheck", func(s Server) {
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		result, err := checker.Check(context.Background(), s, req)
+		served <- bandwidth_served{result, err}
+	})
+	defer close()
+
+	// the key is required.
+	c, err := dial_bandwidth(t, tc_url + "?key=yyy")
+	defer c.Destroy()
+	if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED || !strings.Contains(v.Desc(), "invalid bandwidth check key") {
+		t.Errorf("expect key rejected, actual %v", err)
+	}
+	if v, ok := (<-served).err.(Error); !ok || v.Code() != ERROR_SYSTEM_BANDWIDTH_KEY {
+		t.Errorf("expect served key error, actual %v", v)
+	}
+
+	// check the play and publish.
+	c, err = dial_bandwidth(t, tc_url + "?key=xxx")
+	defer c.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.Bandwidth()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := <-served
+	if v.err != nil {
+		t.Fatal(v.err)
+	}
+	if result.PlayBytes != v.result.PlayBytes || result.PublishBytes != v.result.PublishBytes || result.PlayKbps != v.result.PlayKbps {
+		t.Errorf("expect report %+v, actual %+v", v.result, result)
+	}
+	if result.PlayTime < checker.Duration || result.PublishTime < checker.Duration {
+		t.Errorf("expect duration %v, actual play %v, publish %v", checker.Duration, result.PlayTime, result.PublishTime)
+	}
+	for _, kbps := range []int{result.PlayKbps, result.PublishKbps} {
+		if kbps <= 0 || kbps > checker.LimitKbps * 2 {
+			t.Errorf("expect kbps limited to %v, actual %+v", checker.LimitKbps, result)
+		}
+	}
+
+	// the check in the interval is rejected.
+	c, err = dial_bandwidth(t, tc_url + "?key=xxx")
+	defer c.Destroy()
+	if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED || !strings.Contains(v.Desc(), "bandwidth check rejected") {
+		t.Errorf("expect interval rejected, actual %v", err)
+	}
+	if v, ok := (<-served).err.(Error); !ok || v.Code() != ERROR_SYSTEM_BANDWIDTH_DENIED {
+		t.Errorf("expect served denied, actual %v", v)
+	}
+}
+
+func TestBandwidthCheckStopClock(t *testing.T) {
+	checker := NewBandwidthChecker("")
+	checker.Duration = 100 * time.Millisecond
+	checker.LimitKbps = 8000
+
+	served := make(chan bandwidth_served, 1)
+	tc_url, close := serve_rtmp(t, "bwcheck", func(s Server) {
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		result, err := checker.Check(context.Background(), s, req)
+		served <- bandwidth_served{result, err}
+	})
+	defer close()
+
+	c, err := dial_bandwidth(t, tc_url)
+	defer c.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the slow client response the stopped after a while, which is not in the duration.
+	delay := 300 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+	p := c.Protocol()
+	for _, v := range []struct{
+		expect string
+		response string
+		delay time.Duration
+	}{
+		{SRS_BW_CHECK_START_PLAY, SRS_BW_CHECK_STARTING_PLAY, 0},
+		{SRS_BW_CHECK_STOP_PLAY, SRS_BW_CHECK_STOPPED_PLAY, delay},
+		{SRS_BW_CHECK_START_PUBLISH, SRS_BW_CHECK_STARTING_PUBLISH, 0},
+		{SRS_BW_CHECK_STOP_PUBLISH, SRS_BW_CHECK_STOPPED_PUBLISH, delay},
+	} {
+		if _, err = expect_bandwidth(ctx, p, v.expect); err != nil {
+			t.Fatalf("expect %v failed, %v", v.expect, err)
+		}
+		time.Sleep(v.delay)
+		if err = p.SendPacket(NewBandwidthPacket(v.response), uint32(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := <-served
+	if v.err != nil {
+		t.Fatal(v.err)
+	}
+	if r := v.result; r.PlayTime >= delay || r.PublishTime >= delay {
+		t.Errorf("expect duration %v, actual play %v, publish %v", checker.Duration, r.PlayTime, r.PublishTime)
+	}
+}
+
+func TestBandwidthCheckSlowLink(t *testing.T) {
+	checker := NewBandwidthChecker("")
+	checker.Duration = 300 * time.Millisecond
+	checker.LimitKbps = 80000
+
+	// the link is 800kbps, the burst of rate limit is 1s.
+	served := make(chan bandwidth_served, 1)
+	tc_url, close := serve_rtmp(t, "bwcheck", func(s Server) {
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		s.Protocol().SetSendRate(800)
+		result, err := checker.Check(context.Background(), s, req)
+		served <- bandwidth_served{result, err}
+	})
+	defer close()
+
+	c, err := dial_bandwidth(t, tc_url)
+	defer c.Destroy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Bandwidth(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the filler queued but not sent is never counted in the duration.
+	v := <-served
+	if v.err != nil {
+		t.Fatal(v.err)
+	}
+	if max := 800 * 13 / 3 * 2; v.result.PlayKbps <= 0 || v.result.PlayKbps > max {
+		t.Errorf("expect play kbps in (0, %v], actual %+v", max, v.result)
+	}
+}
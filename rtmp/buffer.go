@@ -22,6 +22,7 @@
 package rtmp
 
 import (
+	"fmt"
 	"math"
 )
 
@@ -34,14 +35,13 @@ type Buffer struct{
 	buf *HPBuffer
 	// to read bytes and append to buffer.
 	conn *Socket
-	// the 4k socket read buffer
-	skt_buf []byte
+	// the limits to decode the amf0 from stream, nil to use the default limits.
+	limits *Limits
 }
 func NewRtmpBuffer(conn *Socket) (*Buffer) {
 	r := &Buffer{}
 	r.conn = conn
 	r.buf = NewHPBuffer(nil)
-	r.skt_buf = make([]byte, RTMP_SOCKET_READ_SIZE)
 	return r
 }
 func NewRtmpStream(b []byte) (*Buffer) {
@@ -56,13 +56,14 @@ func NewRtmpStream(b []byte) (*Buffer) {
 func (r *Buffer) EnsureBufferBytes(n int) (err error) {
 	var buffer *HPBuffer = r.buf
 
-	for buffer.Len() < n {
-		var nsize int
-		if nsize, err = r.conn.Read(r.skt_buf); err != nil {
-			return
-		}
+	// the stream to decode, without connection.
+	if r.conn == nil && buffer.Len() < n {
+		return Error{code:ERROR_RTMP_MESSAGE_DECODE, desc:fmt.Sprintf("stream requires %v bytes, left %v bytes", n, buffer.Len())}
+	}
 
-		if _, err = buffer.Append(r.skt_buf[0:nsize]); err != nil {
+	// read from connection to buffer directly.
+	for buffer.Len() < n {
+		if _, err = buffer.FillFrom(r.conn, RTMP_SOCKET_READ_SIZE); err != nil {
 			return
 		}
 	}
@@ -98,6 +99,36 @@ func (r *Buffer) WrittenBytes() ([]byte) {
 	return r.buf.WrittenBytes()
 }
 
+/**
+* panic with ERROR_GO_BUFFER_OVERFLOW when stream can't satisfy the requires n bytes,
+* the decoders should check by Requires, @see recover_decode
+ */
+func (r *Buffer) must_requires(n int) {
+	if left := r.Left(); n > left {
+		panic(Error{code:ERROR_GO_BUFFER_OVERFLOW, desc:fmt.Sprintf("read %v bytes, left %v bytes", n, left)})
+	}
+}
+
+/**
+* recover the buffer overflow of decoder to err with the code,
+* the decoder never panic for the truncated data, for the read of Buffer
+* panic when the decoder forgot to check by Requires.
+* @remark other panics are raised again, which are bugs.
+* for example:
+* 		defer recover_decode(&err, ERROR_RTMP_MESSAGE_DECODE)
+ */
+func recover_decode(err *error, code int) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if e, ok := v.(Error); ok && e.code == ERROR_GO_BUFFER_OVERFLOW {
+		*err = Error{code:code, desc:fmt.Sprintf("decode failed, %v", e.desc)}
+		return
+	}
+	panic(v)
+}
+
 // Next returns a slice containing the next n bytes from the buffer,
 // advancing the buffer as if the bytes had been returned by Read.
 // If there are fewer than n bytes in the buffer, Next returns the entire buffer.
@@ -113,6 +144,9 @@ func (r *Buffer) Skip(n int){
 // is drained.
 func (r *Buffer) Read(n int) (b []byte) {
 	b = r.buf.Bytes()
+	if n < 0 || n > len(b) {
+		panic(Error{code:ERROR_GO_BUFFER_OVERFLOW, desc:fmt.Sprintf("read %v bytes, left %v bytes", n, len(b))})
+	}
 	b = b[0:n]
 
 	if err := r.buf.Skip(n); err != nil {
@@ -123,6 +157,7 @@ func (r *Buffer) Read(n int) (b []byte) {
 
 // ReadByte reads and returns the next byte from the buffer.
 func (r* Buffer) ReadByte() (v byte) {
+	r.must_requires(1)
 	b := r.buf.Bytes()
 	v = b[0]
 
@@ -134,6 +169,7 @@ func (r* Buffer) ReadByte() (v byte) {
 
 // ReadByte reads and returns the next 3 bytes from the buffer. in big-endian
 func (r* Buffer) ReadUInt24() (v uint32) {
+	r.must_requires(3)
 	b := r.buf.Bytes()
 	v = uint32(b[2]) | uint32(b[1])<<8 | uint32(b[0])<<16
 	//v = v & 0x00FFFFFF
@@ -145,6 +181,7 @@ func (r* Buffer) ReadUInt24() (v uint32) {
 }
 
 func (r* Buffer) ReadUInt16() (v uint16) {
+	r.must_requires(2)
 	b := r.buf.Bytes()
 	v = uint16(b[1]) | uint16(b[0])<<8
 
@@ -156,6 +193,7 @@ func (r* Buffer) ReadUInt16() (v uint16) {
 
 // ReadByte reads and returns the next 4 bytes from the buffer. in big-endian
 func (r* Buffer) ReadUInt32() (v uint32) {
+	r.must_requires(4)
 	b := r.buf.Bytes()
 	v = uint32(b[3]) | uint32(b[2])<<8 | uint32(b[1])<<16 | uint32(b[0])<<24
 
@@ -167,6 +205,7 @@ func (r* Buffer) ReadUInt32() (v uint32) {
 
 // ReadByte reads and returns the next 8 bytes from the buffer. in big-endian
 func (r* Buffer) ReadFloat64() (v float64) {
+	r.must_requires(8)
 	b := r.buf.Bytes()
 	v64 := uint64(b[7]) | uint64(b[6])<<8 | uint64(b[5])<<16 | uint64(b[4])<<24 |
 		uint64(b[3])<<32 | uint64(b[2])<<40 | uint64(b[1])<<48 | uint64(b[0])<<56
@@ -180,6 +219,7 @@ func (r* Buffer) ReadFloat64() (v float64) {
 
 // ReadByte reads and returns the next 4 bytes from the buffer. in little-endian
 func (r* Buffer) ReadUInt32Le() (v uint32) {
+	r.must_requires(4)
 	b := r.buf.Bytes()
 	v = uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
 
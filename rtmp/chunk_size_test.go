@@ -0,0 +1,106 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"testing"
+)
+
+func TestValidateChunkSize(t *testing.T) {
+	for _, c := range []struct {
+		chunk_size uint32
+		ok bool
+	} {
+		{0, false},
+		{RTMP_MIN_CHUNK_SIZE - 1, false},
+		{RTMP_MIN_CHUNK_SIZE, true},
+		{4096, true},
+		{RTMP_MAX_CHUNK_SIZE, true},
+		{RTMP_MAX_CHUNK_SIZE + 1, false},
+		// the first bit must be zero.
+		{0x80000000 | 4096, false},
+	} {
+		err := ValidateChunkSize(c.chunk_size)
+		if c.ok && err != nil {
+			t.Errorf("chunk size %#x should be ok, %v", c.chunk_size, err)
+		}
+		if !c.ok {
+			if v, ok := err.(Error); !ok || v.code != ERROR_RTMP_CHUNK_SIZE {
+				t.Errorf("chunk size %#x expect ERROR_RTMP_CHUNK_SIZE, actual %v", c.chunk_size, err)
+			}
+		}
+	}
+}
+
+func TestServerSetChunkSize(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+
+	responses := replay_session(t, c.b, 6, func(s Server) {
+		// the out of range size is never sent.
+		for _, chunk_size := range []uint32{RTMP_MIN_CHUNK_SIZE - 1, RTMP_MAX_CHUNK_SIZE + 1, 0x80000000 | 4096} {
+			assert_error_code(t, s.SetChunkSize(chunk_size), ERROR_RTMP_CHUNK_SIZE)
+			assert_error_code(t, s.SetDefaultChunkSize(chunk_size), ERROR_RTMP_CHUNK_SIZE)
+		}
+
+		// the default chunk size is sent after the connect response.
+		if err := s.SetDefaultChunkSize(4096); err != nil {
+			t.Error(err)
+			return
+		}
+		serve_connect(t, s, NewRequest())
+
+		// the client parse the video in the chunk size 4096.
+		if err := s.Protocol().SendMessage(new_av_message(RTMP_MSG_VideoMessage, 0, conformance_frame(true, 3000)), 1); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// the chunk size is protocol control, maybe sent before the queued commands.
+	var commands, controls []string
+	for _, response := range responses {
+		if response == "cid=2 sid=0 SetChunkSize(4096)" {
+			controls = append(controls, response)
+		} else {
+			commands = append(commands, response)
+		}
+	}
+	if len(controls) != 1 {
+		t.Errorf("expect SetChunkSize(4096), actual %v", responses)
+	}
+	assert_responses(t, commands, append(connect_responses(0), "cid=6 sid=1 type=9 size=3000"))
+}
+
+func TestServerRecvInvalidChunkSize(t *testing.T) {
+	for _, chunk_size := range []uint32{RTMP_MIN_CHUNK_SIZE - 1, RTMP_MAX_CHUNK_SIZE + 1, 0x80000000 | 4096} {
+		c := new_seed_session()
+		c.raw(0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, RTMP_MSG_SetChunkSize, 0x00, 0x00, 0x00, 0x00,
+			byte(chunk_size >> 24), byte(chunk_size >> 16), byte(chunk_size >> 8), byte(chunk_size))
+
+		replay_session(t, c.b, 0, func(s Server) {
+			// the stack is closed by the invalid chunk size.
+			<-s.Done()
+			assert_error_code(t, s.Err(), ERROR_RTMP_CHUNK_SIZE)
+		})
+	}
+}
@@ -0,0 +1,438 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+* the rtmp client interface, to publish or play stream on the rtmp server,
+* user can create it by func NewClient() or DialClient(), for example,
+* 		c, err := DialClient(ctx, "rtmp://127.0.0.1/live")
+* 		defer c.Destroy()
+* 		c.Handshake()
+* 		c.ConnectApp(req) // req.TcUrl is "rtmp://127.0.0.1/live"
+* 		stream_id, err := c.Publish("livestream")
+* 		c.Protocol().SendMessage(msg, stream_id)
+ */
+type Client interface {
+	/**
+	* destroy the client stack.
+	 */
+	Destroy()
+	/**
+	* the done channel is closed when the connection is dead,
+	* and Err() to get the error which closed it, @see Protocol.Done()
+	 */
+	Done() (<-chan struct{})
+	Err() (err error)
+	/**
+	* get the underlayer protocol stack sdk.
+	 */
+	Protocol() (Protocol)
+	/**
+	* set the logger of connection, @see Protocol.SetLogger()
+	 */
+	SetLogger(logger Logger)
+	/**
+	* do simple handshake with server.
+	 */
+	Handshake() (err error)
+	/**
+	* handshake with ctx, @see Protocol.SimpleHandshake2ServerContext
+	* @remark for all the *Context methods, the client is closed by the error of ctx
+	* 		when ctx canceled or deadline exceeded, for the client is unusable.
+	 */
+	HandshakeContext(ctx context.Context) (err error)
+	/**
+	* connect the app of req.TcUrl, the req is parsed from the tcUrl,
+	* and the req.ForwardedBy is sent by the FORWARD_MARKER of connect object.
+	* return ERROR_RTMP_ACCESS_DENIED when server rejected, with the description of server.
+	 */
+	ConnectApp(req *Request) (err error)
+	ConnectAppContext(ctx context.Context, req *Request) (err error)
+	/**
+	* create a stream, return the stream id.
+	 */
+	CreateStream() (stream_id uint32, err error)
+	CreateStreamContext(ctx context.Context) (stream_id uint32, err error)
+	/**
+	* publish the stream in the FMLE schema, that is, the releaseStream, FCPublish,
+	* createStream and publish, return when got onStatus(NetStream.Publish.Start).
+	* @param stream the stream name with params, for example, "livestream?key=xxx"
+	* return ERROR_RTMP_ACCESS_DENIED when server rejected, with the description of server.
+	 */
+	Publish(stream string) (stream_id uint32, err error)
+	PublishContext(ctx context.Context, stream string) (stream_id uint32, err error)
+	/**
+	* play the stream, that is, the createStream and play,
+	* return when got onStatus(NetStream.Play.Start),
+	* then user can recv the audio/video from Protocol().
+	* return ERROR_RTMP_ACCESS_DENIED when server rejected, with the description of server.
+	 */
+	Play(stream string) (stream_id uint32, err error)
+	PlayContext(ctx context.Context, stream string) (stream_id uint32, err error)
+	/**
+	* do the bandwidth check after ConnectApp, the server serve it by BandwidthChecker,
+	* the play test measures the downlink, then the publish test measures the uplink,
+	* return the result reported by server in onSrsBandCheckFinished.
+	* the BandwidthContext abort the check when ctx is done, and the client is closed.
+	 */
+	Bandwidth() (result *BandwidthResult, err error)
+	BandwidthContext(ctx context.Context) (result *BandwidthResult, err error)
+}
+
+/**
+* create the rtmp client over the conn, which is connected to server.
+ */
+func NewClient(conn net.Conn) (Client, error) {
+	var err error
+	r := &client{}
+	// the 1 is for connect.
+	r.transaction_id = 1
+	if r.protocol, err = NewProtocol(conn); err != nil {
+		return r, err
+	}
+	return r, err
+}
+
+/**
+* dial the server of tcUrl, and create the client over it.
+* @param tc_url the url of app, for example, rtmp://127.0.0.1:1935/live
+ */
+func DialClient(ctx context.Context, tc_url string) (Client, error) {
+	u, err := url.Parse(tc_url)
+	if err != nil {
+		return nil, Error{code:ERROR_RTMP_REQ_TCURL, desc:fmt.Sprintf("invalid tcUrl %v, %v", tc_url, err)}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), strconv.Itoa(DefaultPort))
+	}
+
+	var d net.Dialer
+	var conn net.Conn
+	if conn, err = d.DialContext(ctx, "tcp", addr); err != nil {
+		return nil, Error{code:ERROR_SOCKET_CREATE, desc:fmt.Sprintf("dial %v failed, %v", addr, err)}
+	}
+
+	var c Client
+	if c, err = NewClient(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type client struct {
+	protocol Protocol
+	// the last transaction id of request.
+	transaction_id float64
+}
+
+func (r *client) Destroy() {
+	r.protocol.Destroy()
+}
+
+func (r *client) Done() (<-chan struct{}) {
+	return r.protocol.Done()
+}
+
+func (r *client) Err() (err error) {
+	return r.protocol.Err()
+}
+
+func (r *client) Protocol() (Protocol) {
+	return r.protocol
+}
+
+func (r *client) SetLogger(logger Logger) {
+	r.protocol.SetLogger(logger)
+}
+
+// log info with the context of connection.
+func (r *client) info(format string, v ...interface {}) {
+	r.protocol.(*protocol).info(format, v...)
+}
+
+func (r *client) Handshake() (err error) {
+	return r.HandshakeContext(context.Background())
+}
+
+func (r *client) HandshakeContext(ctx context.Context) (err error) {
+	return r.protocol.SimpleHandshake2ServerContext(ctx)
+}
+
+func (r *client) ConnectApp(req *Request) (err error) {
+	return r.ConnectAppContext(context.Background(), req)
+}
+
+func (r *client) ConnectAppContext(ctx context.Context, req *Request) (err error) {
+	if err = req.discovery_app(); err != nil {
+		return
+	}
+
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.Vhost, ctx.App, ctx.State = req.Vhost, req.App, LogStateConnect
+	})
+
+	// the params of tcUrl is also in app, for example,
+	// 		app=live?token=xxx, tcUrl=rtmp://127.0.0.1/live?token=xxx
+	app := req.App
+	if pos := strings.Index(req.TcUrl, "?"); pos >= 0 {
+		app += req.TcUrl[pos:]
+	}
+
+	pkt := NewConnectAppPacket()
+	pkt.Set("app", app).Set("flashVer", "FMLE/3.0 (compatible; FMSc/1.0)").Set("tcUrl", req.TcUrl)
+	pkt.Set("swfUrl", req.SwfUrl).Set("pageUrl", req.PageUrl)
+	pkt.Set("fpad", false).Set("capabilities", float64(239)).Set("audioCodecs", float64(3575))
+	pkt.Set("videoCodecs", float64(252)).Set("videoFunction", float64(1)).Set("objectEncoding", float64(req.ObjectEncoding))
+	if len(req.ForwardedBy) > 0 {
+		pkt.Set(FORWARD_MARKER, strings.Join(req.ForwardedBy, ","))
+	}
+	if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+		return
+	}
+
+	var res *ConnectAppResPacket
+	if _, err = r.protocol.ExpectPacketContext(ctx, &res); err != nil {
+		return
+	}
+	if res.CommandName == AMF0_COMMAND_ERROR {
+		return status_error("connect rejected", res.Info)
+	}
+
+	r.info("connect app ok, tcUrl=%v", req.TcUrl)
+	return
+}
+
+func (r *client) CreateStream() (stream_id uint32, err error) {
+	return r.CreateStreamContext(context.Background())
+}
+
+func (r *client) CreateStreamContext(ctx context.Context) (stream_id uint32, err error) {
+	r.transaction_id++
+	transaction_id := r.transaction_id
+
+	pkt := NewCreateStreamPacket()
+	pkt.TransactionId = transaction_id
+	if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+		return
+	}
+
+	err = r.expect(ctx, func(pkt interface {}) (ok bool, err error) {
+		switch pkt := pkt.(type) {
+		case *CreateStreamResPacket:
+			if ok = pkt.TransactionId == transaction_id; ok {
+				stream_id = uint32(pkt.StreamId)
+			}
+		case *OnStatusCallPacket:
+			if ok = pkt.CommandName == AMF0_COMMAND_ERROR && pkt.TransactionId == transaction_id; ok {
+				err = status_error("create stream failed", pkt.Data)
+			}
+		}
+		return
+	})
+	return
+}
+
+func (r *client) Publish(stream string) (stream_id uint32, err error) {
+	return r.PublishContext(context.Background(), stream)
+}
+
+func (r *client) PublishContext(ctx context.Context, stream string) (stream_id uint32, err error) {
+	// releaseStream and FCPublish, the response is ignored.
+	for _, command := range []string{AMF0_COMMAND_RELEASE_STREAM, AMF0_COMMAND_FC_PUBLISH} {
+		r.transaction_id++
+
+		pkt := NewFMLEStartPacket()
+		pkt.CommandName, pkt.TransactionId, pkt.StreamName = command, r.transaction_id, stream
+		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+			return
+		}
+	}
+
+	if stream_id, err = r.CreateStreamContext(ctx); err != nil {
+		return
+	}
+
+	pkt := NewPublishPacket()
+	pkt.StreamName = stream
+	if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+		return
+	}
+	if err = r.expect_status(ctx, SCODE_PublishStart, "publish rejected"); err != nil {
+		return
+	}
+
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.Stream, ctx.State = stream, LogStatePublish
+	})
+	r.info("publish ok, stream_id=%v", stream_id)
+	return
+}
+
+func (r *client) Play(stream string) (stream_id uint32, err error) {
+	return r.PlayContext(context.Background(), stream)
+}
+
+func (r *client) PlayContext(ctx context.Context, stream string) (stream_id uint32, err error) {
+	if stream_id, err = r.CreateStreamContext(ctx); err != nil {
+		return
+	}
+
+	pkt := NewPlayPacket()
+	pkt.StreamName = stream
+	if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+		return
+	}
+	if err = r.expect_status(ctx, SCODE_StreamStart, "play rejected"); err != nil {
+		return
+	}
+
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.Stream, ctx.State = stream, LogStatePlay
+	})
+	r.info("play ok, stream_id=%v", stream_id)
+	return
+}
+
+// expect the onStatus of code, or the error level onStatus.
+func (r *client) expect_status(ctx context.Context, code string, reason string) (err error) {
+	return r.expect(ctx, func(pkt interface {}) (ok bool, err error) {
+		if pkt, ok := pkt.(*OnStatusCallPacket); ok && pkt.CommandName == AMF0_COMMAND_ON_STATUS {
+			if v, _ := pkt.Data.GetPropertyString(SLEVEL); v == SLEVEL_Error {
+				return true, status_error(reason, pkt.Data)
+			}
+			if v, _ := pkt.Data.GetPropertyString(SCODE); v == code {
+				return true, nil
+			}
+		}
+		return
+	})
+}
+
+// the bandwidth check, response the commands of server in order, @see BandwidthChecker.
+func (r *client) Bandwidth() (result *BandwidthResult, err error) {
+	return r.BandwidthContext(context.Background())
+}
+
+func (r *client) BandwidthContext(ctx context.Context) (result *BandwidthResult, err error) {
+	p := r.protocol
+	defer func() {
+		if err != nil {
+			err = p.(*protocol).close_by_context(ctx, err)
+		}
+	}()
+
+	// play test, recv the filler util server stop it.
+	if _, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_START_PLAY); err != nil {
+		return
+	}
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_STARTING_PLAY), uint32(0)); err != nil {
+		return
+	}
+	if _, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_STOP_PLAY); err != nil {
+		return
+	}
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_STOPPED_PLAY), uint32(0)); err != nil {
+		return
+	}
+
+	// publish test, send the filler in the duration and limit of server.
+	var pkt *BandwidthPacket
+	if pkt, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_START_PUBLISH); err != nil {
+		return
+	}
+	duration_ms, _ := pkt.Data.GetPropertyNumber("duration_ms")
+	limit_kbps, _ := pkt.Data.GetPropertyNumber("limit_kbps")
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_STARTING_PUBLISH), uint32(0)); err != nil {
+		return
+	}
+
+	start := time.Now()
+	for sent := uint64(0); time.Since(start) < time.Duration(duration_ms) * time.Millisecond; {
+		pkt := NewBandwidthPacket(SRS_BW_CHECK_PUBLISHING).Set("data", bandwidth_filler)
+		sent += uint64(pkt.GetSize())
+		if err = p.SendPacket(pkt, uint32(0)); err != nil {
+			return
+		}
+		if err = bandwidth_limit(ctx, start, sent, int(limit_kbps)); err != nil {
+			return
+		}
+	}
+	if _, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_STOP_PUBLISH); err != nil {
+		return
+	}
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_STOPPED_PUBLISH), uint32(0)); err != nil {
+		return
+	}
+
+	// the report of server, confirm by the final packet.
+	if pkt, err = expect_bandwidth(ctx, p, SRS_BW_CHECK_FINISHED); err != nil {
+		return
+	}
+	if err = p.SendPacket(NewBandwidthPacket(SRS_BW_CHECK_FLASH_FINAL), uint32(0)); err != nil {
+		return
+	}
+	return bandwidth_report(pkt.Data), nil
+}
+
+/**
+* recv and decode the packets, util the match is ok, drop the others.
+ */
+func (r *client) expect(ctx context.Context, match func(pkt interface {}) (ok bool, err error)) (err error) {
+	for {
+		var msg *Message
+		if msg, err = r.protocol.RecvMessageContext(ctx); err != nil {
+			err = r.protocol.(*protocol).close_by_context(ctx, err)
+			return
+		}
+
+		var pkt interface {}
+		if pkt, err = r.protocol.DecodeMessage(msg); err != nil {
+			return
+		}
+		msg.Release()
+
+		var ok bool
+		if ok, err = match(pkt); ok || err != nil {
+			return
+		}
+	}
+}
+
+// the error of server rejected, the desc is the code and description of status.
+func status_error(reason string, info *Amf0Object) (error) {
+	code, _ := info.GetPropertyString(SCODE)
+	desc, _ := info.GetPropertyString(SDESC)
+	return Error{code:ERROR_RTMP_ACCESS_DENIED, desc:fmt.Sprintf("%v, code=%v, description=%v", reason, code, desc)}
+}
@@ -0,0 +1,239 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listen on loopback and serve each rtmp connection, return the tcUrl of app and the close func.
+func serve_rtmp(t *testing.T, app string, serve func(s Server)) (tc_url string, close func()) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP:net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := &sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				s, err := NewServer(conn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer s.Destroy()
+
+				if err := s.Handshake(); err != nil {
+					t.Error(err)
+					return
+				}
+				serve(s)
+			}()
+		}
+	}()
+
+	return fmt.Sprintf("rtmp://%v/%v", l.Addr(), app), func() {
+		l.Close()
+		wait.Wait()
+	}
+}
+
+func new_av_message(message_type byte, timestamp uint64, payload []byte) (*Message) {
+	msg := NewMessage()
+	msg.Header.MessageType = message_type
+	msg.Header.Timestamp = timestamp
+	msg.Header.PayloadLength = uint32(len(payload))
+	msg.Payload = payload
+	msg.PerferCid = RTMP_CID_Video
+	if message_type == RTMP_MSG_AudioMessage {
+		msg.PerferCid = RTMP_CID_Audio
+	}
+	return msg
+}
+
+func dial_client(t *testing.T, tc_url string, forwarded_by ...string) (Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	c, err := DialClient(ctx, tc_url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.HandshakeContext(ctx); err != nil {
+		c.Destroy()
+		t.Fatal(err)
+	}
+
+	req := NewRequest()
+	req.TcUrl = tc_url + "?token=abc"
+	req.ForwardedBy = forwarded_by
+	if err = c.ConnectAppContext(ctx, req); err != nil {
+		c.Destroy()
+		t.Fatal(err)
+	}
+	if req.App != "live" || req.Param.Get("token") != "abc" {
+		t.Errorf("app=%v, param=%v", req.App, req.Param)
+	}
+	return c
+}
+
+func TestClientPublish(t *testing.T) {
+	var req *Request
+	var msgs []conformance_av
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		req = NewRequest()
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream?key=xxx")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+			return
+		}
+		msgs = recv_av_messages(t, s, 2)
+	})
+
+	c := dial_client(t, tc_url, "server-a", "server-b")
+	defer c.Destroy()
+
+	stream_id, err := c.Publish("livestream?key=xxx")
+	if err != nil || stream_id != 1 {
+		t.Fatalf("publish stream_id=%v, %v", stream_id, err)
+	}
+	if err = c.Protocol().SendMessage(new_av_message(RTMP_MSG_AudioMessage, 0, aac_sequence_header), stream_id); err != nil {
+		t.Error(err)
+	}
+	if err = c.Protocol().SendMessage(new_av_message(RTMP_MSG_VideoMessage, 40, conformance_frame(true, 1024)), stream_id); err != nil {
+		t.Error(err)
+	}
+	close()
+
+	if req.Param.Get("token") != "abc" || !reflect.DeepEqual(req.ForwardedBy, []string{"server-a", "server-b"}) {
+		t.Errorf("param=%v, forwarded by %v", req.Param, req.ForwardedBy)
+	}
+	expect := []conformance_av{
+		{RTMP_MSG_AudioMessage, 0, 1, len(aac_sequence_header)},
+		{RTMP_MSG_VideoMessage, 40, 1, 1024},
+	}
+	if !reflect.DeepEqual(msgs, expect) {
+		t.Errorf("expect %v, actual %v", expect, msgs)
+	}
+}
+
+func TestClientPlay(t *testing.T) {
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.Protocol().SendMessage(new_av_message(RTMP_MSG_VideoMessage, 40, avc_sequence_header), 1); err != nil {
+			t.Error(err)
+		}
+		<-s.Done()
+	})
+	defer close()
+
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+
+	stream_id, err := c.Play("livestream")
+	if err != nil || stream_id != 1 {
+		t.Fatalf("play stream_id=%v, %v", stream_id, err)
+	}
+	for {
+		msg, err := c.Protocol().RecvMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.IsVideo() {
+			if msg.Header.StreamId != 1 || msg.Header.Timestamp != 40 || len(msg.Payload) != len(avc_sequence_header) {
+				t.Errorf("video %v", message_dump(msg))
+			}
+			break
+		}
+	}
+}
+
+func TestClientRejected(t *testing.T) {
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Param.Get("token") == "" {
+			s.RejectConnectApp(req, "token required")
+			<-s.Done()
+			return
+		}
+		if err := s.ReponseConnectApp(req, "", nil); err != nil {
+			t.Error(err)
+		}
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.RejectPublish(1, "stream is busy"); err != nil {
+			t.Error(err)
+		}
+		<-s.Done()
+	})
+	defer close()
+
+	// reject connect.
+	c, err := DialClient(context.Background(), tc_url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Destroy()
+	if err = c.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	req := NewRequest()
+	req.TcUrl = tc_url
+	err = c.ConnectApp(req)
+	if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED || !strings.Contains(v.Desc(), "token required") {
+		t.Errorf("expect connect rejected, actual %v", err)
+	}
+
+	// reject publish.
+	c = dial_client(t, tc_url)
+	defer c.Destroy()
+	_, err = c.Publish("livestream")
+	if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED || !strings.Contains(v.Desc(), "stream is busy") {
+		t.Errorf("expect publish rejected, actual %v", err)
+	}
+}
@@ -0,0 +1,507 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+/**
+* the directive of config, the nginx/SRS style, for example,
+* 		# the default vhost.
+* 		vhost __defaultVhost__ {
+* 			chunk_size 60000;
+* 			ack_window 2500000;
+* 			peer_bandwidth 2500000 dynamic;
+* 			send_rate 8000;
+* 			clients play fmle_publish flash_publish;
+* 			http_hooks {
+* 				on_publish http://127.0.0.1:8085/api/v1/streams;
+* 			}
+* 			app live {
+* 				gop_cache on;
+* 			}
+* 		}
+* the directive "vhost __defaultVhost__ {}" is Name="vhost", Args=["__defaultVhost__"],
+* and the directives in block is the Directives.
+ */
+type ConfDirective struct {
+	// the line of directive in config file, start from 1, 0 for the root.
+	Line int
+	Name string
+	Args []string
+	Directives []*ConfDirective
+}
+
+// get the first arg, empty when no args.
+func (r *ConfDirective) Arg0() (string) {
+	return r.Arg(0)
+}
+
+// get the arg at index, empty when not exists.
+func (r *ConfDirective) Arg(index int) (string) {
+	if index < len(r.Args) {
+		return r.Args[index]
+	}
+	return ""
+}
+
+// get the first sub directive by name, nil when not found.
+func (r *ConfDirective) Get(name string) (*ConfDirective) {
+	for _, v := range r.Directives {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+/**
+* the config of application, the free-form key/value directives of app block,
+* the value is the args joined by space, for example, "gop_cache on;" is gop_cache=on.
+ */
+type AppConfig struct {
+	Name string
+	Params map[string]string
+}
+
+// get the param of app, ok is false when not configured.
+func (r *AppConfig) Get(key string) (value string, ok bool) {
+	value, ok = r.Params[key]
+	return
+}
+
+/**
+* the config of vhost, the zero value of field means not configured,
+* the server use the default value, or what user set.
+ */
+type VhostConfig struct {
+	Name string
+	/**
+	* the out chunk size, set by server after ConnectApp response.
+	* @see Server.SetDefaultChunkSize
+	 */
+	ChunkSize uint32
+	// the window ack size, sent by server in ConnectApp.
+	AckWindow uint32
+	// the peer bandwidth and limit type, sent by server in ConnectApp.
+	PeerBandwidth uint32
+	PeerBandwidthType byte
+	// the max output kbps of connection, @see Protocol.SetSendRate
+	SendRate uint32
+	// the allowed CLIENT_TYPE_*, empty to allow all.
+	Clients []string
+	// the urls of http hooks, nil when not configured.
+	Hooks *HTTPHooksConfig
+	// the apps in vhost, key is the app name.
+	Apps map[string]*AppConfig
+	// the directive of vhost, for the directives not parsed.
+	Directive *ConfDirective
+}
+
+// whether the client type is allowed by vhost.
+func (r *VhostConfig) AllowClient(client_type string) (bool) {
+	if len(r.Clients) == 0 {
+		return true
+	}
+	for _, v := range r.Clients {
+		if v == client_type {
+			return true
+		}
+	}
+	return false
+}
+
+// get the config of app, nil when not configured.
+func (r *VhostConfig) App(name string) (*AppConfig) {
+	return r.Apps[name]
+}
+
+/**
+* the parsed config, never changed once parsed, reload create a new one.
+ */
+type Config struct {
+	// the root directive, the directives of config file.
+	Root *ConfDirective
+	// the vhosts in order of config file.
+	Vhosts []*VhostConfig
+	vhosts map[string]*VhostConfig
+}
+
+/**
+* parse the config from data, the nginx/SRS style.
+* @see ConfDirective for the syntax.
+ */
+func ParseConfig(data []byte) (*Config, error) {
+	p := &conf_parser{data:data, line:1}
+	root := &ConfDirective{}
+
+	var err error
+	if root.Directives, err = p.parse_block(false); err != nil {
+		return nil, err
+	}
+
+	r := &Config{Root:root, vhosts:map[string]*VhostConfig{}}
+	for _, d := range root.Directives {
+		if d.Name != "vhost" {
+			continue
+		}
+
+		var vhost *VhostConfig
+		if vhost, err = parse_vhost(d); err != nil {
+			return nil, err
+		}
+		if _, ok := r.vhosts[vhost.Name]; ok {
+			return nil, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: duplicated vhost %v", d.Line, vhost.Name)}
+		}
+		r.vhosts[vhost.Name] = vhost
+		r.Vhosts = append(r.Vhosts, vhost)
+	}
+	return r, nil
+}
+
+// load the config from file.
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("read config %v failed, %v", file, err)}
+	}
+	return ParseConfig(data)
+}
+
+/**
+* get the vhost config, or the DefaultVhost when not configured,
+* nil when both not found.
+ */
+func (r *Config) Vhost(name string) (*VhostConfig) {
+	if v, ok := r.vhosts[name]; ok {
+		return v
+	}
+	return r.vhosts[DefaultVhost]
+}
+
+func parse_vhost(d *ConfDirective) (r *VhostConfig, err error) {
+	if d.Arg0() == "" {
+		return nil, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: vhost name required", d.Line)}
+	}
+
+	r = &VhostConfig{Name:d.Arg0(), Apps:map[string]*AppConfig{}, Directive:d}
+	for _, v := range d.Directives {
+		switch v.Name {
+		case "chunk_size":
+			if r.ChunkSize, err = parse_conf_uint32(v); err != nil {
+				return
+			}
+			if err = ValidateChunkSize(r.ChunkSize); err != nil {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: %v", v.Line, err)}
+			}
+		case "ack_window":
+			if r.AckWindow, err = parse_conf_uint32(v); err != nil {
+				return
+			}
+		case "peer_bandwidth":
+			if r.PeerBandwidth, err = parse_conf_uint32(v); err != nil {
+				return
+			}
+			if r.PeerBandwidthType, err = parse_conf_bandwidth_type(v); err != nil {
+				return
+			}
+		case "send_rate":
+			if r.SendRate, err = parse_conf_uint32(v); err != nil {
+				return
+			}
+		case "clients":
+			for _, client_type := range v.Args {
+				if client_type != CLIENT_TYPE_Play && client_type != CLIENT_TYPE_FMLEPublish && client_type != CLIENT_TYPE_FlashPublish {
+					return nil, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: invalid client type %v", v.Line, client_type)}
+				}
+			}
+			r.Clients = v.Args
+		case "http_hooks":
+			r.Hooks = parse_hooks(v)
+		case "app":
+			if v.Arg0() == "" {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: app name required", v.Line)}
+			}
+			app := &AppConfig{Name:v.Arg0(), Params:map[string]string{}}
+			for _, p := range v.Directives {
+				app.Params[p.Name] = strings.Join(p.Args, " ")
+			}
+			r.Apps[app.Name] = app
+		}
+	}
+	return
+}
+
+func parse_hooks(d *ConfDirective) (r *HTTPHooksConfig) {
+	r = &HTTPHooksConfig{}
+	for _, v := range d.Directives {
+		switch v.Name {
+		case HOOK_ACTION_OnConnect:
+			r.OnConnect = append(r.OnConnect, v.Args...)
+		case HOOK_ACTION_OnPublish:
+			r.OnPublish = append(r.OnPublish, v.Args...)
+		case HOOK_ACTION_OnUnpublish:
+			r.OnUnpublish = append(r.OnUnpublish, v.Args...)
+		case HOOK_ACTION_OnPlay:
+			r.OnPlay = append(r.OnPlay, v.Args...)
+		case HOOK_ACTION_OnStop:
+			r.OnStop = append(r.OnStop, v.Args...)
+		case HOOK_ACTION_OnDvr:
+			r.OnDvr = append(r.OnDvr, v.Args...)
+		}
+	}
+	return
+}
+
+func parse_conf_uint32(d *ConfDirective) (v uint32, err error) {
+	var n uint64
+	if n, err = strconv.ParseUint(d.Arg0(), 10, 32); err != nil {
+		return 0, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: invalid %v %v", d.Line, d.Name, d.Arg0())}
+	}
+	return uint32(n), nil
+}
+
+// parse the limit type of peer bandwidth, default to dynamic.
+func parse_conf_bandwidth_type(d *ConfDirective) (v byte, err error) {
+	switch d.Arg(1) {
+	case "hard":
+		return PeerBandwidthHard, nil
+	case "soft":
+		return PeerBandwidthSoft, nil
+	case "dynamic", "":
+		return PeerBandwidthDynamic, nil
+	}
+	return 0, Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:fmt.Sprintf("line %v: invalid %v type %v", d.Line, d.Name, d.Arg(1))}
+}
+
+/**
+* the parser of config, the tokens are the words, quoted strings,
+* and the special chars ";", "{" and "}", the "#" starts a comment line.
+ */
+type conf_parser struct {
+	data []byte
+	pos int
+	line int
+}
+
+// the token of config, the quoted string never be a special char.
+type conf_token struct {
+	value string
+	line int
+	special bool
+}
+
+/**
+* parse the directives of block, util "}" when in_block, or EOF when root.
+ */
+func (r *conf_parser) parse_block(in_block bool) (directives []*ConfDirective, err error) {
+	var args []*conf_token
+	for {
+		var token *conf_token
+		if token, err = r.next_token(); err != nil {
+			return
+		}
+
+		// EOF
+		if token == nil {
+			if len(args) > 0 {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_EOF, desc:fmt.Sprintf("line %v: unexpected end of file, expecting ; or {", args[0].line)}
+			}
+			if in_block {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_BLOCK_END, desc:fmt.Sprintf("line %v: unexpected end of file, expecting }", r.line)}
+			}
+			return
+		}
+
+		if !token.special {
+			args = append(args, token)
+			continue
+		}
+
+		switch token.value {
+		case ";":
+			if len(args) == 0 {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_DIRECTIVE, desc:fmt.Sprintf("line %v: unexpected ;", token.line)}
+			}
+			directives = append(directives, new_conf_directive(args))
+		case "{":
+			if len(args) == 0 {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_BLOCK_START, desc:fmt.Sprintf("line %v: unexpected {", token.line)}
+			}
+			d := new_conf_directive(args)
+			if d.Directives, err = r.parse_block(true); err != nil {
+				return
+			}
+			directives = append(directives, d)
+		case "}":
+			if !in_block {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_BLOCK_END, desc:fmt.Sprintf("line %v: unexpected }", token.line)}
+			}
+			if len(args) > 0 {
+				return nil, Error{code:ERROR_SYSTEM_CONFIG_DIRECTIVE, desc:fmt.Sprintf("line %v: directive %v is not terminated by ;", args[0].line, args[0].value)}
+			}
+			return
+		}
+		args = nil
+	}
+}
+
+func new_conf_directive(args []*conf_token) (*ConfDirective) {
+	r := &ConfDirective{Line:args[0].line, Name:args[0].value}
+	for _, v := range args[1:] {
+		r.Args = append(r.Args, v.value)
+	}
+	return r
+}
+
+// read the next token, nil when EOF.
+func (r *conf_parser) next_token() (token *conf_token, err error) {
+	// skip the spaces and comments.
+	for r.pos < len(r.data) {
+		ch := r.data[r.pos]
+		if ch == '\n' {
+			r.line++
+		}
+		if ch == '#' {
+			for r.pos < len(r.data) && r.data[r.pos] != '\n' {
+				r.pos++
+			}
+			continue
+		}
+		if ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+			break
+		}
+		r.pos++
+	}
+	if r.pos >= len(r.data) {
+		return nil, nil
+	}
+
+	ch := r.data[r.pos]
+	if ch == ';' || ch == '{' || ch == '}' {
+		r.pos++
+		return &conf_token{value:string(ch), line:r.line, special:true}, nil
+	}
+
+	// the quoted string, which can contains spaces and special chars.
+	if ch == '"' || ch == '\'' {
+		end := strings.IndexByte(string(r.data[r.pos + 1:]), ch)
+		if end < 0 {
+			return nil, Error{code:ERROR_SYSTEM_CONFIG_EOF, desc:fmt.Sprintf("line %v: unexpected end of file, expecting %c", r.line, ch)}
+		}
+		token = &conf_token{value:string(r.data[r.pos + 1:r.pos + 1 + end]), line:r.line}
+		r.line += strings.Count(token.value, "\n")
+		r.pos += end + 2
+		return
+	}
+
+	start := r.pos
+	for r.pos < len(r.data) && !strings.ContainsRune(" \t\r\n;{}#\"'", rune(r.data[r.pos])) {
+		r.pos++
+	}
+	return &conf_token{value:string(r.data[start:r.pos]), line:r.line}, nil
+}
+
+/**
+* the config file, which can reload when SIGHUP, for example,
+* 		f, err := NewConfigFile("rtmp.conf")
+* 		go f.ReloadOnSignal(ctx, nil)
+* 		// for each new connection:
+* 		s.SetConfig(f.Config())
+* the connections use the config when created, the reload never affect them.
+ */
+type ConfigFile struct {
+	file string
+	// the current config, the value is *Config.
+	config atomic.Value
+	lock *sync.Mutex
+}
+
+/**
+* load the config file, return error when parse failed.
+ */
+func NewConfigFile(file string) (*ConfigFile, error) {
+	r := &ConfigFile{file:file, lock:&sync.Mutex{}}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// get the current config.
+func (r *ConfigFile) Config() (*Config) {
+	return r.config.Load().(*Config)
+}
+
+/**
+* reload the config file, the current config is kept when failed.
+ */
+func (r *ConfigFile) Reload() (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var c *Config
+	if c, err = LoadConfig(r.file); err != nil {
+		return
+	}
+	r.config.Store(c)
+	return
+}
+
+/**
+* reload the config when got SIGHUP, util the ctx is done.
+* @param on_reload the callback after each reload, the err is the reload error,
+* 		and the config is the current one, for example, apply the http hooks.
+* 		nil to ignore.
+ */
+func (r *ConfigFile) ReloadOnSignal(ctx context.Context, on_reload func(c *Config, err error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	r.reload_on(ctx, signals, on_reload)
+}
+
+// reload the config when got signal, util the ctx is done.
+func (r *ConfigFile) reload_on(ctx context.Context, signals <-chan os.Signal, on_reload func(c *Config, err error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			err := r.Reload()
+			if on_reload != nil {
+				on_reload(r.Config(), err)
+			}
+		}
+	}
+}
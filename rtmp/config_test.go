@@ -0,0 +1,282 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+const test_config = `
+# the default vhost.
+vhost __defaultVhost__ {
+	chunk_size 60000;
+	clients play;
+}
+
+vhost config.test {
+	ack_window 2500000;
+	peer_bandwidth 1000000 hard; # the hard limit.
+	send_rate 8000;
+	clients fmle_publish flash_publish;
+	http_hooks {
+		on_publish http://127.0.0.1:8085/api/v1/streams http://127.0.0.1:8086/api/v1/streams;
+		on_play "http://127.0.0.1:8085/api/v1/sessions";
+	}
+	app live {
+		gop_cache on;
+		refer "github.com" 'ossrs.net';
+	}
+}
+`
+
+func TestParseConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(test_config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Vhosts) != 2 || c.Vhosts[0].Name != DefaultVhost || c.Vhosts[1].Name != "config.test" {
+		t.Fatalf("vhosts %v", c.Vhosts)
+	}
+
+	v := c.Vhost(DefaultVhost)
+	if v.ChunkSize != 60000 || v.AckWindow != 0 || !v.AllowClient(CLIENT_TYPE_Play) || v.AllowClient(CLIENT_TYPE_FMLEPublish) || v.Hooks != nil {
+		t.Errorf("default vhost %+v", v)
+	}
+
+	v = c.Vhost("config.test")
+	if v.ChunkSize != 0 || v.AckWindow != 2500000 || v.PeerBandwidth != 1000000 || v.PeerBandwidthType != PeerBandwidthHard || v.SendRate != 8000 {
+		t.Errorf("vhost %+v", v)
+	}
+	if v.AllowClient(CLIENT_TYPE_Play) || !v.AllowClient(CLIENT_TYPE_FlashPublish) {
+		t.Errorf("clients %v", v.Clients)
+	}
+	if !reflect.DeepEqual(v.Hooks.OnPublish, []string{"http://127.0.0.1:8085/api/v1/streams", "http://127.0.0.1:8086/api/v1/streams"}) ||
+		!reflect.DeepEqual(v.Hooks.OnPlay, []string{"http://127.0.0.1:8085/api/v1/sessions"}) {
+		t.Errorf("hooks %+v", v.Hooks)
+	}
+	if v.App("live") == nil || v.App("other") != nil {
+		t.Fatalf("apps %v", v.Apps)
+	}
+	if p, ok := v.App("live").Get("gop_cache"); !ok || p != "on" {
+		t.Errorf("gop_cache %v", p)
+	}
+	if p, _ := v.App("live").Get("refer"); p != "github.com ossrs.net" {
+		t.Errorf("refer %v", p)
+	}
+	if d := v.Directive.Get("peer_bandwidth"); d == nil || d.Line != 10 || d.Arg(1) != "hard" || d.Arg(2) != "" {
+		t.Errorf("directive %+v", d)
+	}
+
+	// fallback to default vhost.
+	if v = c.Vhost("other.test"); v == nil || v.Name != DefaultVhost {
+		t.Errorf("vhost %+v", v)
+	}
+	if c, err = ParseConfig([]byte("vhost config.test {}")); err != nil || c.Vhost("other.test") != nil {
+		t.Errorf("expect no vhost, err=%v", err)
+	}
+}
+
+func TestParseConfigError(t *testing.T) {
+	for _, c := range []struct {
+		conf string
+		code int
+	}{
+		{"vhost a { chunk_size 128 }", ERROR_SYSTEM_CONFIG_DIRECTIVE},
+		{"vhost a { ; }", ERROR_SYSTEM_CONFIG_DIRECTIVE},
+		{"vhost a { { } }", ERROR_SYSTEM_CONFIG_BLOCK_START},
+		{"vhost a { }\n}", ERROR_SYSTEM_CONFIG_BLOCK_END},
+		{"vhost a {\n", ERROR_SYSTEM_CONFIG_BLOCK_END},
+		{"vhost a { } listen 1935", ERROR_SYSTEM_CONFIG_EOF},
+		{"vhost a { app \"live; }", ERROR_SYSTEM_CONFIG_EOF},
+		{"vhost a { chunk_size 1; }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost a { chunk_size x; }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost a { peer_bandwidth 1000 any; }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost a { send_rate -1; }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost a { clients play edge; }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost a { app { } }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost { }", ERROR_SYSTEM_CONFIG_INVALID},
+		{"vhost a { } vhost a { }", ERROR_SYSTEM_CONFIG_INVALID},
+	} {
+		_, err := ParseConfig([]byte(c.conf))
+		if v, ok := err.(Error); !ok || v.Code() != c.code {
+			t.Errorf("config %v, expect %v, actual %v", c.conf, c.code, err)
+		}
+	}
+}
+
+func TestConfigFileReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rtmp-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "rtmp.conf")
+	if err = ioutil.WriteFile(file, []byte("vhost a { chunk_size 4096; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewConfigFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := f.Config()
+
+	// reload by signal.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal)
+	reloaded := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.reload_on(ctx, signals, func(c *Config, err error) {
+			reloaded <- err
+		})
+	}()
+
+	ioutil.WriteFile(file, []byte("vhost a { chunk_size 8192; }"), 0644)
+	signals <- syscall.SIGHUP
+	if err = <-reloaded; err != nil {
+		t.Error(err)
+	}
+	if f.Config().Vhost("a").ChunkSize != 8192 || old.Vhost("a").ChunkSize != 4096 {
+		t.Errorf("config not reloaded")
+	}
+
+	// keep the current config when failed.
+	ioutil.WriteFile(file, []byte("vhost a { chunk_size 8192 }"), 0644)
+	signals <- syscall.SIGHUP
+	if err = <-reloaded; err == nil {
+		t.Error("expect reload failed")
+	}
+	if f.Config().Vhost("a").ChunkSize != 8192 {
+		t.Errorf("config changed")
+	}
+
+	cancel()
+	<-done
+
+	if _, err = NewConfigFile(filepath.Join(dir, "none.conf")); err == nil {
+		t.Error("expect load failed")
+	}
+}
+
+func TestConfigConnectApp(t *testing.T) {
+	c, err := ParseConfig([]byte(test_config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := new_seed_session()
+	session.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live?vhost=config.test")))
+	session.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	session.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "livestream"))
+
+	responses := replay_session(t, session.b, 5, func(s Server) {
+		s.SetConfig(c)
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		if s.Vhost() != c.Vhost("config.test") || req.Vhost != "config.test" {
+			t.Errorf("vhost %v", req.Vhost)
+		}
+		if err := s.ReponseConnectApp(req, "", nil); err != nil {
+			t.Error(err)
+		}
+
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		err := s.StartPlay(1)
+		if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED {
+			t.Errorf("expect access denied, actual %v", err)
+		}
+	})
+
+	assert_responses(t, responses, []string{
+		"cid=2 sid=0 WindowAckSize(2500000)",
+		"cid=2 sid=0 SetPeerBandwidth(1000000,0)",
+		`cid=3 sid=0 "_result",1,{fmsVer:"FMS/3,5,3,888",capabilities:127,mode:1},{level:"status",code:"NetConnection.Connect.Success",description:"Connection succeeded",objectEncoding:0,data:[version:"3,5,3,888"]}`,
+		`cid=3 sid=0 "_result",2,null,1`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Play.StreamNotFound",description:"client type play not allowed",details:"stream",clientid:"ASAICiss"}`,
+	})
+}
+
+func TestConfigDefaultVhost(t *testing.T) {
+	c, err := ParseConfig([]byte(test_config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := new_seed_session()
+	session.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+
+	responses := replay_session(t, session.b, 2, func(s Server) {
+		s.SetConfig(c)
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		if req.Vhost != DefaultVhost || s.Protocol().LogContext().Vhost != DefaultVhost {
+			t.Errorf("vhost %v", req.Vhost)
+		}
+		if err := s.ReponseConnectApp(req, "", nil); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// the protocol control message is sent before the command.
+	if len(responses) != 2 || responses[0] != "cid=2 sid=0 SetChunkSize(60000)" {
+		t.Errorf("responses %v", responses)
+	}
+}
+
+func TestConfigVhostNotFound(t *testing.T) {
+	c, err := ParseConfig([]byte("vhost config.test {}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session := new_seed_session()
+	session.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+
+	// the server is closed when vhost not found, the client must got the rejection.
+	responses := replay_and_destroy(t, session.b, func(s Server) {
+		s.SetConfig(c)
+		err := s.ConnectApp(NewRequest())
+		if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_VHOST_NOT_FOUND {
+			t.Errorf("expect vhost not found, actual %v", err)
+		}
+	})
+
+	assert_last_response(t, responses, `cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"vhost not found"}`)
+}
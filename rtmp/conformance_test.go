@@ -0,0 +1,455 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"net"
+	"testing"
+	"time"
+)
+
+/**
+* the conformance tests replay the client->server traffic of encoders and players
+* through NewServer over net.Pipe, assert the decoded request, the identified client
+* and every response of server.
+* the sessions in testdata/sessions are the client->server bytes from the c0c1,
+* the librtmp sessions are captured, the FMLE, OBS, Flash Player and Wirecast sessions
+* are reconstructed from their traces, see testdata/sessions/README.
+* to add a capture, save the client->server stream of tcp as testdata/sessions/name.rtmp
+ */
+
+// render the message sent by server, one line per message.
+func render_message(msg *Message) (s string) {
+	h := msg.Header
+	s = fmt.Sprintf("cid=%v sid=%v ", msg.PerferCid, h.StreamId)
+
+	stream := NewRtmpStream(msg.Payload)
+	switch {
+	case h.IsAmf0Command() || h.IsAmf0Data():
+		return s + amf0_dump(msg.Payload)
+	case h.IsSetChunkSize():
+		return s + fmt.Sprintf("SetChunkSize(%v)", stream.ReadUInt32())
+	case h.IsWindowAcknowledgementSize():
+		return s + fmt.Sprintf("WindowAckSize(%v)", stream.ReadUInt32())
+	case h.MessageType == RTMP_MSG_SetPeerBandwidth:
+		return s + fmt.Sprintf("SetPeerBandwidth(%v,%v)", stream.ReadUInt32(), stream.ReadByte())
+	case h.IsUserControlMessage():
+		return s + fmt.Sprintf("UserControl(%v,%v)", stream.ReadUInt16(), stream.ReadUInt32())
+	}
+	return s + fmt.Sprintf("type=%v size=%v", h.MessageType, len(msg.Payload))
+}
+
+// load the session from testdata/sessions, the client->server bytes from the c0c1.
+func load_session(t *testing.T, name string) ([]byte) {
+	b, err := os.ReadFile(filepath.Join("testdata", "sessions", name + ".rtmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 1537 + 1536 {
+		t.Fatalf("session %v requires c0c1 and c2, size %v", name, len(b))
+	}
+	return b
+}
+
+/**
+* write the c0c1 of session, read the s0s1s2 of server,
+* then write the c2 and messages in background.
+ */
+func replay_handshake(conn net.Conn, session []byte) (err error) {
+	if _, err = conn.Write(session[:1537]); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 3073)); err != nil {
+		return
+	}
+
+	go conn.Write(session[1537:])
+	return
+}
+
+/**
+* replay the session to server, the serve runs the server,
+* return the rendered messages sent by server.
+ */
+func replay_session(t *testing.T, session []byte, nb_responses int, serve func(s Server)) (responses []string) {
+	server_conn, client_conn := net.Pipe()
+	defer client_conn.Close()
+
+	s, err := NewServer(server_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Destroy()
+
+	// the client handshake, then send session and parse the responses.
+	messages := make(chan string, 100)
+	go func() {
+		defer close(messages)
+		if err := replay_handshake(client_conn, session); err != nil {
+			return
+		}
+
+		parser := new_protocol(NewSocket(client_conn))
+		for {
+			msg, err := parser.do_recv_msg_goroutine_job()
+			if err != nil {
+				return
+			}
+			if msg != nil {
+				messages <- render_message(msg)
+			}
+		}
+	}()
+
+	must_complete(t, 3 * time.Second, "serve", func() {
+		if err := s.Handshake(); err != nil {
+			t.Error(err)
+			return
+		}
+		serve(s)
+	})
+
+	timeout := time.After(3 * time.Second)
+	for len(responses) < nb_responses {
+		select {
+		case msg, ok := <- messages:
+			if !ok {
+				t.Fatalf("connection closed, got %v responses", len(responses))
+			}
+			responses = append(responses, msg)
+		case <- timeout:
+			t.Fatalf("got %v responses, expect %v", len(responses), nb_responses)
+		}
+	}
+	return
+}
+
+func assert_responses(t *testing.T, actual []string, expect []string) {
+	for i := range expect {
+		if actual[i] != expect[i] {
+			t.Errorf("response #%v\nexpect: %v\nactual: %v", i, expect[i], actual[i])
+		}
+	}
+}
+
+// the audio/video/data message got by server.
+type conformance_av struct {
+	message_type byte
+	timestamp uint64
+	stream_id uint32
+	size int
+}
+
+// recv n audio/video/data messages after publish.
+func recv_av_messages(t *testing.T, s Server, n int) (msgs []conformance_av) {
+	for len(msgs) < n {
+		msg, err := s.Protocol().RecvMessage()
+		if err != nil {
+			t.Errorf("recv av message failed, %v", err)
+			return
+		}
+
+		h := msg.Header
+		if h.IsAudio() || h.IsVideo() || h.IsAmf0Data() {
+			msgs = append(msgs, conformance_av{h.MessageType, h.Timestamp, h.StreamId, len(msg.Payload)})
+		}
+	}
+	return
+}
+
+func assert_av_messages(t *testing.T, actual []conformance_av, expect []conformance_av) {
+	if fmt.Sprint(actual) != fmt.Sprint(expect) {
+		t.Errorf("av messages\nexpect: %v\nactual: %v", expect, actual)
+	}
+}
+
+// the connect flow of server, the response is 4 messages.
+func serve_connect(t *testing.T, s Server, req *Request) {
+	if err := s.ConnectApp(req); err != nil {
+		t.Errorf("connect app failed, %v", err)
+		return
+	}
+	if err := s.SetWindowAckSize(2500000); err != nil {
+		t.Error(err)
+	}
+	if err := s.SetPeerBandwidth(2500000, 2); err != nil {
+		t.Error(err)
+	}
+	if err := s.ReponseConnectApp(req, "", nil); err != nil {
+		t.Error(err)
+	}
+	if err := s.CallOnBWDone(); err != nil {
+		t.Error(err)
+	}
+}
+
+func assert_identify(t *testing.T, s Server, client_type string, stream_name string) {
+	ct, sn, err := s.IdentifyClient(1)
+	if err != nil {
+		t.Errorf("identify client failed, %v", err)
+		return
+	}
+	if ct != client_type || sn != stream_name {
+		t.Errorf("expect client=%v stream=%v, actual client=%v stream=%v", client_type, stream_name, ct, sn)
+	}
+}
+
+func assert_request(t *testing.T, req *Request, tc_url string, vhost string, app string, object_encoding int) {
+	if req.TcUrl != tc_url || req.Vhost != vhost || req.App != app || req.Port != "1935" || req.ObjectEncoding != object_encoding {
+		t.Errorf("request tcUrl=%v vhost=%v app=%v port=%v objectEncoding=%v", req.TcUrl, req.Vhost, req.App, req.Port, req.ObjectEncoding)
+	}
+}
+
+// the responses of serve_connect, for objectEncoding is 0 or 3.
+func connect_responses(object_encoding int) ([]string) {
+	return []string{
+		"cid=2 sid=0 WindowAckSize(2500000)",
+		"cid=2 sid=0 SetPeerBandwidth(2500000,2)",
+		fmt.Sprintf(`cid=3 sid=0 "_result",1,{fmsVer:"FMS/3,5,3,888",capabilities:127,mode:1},{level:"status",code:"NetConnection.Connect.Success",description:"Connection succeeded",objectEncoding:%v,data:[version:"3,5,3,888"]}`, object_encoding),
+		`cid=3 sid=0 "onBWDone",0,null`,
+	}
+}
+
+// the responses of FMLE publish, releaseStream, FCPublish, createStream and publish.
+var fmle_publish_responses = []string{
+	`cid=3 sid=0 "_result",2,null,undefined`,
+	`cid=3 sid=0 "_result",3,null,undefined`,
+	`cid=3 sid=0 "_result",4,null,1`,
+	`cid=5 sid=1 "onFCPublish",0,null,{code:"NetStream.Publish.Start",description:"Started publishing stream."}`,
+	`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Publish.Start",description:"Started publishing stream.",clientid:"ASAICiss"}`,
+}
+
+var aac_sequence_header = []byte{0xaf, 0x00, 0x12, 0x10}
+var avc_sequence_header = []byte{
+	0x17, 0x00, 0x00, 0x00, 0x00, 0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x04, 0x67, 0x64, 0x00,
+	0x1f, 0x01, 0x00, 0x04, 0x68, 0xee, 0x3c, 0xb0,
+}
+
+// the video frame, filled by 0xaa, never be taken as the extended timestamp.
+func conformance_frame(keyframe bool, size int) (b []byte) {
+	b = make([]byte, size)
+	for i := range b {
+		b[i] = 0xaa
+	}
+	if b[0] = 0x27; keyframe {
+		b[0] = 0x17
+	}
+	b[1] = 0x01
+	return
+}
+
+// FMLE publish, set chunk size after connect, the audio in fmt=3 first chunk,
+// whose timestamp is the delta of previous chunk, 26+26=52.
+func TestConformanceFMLE(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1/live"
+	session := load_session(t, "fmle")
+
+	var av []conformance_av
+	req := NewRequest()
+	responses := replay_session(t, session, 9, func(s Server) {
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+		}
+		av = recv_av_messages(t, s, 5)
+	})
+
+	assert_request(t, req, tc_url, "127.0.0.1", "live", CodecAMF0)
+	assert_responses(t, responses, append(connect_responses(0), fmle_publish_responses[:]...))
+	assert_av_messages(t, av, []conformance_av{
+		{RTMP_MSG_AMF0DataMessage, 0, 1, 112},
+		{RTMP_MSG_AudioMessage, 26, 1, 157},
+		{RTMP_MSG_AudioMessage, 52, 1, 157},
+		{RTMP_MSG_VideoMessage, 0, 1, 24},
+		{RTMP_MSG_VideoMessage, 40, 1, 9000},
+	})
+}
+
+// OBS publish, set chunk size 4096 before connect, the keyframe in 3 chunks.
+func TestConformanceOBS(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1:1935/live?vhost=obs.test"
+	session := load_session(t, "obs")
+
+	var av []conformance_av
+	req := NewRequest()
+	responses := replay_session(t, session, 9, func(s Server) {
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+		}
+		av = recv_av_messages(t, s, 5)
+	})
+
+	assert_request(t, req, tc_url, "obs.test", "live", CodecAMF0)
+	assert_responses(t, responses, append(connect_responses(0), fmle_publish_responses[:]...))
+	assert_av_messages(t, av, []conformance_av{
+		{RTMP_MSG_AMF0DataMessage, 0, 1, 337},
+		{RTMP_MSG_VideoMessage, 0, 1, 24},
+		{RTMP_MSG_AudioMessage, 0, 1, 4},
+		{RTMP_MSG_VideoMessage, 0, 1, 10000},
+		{RTMP_MSG_VideoMessage, 33, 1, 3000},
+	})
+}
+
+// librtmp publish, the metadata and sequence headers at 0, the audio in fmt=1/2 chunks,
+// then FCUnpublish and deleteStream.
+func TestConformanceLibrtmpPublish(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1:19350/live"
+	session := load_session(t, "librtmp-publish")
+
+	var av []conformance_av
+	req := NewRequest()
+	responses := replay_session(t, session, 9, func(s Server) {
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+		}
+		av = recv_av_messages(t, s, 8)
+	})
+
+	if req.TcUrl != tc_url || req.Vhost != "127.0.0.1" || req.App != "live" || req.Port != "19350" {
+		t.Errorf("request tcUrl=%v vhost=%v app=%v port=%v", req.TcUrl, req.Vhost, req.App, req.Port)
+	}
+	assert_responses(t, responses, append(connect_responses(0), fmle_publish_responses[:]...))
+	assert_av_messages(t, av, []conformance_av{
+		{RTMP_MSG_AMF0DataMessage, 0, 1, 135},
+		{RTMP_MSG_VideoMessage, 0, 1, 24},
+		{RTMP_MSG_AudioMessage, 0, 1, 4},
+		{RTMP_MSG_AudioMessage, 23, 1, 4},
+		{RTMP_MSG_AudioMessage, 47, 1, 4},
+		{RTMP_MSG_AudioMessage, 71, 1, 4},
+		{RTMP_MSG_VideoMessage, 0, 1, 200},
+		{RTMP_MSG_VideoMessage, 40, 1, 200},
+	})
+}
+
+// librtmp play, the SetBufferLength of 3000ms for stream 1.
+func TestConformanceLibrtmpPlay(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1:19351/live"
+	session := load_session(t, "librtmp-play")
+
+	req := NewRequest()
+	responses := replay_session(t, session, 10, func(s Server) {
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+		}
+
+		// the SetBufferLength of stream 1, around play.
+		for {
+			if length, ok := s.Protocol().BufferLength(1); ok {
+				if length != 3 * time.Second {
+					t.Errorf("buffer length %v", length)
+				}
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	if req.TcUrl != tc_url || req.Vhost != "127.0.0.1" || req.App != "live" || req.Port != "19351" {
+		t.Errorf("request tcUrl=%v vhost=%v app=%v port=%v", req.TcUrl, req.Vhost, req.App, req.Port)
+	}
+	assert_responses(t, responses, append(connect_responses(0),
+		`cid=3 sid=0 "_result",2,null,1`,
+		"cid=2 sid=0 UserControl(0,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Reset",description:"Playing and resetting stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Start",description:"Started playing stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "|RtmpSampleAccess",false,false`,
+		`cid=5 sid=1 "onStatus",{code:"NetStream.Data.Start"}`,
+	))
+}
+
+// flash player play in objectEncoding 3, the amf3 commands and SetBufferLength.
+func TestConformanceFlashPlayer(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1/live"
+	session := load_session(t, "flashplayer")
+
+	req := NewRequest()
+	responses := replay_session(t, session, 10, func(s Server) {
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+		}
+
+		// the SetBufferLength after play.
+		for {
+			if length, ok := s.Protocol().BufferLength(1); ok {
+				if length != 3 * time.Second {
+					t.Errorf("buffer length %v", length)
+				}
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	if req.PageUrl != "http://127.0.0.1/player.html" || req.SwfUrl != "http://127.0.0.1/player.swf" {
+		t.Errorf("pageUrl=%v swfUrl=%v", req.PageUrl, req.SwfUrl)
+	}
+	assert_request(t, req, tc_url, "127.0.0.1", "live", CodecAMF3)
+	assert_responses(t, responses, append(connect_responses(3),
+		`cid=3 sid=0 "_result",2,null,1`,
+		"cid=2 sid=0 UserControl(0,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Reset",description:"Playing and resetting stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Start",description:"Started playing stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "|RtmpSampleAccess",false,false`,
+		`cid=5 sid=1 "onStatus",{code:"NetStream.Data.Start"}`,
+	))
+}
+
+// wirecast publish in the flash schema, without releaseStream and FCPublish.
+func TestConformanceWirecast(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1/live"
+	session := load_session(t, "wirecast")
+
+	var av []conformance_av
+	req := NewRequest()
+	responses := replay_session(t, session, 6, func(s Server) {
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_FlashPublish, "livestream")
+		if err := s.StartFlashPublish(1); err != nil {
+			t.Error(err)
+		}
+		av = recv_av_messages(t, s, 3)
+	})
+
+	assert_request(t, req, tc_url, "127.0.0.1", "live", CodecAMF0)
+	assert_responses(t, responses, append(connect_responses(0),
+		`cid=3 sid=0 "_result",2,null,1`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Publish.Start",description:"Started publishing stream.",clientid:"ASAICiss"}`,
+	))
+	assert_av_messages(t, av, []conformance_av{
+		{RTMP_MSG_AudioMessage, 0, 1, 4},
+		{RTMP_MSG_VideoMessage, 0, 1, 24},
+		{RTMP_MSG_VideoMessage, 0, 1, 5000},
+	})
+}
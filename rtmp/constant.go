@@ -185,8 +185,10 @@ const RTMP_EXTENDED_TIMESTAMP  = 0xFFFFFF
 const AMF0_COMMAND_CONNECT = "connect"
 const AMF0_COMMAND_CREATE_STREAM = "createStream"
 const AMF0_COMMAND_CLOSE_STREAM = "closeStream"
+const AMF0_COMMAND_DELETE_STREAM = "deleteStream"
 const AMF0_COMMAND_PLAY = "play"
 const AMF0_COMMAND_PAUSE = "pause"
+const AMF0_COMMAND_SEEK = "seek"
 const AMF0_COMMAND_ON_BW_DONE = "onBWDone"
 const AMF0_COMMAND_ON_STATUS = "onStatus"
 const AMF0_COMMAND_RESULT = "_result"
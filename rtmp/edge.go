@@ -0,0 +1,604 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// the default grace period to stop pulling after the last player leaves.
+const EDGE_DEFAULT_GRACE_PERIOD = 10 * time.Second
+// the default messages queued for each player, drop the message when full.
+const EDGE_DEFAULT_QUEUE_SIZE = 1024
+
+/**
+* the edge of cluster, pull the stream from origin on demand for players,
+* all players of a stream share the single upstream pull, for example,
+* 		edge := NewEdge("origin1:1935", "origin2:1935")
+* 		// for each connection:
+* 		client_type, _, err := s.IdentifyClient(1)
+* 		if client_type == CLIENT_TYPE_Play && !published_locally(req) {
+* 			return edge.ServePlay(ctx, s, req, 1)
+* 		}
+* the edge try the origins in order, failover to the next one when failed,
+* and stop pulling when the last player leaves plus the GracePeriod.
+* the edge also proxy the publisher to origin, @see ServePublish.
+ */
+type Edge struct {
+	// the origins, the host[:port] of origin server.
+	Origins []string
+	// the timeout to connect and play from origin.
+	Timeout time.Duration
+	// the backoff to retry when all origins failed, doubled for each round from min to max.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// the grace period to stop pulling after the last player leaves.
+	GracePeriod time.Duration
+	// the max messages queued for each player, drop the message when full.
+	QueueSize int
+	logger Logger
+	// the pulling streams, key is the Request.StreamUrl()
+	lock *sync.Mutex
+	streams map[string]*edge_stream
+}
+func NewEdge(origins ...string) (*Edge) {
+	r := &Edge{}
+	r.Origins = origins
+	r.Timeout = FORWARD_DEFAULT_TIMEOUT
+	r.MinBackoff = FORWARD_DEFAULT_MIN_BACKOFF
+	r.MaxBackoff = FORWARD_DEFAULT_MAX_BACKOFF
+	r.GracePeriod = EDGE_DEFAULT_GRACE_PERIOD
+	r.QueueSize = EDGE_DEFAULT_QUEUE_SIZE
+	r.logger = null_logger{}
+	r.lock = &sync.Mutex{}
+	r.streams = map[string]*edge_stream{}
+	return r
+}
+
+/**
+* set the logger of edge and origin connections, nil to discard.
+ */
+func (r *Edge) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = null_logger{}
+	}
+	r.logger = logger
+}
+
+/**
+* play the stream of req, start to pull from origin when not pulling,
+* return the consumer to recv the messages of stream, user must close it.
+* the tcUrl params and stream params of the player who starts the pull are forwarded
+* to origin, the players joined later share the pull, so they must be authed by edge.
+* @param req the request of player, the vhost/app/stream is identified.
+ */
+func (r *Edge) Play(req *Request) (*EdgeConsumer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := req.StreamUrl()
+	stream, ok := r.streams[key]
+	if !ok {
+		stream = new_edge_stream(r, key, req)
+		r.streams[key] = stream
+		go stream.run()
+	}
+	return stream.subscribe()
+}
+
+/**
+* serve the player by the stream pulled from origin, util player closed the stream or ctx done,
+* the StartPlay is called to response the player, so the auth and vhost check is applied.
+* @param req the request of player, the vhost/app/stream is identified.
+* @param stream_id the stream id of IdentifyClient.
+ */
+func (r *Edge) ServePlay(ctx context.Context, s Server, req *Request, stream_id uint32) (err error) {
+	if err = s.StartPlay(stream_id); err != nil {
+		return
+	}
+
+	c := r.Play(req)
+	defer c.Close()
+
+	// recv the messages of player, stop when player close stream,
+	// the recv is canceled and waited when return, so it never recv after ServePlay.
+	recv_ctx, cancel := context.WithCancel(ctx)
+	closed := make(chan struct{})
+	defer func() {
+		cancel()
+		<-closed
+	}()
+	go func() {
+		defer close(closed)
+		for {
+			msg, err := s.Protocol().RecvMessageContext(recv_ctx)
+			if err != nil {
+				return
+			}
+
+			pkt, err := s.Protocol().DecodeMessage(msg)
+			msg.Release()
+			if err != nil {
+				return
+			}
+			switch pkt.(type) {
+			case *CloseStreamPacket, *DeleteStreamPacket:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return context_error(ctx)
+		case <-s.Done():
+			return s.Err()
+		case <-closed:
+			return
+		case msg := <-c.msgs:
+			if err = s.Protocol().SendMessage(msg, stream_id); err != nil {
+				return
+			}
+		}
+	}
+}
+
+/**
+* proxy the identified publisher to origin, util publisher unpublished, closed or ctx done,
+* the publish of origin is started before responsing the publisher, that is, the
+* StartFMLEPublish or StartFlashPublish is called after the origin accepted the stream,
+* so the transaction ids of publisher are responsed by server, while the origin
+* connection use its own transaction ids.
+* when the origin rejected or failed, the publisher got the onStatus(NetStream.Publish.BadName)
+* with the description of origin, and the error is returned, user should close the publisher.
+* @param req the request of publisher, the params of tcUrl and stream are passed to origin.
+* @param client_type the client type of IdentifyClient, FMLE or flash publish.
+* @param stream_id the stream id of IdentifyClient.
+ */
+func (r *Edge) ServePublish(ctx context.Context, s Server, req *Request, client_type string, stream_id uint32) (err error) {
+	if client_type != CLIENT_TYPE_FMLEPublish && client_type != CLIENT_TYPE_FlashPublish {
+		return Error{code:ERROR_SYSTEM_CLIENT_INVALID, desc:fmt.Sprintf("client type %v not publish", client_type)}
+	}
+
+	var c Client
+	var origin_stream_id uint32
+	if c, origin_stream_id, err = r.publish_origin(ctx, req); err != nil {
+		if err := s.RejectPublish(stream_id, auth_error_desc(err)); err != nil {
+			return err
+		}
+		return
+	}
+	defer c.Destroy()
+
+	if client_type == CLIENT_TYPE_FMLEPublish {
+		err = s.StartFMLEPublish(stream_id)
+	} else {
+		err = s.StartFlashPublish(stream_id)
+	}
+	if err != nil {
+		return
+	}
+
+	// watch the origin, cancel the publisher when origin rejected or failed.
+	publish_ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var origin_err error
+	origin_done := make(chan struct{})
+	go func() {
+		defer close(origin_done)
+		defer cancel()
+		origin_err = watch_origin(publish_ctx, c)
+	}()
+	defer func() {
+		cancel()
+		<-origin_done
+	}()
+
+	for {
+		var msg *Message
+		if msg, err = s.Protocol().RecvMessageContext(publish_ctx); err != nil {
+			break
+		}
+
+		h := msg.Header
+		if h.IsAudio() || h.IsVideo() || h.IsAmf0Data() || h.IsAmf3Data() {
+			if err = c.Protocol().SendMessage(msg, origin_stream_id); err != nil {
+				return origin_failed(s, stream_id, err)
+			}
+			continue
+		}
+		if !h.IsAmf0Command() && !h.IsAmf3Command() {
+			msg.Release()
+			continue
+		}
+
+		var pkt interface {}
+		pkt, err = s.Protocol().DecodeMessage(msg)
+		msg.Release()
+		if err != nil {
+			return
+		}
+
+		switch pkt := pkt.(type) {
+		case *FMLEStartPacket:
+			if pkt.CommandName == AMF0_COMMAND_UNPUBLISH {
+				return s.FMLEUnpublish(stream_id, pkt.TransactionId)
+			}
+		case *CloseStreamPacket:
+			if client_type == CLIENT_TYPE_FlashPublish {
+				return s.FlashUnpublish(stream_id)
+			}
+			return
+		case *DeleteStreamPacket:
+			return
+		}
+	}
+
+	// the publisher is closed, or ctx is done, or canceled by origin.
+	if ctx.Err() != nil {
+		return context_error(ctx)
+	}
+	if publish_ctx.Err() == nil {
+		return
+	}
+	<-origin_done
+	return origin_failed(s, stream_id, origin_err)
+}
+
+// response the error of origin to publisher by onStatus(NetStream.Publish.BadName).
+func origin_failed(s Server, stream_id uint32, origin_err error) (err error) {
+	pkt := NewOnStatusCallPacket()
+	pkt.Set(SLEVEL, SLEVEL_Error).Set(SCODE, SCODE_PublishBadName).Set(SDESC, auth_error_desc(origin_err)).Set(SCLIENT_ID, SIG_CLIENT_ID)
+	if err = s.Protocol().SendPacketSync(pkt, stream_id); err != nil {
+		return
+	}
+	return origin_err
+}
+
+/**
+* the tcUrl params and stream of client to origin, the params of client are forwarded,
+* so the origin can auth the client, and the vhost is in the tcUrl params.
+ */
+func origin_request(req *Request) (param url.Values, stream string) {
+	param = url.Values{}
+	for k, v := range req.Param {
+		param[k] = v
+	}
+	param.Set("vhost", req.Vhost)
+
+	stream = req.Stream
+	if len(req.StreamParams) > 0 {
+		stream += "?" + req.StreamParams.Encode()
+	}
+	return
+}
+
+// connect and publish to the origins in order, return the first published.
+func (r *Edge) publish_origin(ctx context.Context, req *Request) (c Client, stream_id uint32, err error) {
+	param, stream := origin_request(req)
+
+	for _, origin := range r.Origins {
+		tc_url := origin_tc_url(origin, req.App, param)
+		if c, stream_id, err = r.publish(ctx, tc_url, stream); err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// failover to the next origin, but the reject of origin is final.
+		if v, ok := err.(Error); ok && v.Code() == ERROR_RTMP_ACCESS_DENIED {
+			return
+		}
+	}
+	if err == nil {
+		err = Error{code:ERROR_SYSTEM_CONFIG_INVALID, desc:"no origin"}
+	}
+	return
+}
+
+func (r *Edge) publish(ctx context.Context, tc_url string, stream string) (c Client, stream_id uint32, err error) {
+	publish_ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+
+	if c, err = DialClient(publish_ctx, tc_url); err != nil {
+		return
+	}
+	c.SetLogger(r.logger)
+
+	req := NewRequest()
+	req.TcUrl = tc_url
+	if err = c.HandshakeContext(publish_ctx); err == nil {
+		if err = c.ConnectAppContext(publish_ctx, req); err == nil {
+			stream_id, err = c.PublishContext(publish_ctx, stream)
+		}
+	}
+	if err != nil {
+		c.Destroy()
+		return nil, 0, err
+	}
+	return
+}
+
+// recv the messages of origin util failed, or the origin response error onStatus.
+func watch_origin(ctx context.Context, c Client) (err error) {
+	for {
+		var msg *Message
+		if msg, err = c.Protocol().RecvMessageContext(ctx); err != nil {
+			return
+		}
+		if !msg.Header.IsAmf0Command() && !msg.Header.IsAmf3Command() {
+			msg.Release()
+			continue
+		}
+
+		var pkt interface {}
+		pkt, err = c.Protocol().DecodeMessage(msg)
+		msg.Release()
+		if err != nil {
+			return
+		}
+		if pkt, ok := pkt.(*OnStatusCallPacket); ok {
+			if v, _ := pkt.Data.GetPropertyString(SLEVEL); v == SLEVEL_Error {
+				return status_error("origin error", pkt.Data)
+			}
+		}
+	}
+}
+
+// the tcUrl of origin, for example, rtmp://origin:1935/live?vhost=xxx
+func origin_tc_url(origin string, app string, param url.Values) (string) {
+	return fmt.Sprintf("rtmp://%v/%v?%v", origin, app, param.Encode())
+}
+
+// whether the stream is pulling from origin.
+func (r *Edge) pulling(key string) (bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	_, ok := r.streams[key]
+	return ok
+}
+
+// stop pulling the stream when no players.
+func (r *Edge) on_idle(stream *edge_stream) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.streams[stream.key] != stream || stream.nb_consumers() > 0 {
+		return
+	}
+	delete(r.streams, stream.key)
+	stream.cancel()
+}
+
+/**
+* the consumer of edge stream, the player recv messages from it.
+ */
+type EdgeConsumer struct {
+	stream *edge_stream
+	msgs chan *Message
+	close_once *sync.Once
+}
+
+/**
+* recv a message of stream, the audio, video or metadata,
+* the stream id of message is the stream id of origin, user should send it with the stream id of player.
+ */
+func (r *EdgeConsumer) Recv(ctx context.Context) (msg *Message, err error) {
+	select {
+	case msg = <-r.msgs:
+		return
+	case <-ctx.Done():
+		return nil, context_error(ctx)
+	}
+}
+
+/**
+* close the consumer, the edge stop pulling after the last consumer closed plus the grace period.
+ */
+func (r *EdgeConsumer) Close() {
+	r.close_once.Do(func() {
+		r.stream.unsubscribe(r)
+	})
+}
+
+// the stream pulled from origin, shared by players.
+type edge_stream struct {
+	edge *Edge
+	key string
+	req *Request
+	ctx context.Context
+	cancel context.CancelFunc
+	log_ctx *LogContext
+	// the cached metadata and sequence headers, for the player joined later.
+	headers *header_cache
+	lock *sync.Mutex
+	consumers map[*EdgeConsumer]bool
+	// the timer to stop pulling when no players.
+	idle_timer *time.Timer
+}
+
+func new_edge_stream(edge *Edge, key string, req *Request) (*edge_stream) {
+	r := &edge_stream{}
+	r.edge = edge
+	r.key = key
+	r.req = req
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.log_ctx = new_log_context("")
+	r.log_ctx.Vhost, r.log_ctx.App, r.log_ctx.Stream = req.Vhost, req.App, req.Stream
+	r.headers = new_header_cache()
+	r.lock = &sync.Mutex{}
+	r.consumers = map[*EdgeConsumer]bool{}
+	return r
+}
+
+func (r *edge_stream) warn(format string, v ...interface {}) {
+	if logger := r.edge.logger; logger.Enabled(LogLevelWarn) {
+		logger.Log(LogLevelWarn, r.log_ctx, format, v...)
+	}
+}
+
+func (r *edge_stream) subscribe() (c *EdgeConsumer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.idle_timer != nil {
+		r.idle_timer.Stop()
+		r.idle_timer = nil
+	}
+
+	c = &EdgeConsumer{stream:r, msgs:make(chan *Message, r.edge.QueueSize), close_once:&sync.Once{}}
+	// the player joined later starts with the cached headers.
+	for _, msg := range r.headers.copies() {
+		select {
+		case c.msgs <- msg:
+		default:
+			msg.Release()
+		}
+	}
+	r.consumers[c] = true
+	return
+}
+
+func (r *edge_stream) unsubscribe(c *EdgeConsumer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.consumers, c)
+	for len(c.msgs) > 0 {
+		(<-c.msgs).Release()
+	}
+
+	if len(r.consumers) == 0 && r.idle_timer == nil {
+		r.idle_timer = time.AfterFunc(r.edge.GracePeriod, func() {
+			r.edge.on_idle(r)
+		})
+	}
+}
+
+func (r *edge_stream) nb_consumers() (int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.consumers)
+}
+
+// dispatch the message of origin to all players.
+func (r *edge_stream) dispatch(msg *Message) {
+	r.headers.update(msg)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for c, _ := range r.consumers {
+		copy := msg.Copy()
+		select {
+		case c.msgs <- copy:
+		default:
+			copy.Release()
+			r.warn("player queue full, drop %v", message_dump(msg))
+		}
+	}
+}
+
+// pull from origins util canceled, failover to the next origin when failed.
+func (r *edge_stream) run() {
+	defer r.headers.release()
+
+	e := r.edge
+	backoff := e.MinBackoff
+	for {
+		var pulled bool
+		for _, origin := range e.Origins {
+			ok, err := r.pull(origin)
+			if r.ctx.Err() != nil {
+				return
+			}
+			pulled = pulled || ok
+			r.warn("pull from origin %v failed, %v", origin, err)
+		}
+
+		// reset the backoff when pulled, for the origin is ok.
+		if pulled {
+			backoff = e.MinBackoff
+		}
+		r.warn("pull from all origins failed, retry in %v", backoff)
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > e.MaxBackoff {
+			backoff = e.MaxBackoff
+		}
+	}
+}
+
+// play the stream from origin, dispatch the messages util failed.
+func (r *edge_stream) pull(origin string) (pulled bool, err error) {
+	e := r.edge
+
+	param, stream := origin_request(r.req)
+	tc_url := origin_tc_url(origin, r.req.App, param)
+	play_ctx, cancel := context.WithTimeout(r.ctx, e.Timeout)
+	defer cancel()
+
+	var c Client
+	if c, err = DialClient(play_ctx, tc_url); err != nil {
+		return
+	}
+	defer c.Destroy()
+	c.SetLogger(e.logger)
+
+	if err = c.HandshakeContext(play_ctx); err != nil {
+		return
+	}
+
+	req := NewRequest()
+	req.TcUrl = tc_url
+	if err = c.ConnectAppContext(play_ctx, req); err != nil {
+		return
+	}
+	if _, err = c.PlayContext(play_ctx, stream); err != nil {
+		return
+	}
+	pulled = true
+
+	for {
+		var msg *Message
+		if msg, err = c.Protocol().RecvMessageContext(r.ctx); err != nil {
+			return
+		}
+
+		// only the audio, video and metadata for player, the player is responsed by StartPlay.
+		if msg.Header.IsAudio() || msg.Header.IsVideo() || is_metadata(msg) {
+			r.dispatch(msg)
+		}
+		msg.Release()
+	}
+}
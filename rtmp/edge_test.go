@@ -0,0 +1,407 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var edge_messages = []conformance_av{
+	{RTMP_MSG_AMF0DataMessage, 0, 1, len(seed_amf0(AMF0_DATA_SET_DATAFRAME, AMF0_DATA_ON_METADATA))},
+	{RTMP_MSG_AudioMessage, 0, 1, len(aac_sequence_header)},
+	{RTMP_MSG_VideoMessage, 0, 1, len(avc_sequence_header)},
+	{RTMP_MSG_VideoMessage, 40, 1, 1024},
+}
+
+// the origin play the headers and a frame for each connection, return the host:port of origin.
+func serve_origin(t *testing.T, nb_connections *int32) (origin string, close func()) {
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		atomic.AddInt32(nb_connections, 1)
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+			return
+		}
+
+		msgs := []*Message{
+			new_av_message(RTMP_MSG_AMF0DataMessage, 0, seed_amf0(AMF0_DATA_SET_DATAFRAME, AMF0_DATA_ON_METADATA)),
+			new_av_message(RTMP_MSG_AudioMessage, 0, aac_sequence_header),
+			new_av_message(RTMP_MSG_VideoMessage, 0, avc_sequence_header),
+			new_av_message(RTMP_MSG_VideoMessage, 40, conformance_frame(true, 1024)),
+		}
+		for _, msg := range msgs {
+			if err := s.Protocol().SendMessage(msg, 1); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		<-s.Done()
+	})
+	return strings.TrimSuffix(strings.TrimPrefix(tc_url, "rtmp://"), "/live"), close
+}
+
+func recv_edge_messages(t *testing.T, c *EdgeConsumer, n int) (msgs []conformance_av) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+
+	for len(msgs) < n {
+		msg, err := c.Recv(ctx)
+		if err != nil {
+			t.Fatalf("recv edge message failed, %v", err)
+		}
+		h := msg.Header
+		msgs = append(msgs, conformance_av{h.MessageType, h.Timestamp, h.StreamId, len(msg.Payload)})
+		msg.Release()
+	}
+	return
+}
+
+func TestEdgePlay(t *testing.T) {
+	var nb_connections int32
+	origin, close := serve_origin(t, &nb_connections)
+	defer close()
+
+	req := NewRequest()
+	req.Vhost, req.App, req.Stream = "127.0.0.1", "live", "livestream"
+
+	// failover to the second origin.
+	edge := NewEdge("127.0.0.1:1", origin)
+	edge.GracePeriod = 50 * time.Millisecond
+	edge.MinBackoff = 10 * time.Millisecond
+
+	c := edge.Play(req)
+	if msgs := recv_edge_messages(t, c, len(edge_messages)); !reflect.DeepEqual(msgs, edge_messages) {
+		t.Errorf("expect %v, actual %v", edge_messages, msgs)
+	}
+
+	// the second player share the pull, start with the cached headers.
+	c2 := edge.Play(req)
+	if msgs := recv_edge_messages(t, c2, 3); !reflect.DeepEqual(msgs, edge_messages[:3]) {
+		t.Errorf("expect %v, actual %v", edge_messages[:3], msgs)
+	}
+	if v := atomic.LoadInt32(&nb_connections); v != 1 {
+		t.Errorf("expect 1 origin connection, actual %v", v)
+	}
+
+	// stop pulling after the last player leaves plus the grace period.
+	c.Close()
+	c2.Close()
+	if !edge.pulling(req.StreamUrl()) {
+		t.Error("expect pulling in grace period")
+	}
+	for i := 0; edge.pulling(req.StreamUrl()); i++ {
+		if i > 100 {
+			t.Fatal("expect stop pulling after grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// pull again for the new player.
+	c = edge.Play(req)
+	defer c.Close()
+	if msgs := recv_edge_messages(t, c, len(edge_messages)); !reflect.DeepEqual(msgs, edge_messages) {
+		t.Errorf("expect %v, actual %v", edge_messages, msgs)
+	}
+	if v := atomic.LoadInt32(&nb_connections); v != 2 {
+		t.Errorf("expect 2 origin connections, actual %v", v)
+	}
+}
+
+func TestEdgePlayParams(t *testing.T) {
+	// the origin auth the play by the params of player.
+	reqs := make(chan *Request, 1)
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		req := NewRequest()
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream?key=xxx")
+		reqs <- req
+		<-s.Done()
+	})
+	defer close()
+
+	req := NewRequest()
+	req.Vhost, req.App = "127.0.0.1", "live"
+	req.Param = url.Values{"token":{"abc"}}
+	req.ParseStream("livestream?key=xxx")
+
+	edge := NewEdge(strings.TrimSuffix(strings.TrimPrefix(tc_url, "rtmp://"), "/live"))
+	edge.GracePeriod = 10 * time.Millisecond
+	c := edge.Play(req)
+	defer c.Close()
+
+	select {
+	case req := <-reqs:
+		if req.Vhost != "127.0.0.1" || req.Param.Get("token") != "abc" || req.Stream != "livestream" || req.StreamParams.Get("key") != "xxx" {
+			t.Errorf("vhost=%v, param=%v, stream=%v, stream params=%v", req.Vhost, req.Param, req.Stream, req.StreamParams)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expect origin play")
+	}
+}
+
+func TestEdgeRepullBackoff(t *testing.T) {
+	// the origin accept the play then close at once, the onBWDone is sent after
+	// the onStatus, so the play is started when the sync send is done.
+	var nb_connections int32
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		atomic.AddInt32(&nb_connections, 1)
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.Protocol().SendPacketSync(NewOnBWDonePacket(), 0); err != nil {
+			t.Error(err)
+		}
+	})
+	defer close()
+
+	req := NewRequest()
+	req.Vhost, req.App, req.Stream = "127.0.0.1", "live", "livestream"
+
+	edge := NewEdge(strings.TrimSuffix(strings.TrimPrefix(tc_url, "rtmp://"), "/live"))
+	edge.GracePeriod = 10 * time.Millisecond
+	edge.MinBackoff = 100 * time.Millisecond
+	edge.MaxBackoff = 100 * time.Millisecond
+
+	// the origin is pulled, but the edge still wait for MinBackoff to repull.
+	c := edge.Play(req)
+	time.Sleep(350 * time.Millisecond)
+	c.Close()
+	if v := atomic.LoadInt32(&nb_connections); v < 2 || v > 5 {
+		t.Errorf("expect 2-5 origin connections, actual %v", v)
+	}
+}
+
+func TestEdgeServePlay(t *testing.T) {
+	var nb_connections int32
+	origin, close_origin := serve_origin(t, &nb_connections)
+	defer close_origin()
+
+	edge := NewEdge(origin)
+	edge.GracePeriod = 10 * time.Millisecond
+	served := make(chan error, 1)
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		req := NewRequest()
+		serve_connect(t, s, req)
+		assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+		served <- edge.ServePlay(context.Background(), s, req, 1)
+	})
+	defer close()
+
+	c := dial_client(t, tc_url)
+	stream_id, err := c.Play("livestream")
+	if err != nil || stream_id != 1 {
+		t.Fatalf("play stream_id=%v, %v", stream_id, err)
+	}
+
+	var msgs []conformance_av
+	for len(msgs) < len(edge_messages) {
+		msg, err := c.Protocol().RecvMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ignore the |RtmpSampleAccess and NetStream.Data.Start of StartPlay.
+		if h := msg.Header; h.IsAudio() || h.IsVideo() || is_metadata(msg) {
+			msgs = append(msgs, conformance_av{h.MessageType, h.Timestamp, h.StreamId, len(msg.Payload)})
+		}
+	}
+	if !reflect.DeepEqual(msgs, edge_messages) {
+		t.Errorf("expect %v, actual %v", edge_messages, msgs)
+	}
+
+	// the edge stop serving when player closed.
+	c.Destroy()
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Error("expect serve play done")
+	}
+}
+
+// the origin accept the publish with key=xxx, kick it with key=kick, otherwise reject it.
+func serve_publish_origin(t *testing.T, origin_msgs chan []conformance_av) (origin string, close func()) {
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		req := NewRequest()
+		serve_connect(t, s, req)
+		if req.Vhost != "127.0.0.1" || req.Param.Get("token") != "abc" {
+			t.Errorf("vhost=%v, param=%v", req.Vhost, req.Param)
+		}
+
+		if _, _, err := s.IdentifyClient(1); err != nil {
+			t.Error(err)
+			return
+		}
+		key := req.StreamParams.Get("key")
+		if key != "xxx" && key != "kick" {
+			if err := s.RejectPublish(1, "invalid key"); err != nil {
+				t.Error(err)
+			}
+			return
+		}
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+			return
+		}
+
+		if key == "kick" {
+			pkt := NewOnStatusCallPacket()
+			pkt.Set(SLEVEL, SLEVEL_Error).Set(SCODE, SCODE_PublishBadName).Set(SDESC, "stream is kicked")
+			if err := s.Protocol().SendPacketSync(pkt, 1); err != nil {
+				t.Error(err)
+			}
+			return
+		}
+		origin_msgs <- recv_av_messages(t, s, 2)
+		<-s.Done()
+	})
+	return strings.TrimSuffix(strings.TrimPrefix(tc_url, "rtmp://"), "/live"), close
+}
+
+// serve the publisher by edge, return the tcUrl of edge.
+func serve_publish_edge(t *testing.T, edge *Edge, served chan error) (tc_url string, close func()) {
+	return serve_rtmp(t, "live", func(s Server) {
+		req := NewRequest()
+		serve_connect(t, s, req)
+		client_type, _, err := s.IdentifyClient(1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// the publisher is closed at once, it must recv the error before closed.
+		served <- edge.ServePublish(context.Background(), s, req, client_type, 1)
+	})
+}
+
+func TestEdgePublish(t *testing.T) {
+	origin_msgs := make(chan []conformance_av, 1)
+	origin, close_origin := serve_publish_origin(t, origin_msgs)
+	defer close_origin()
+
+	// failover to the second origin.
+	served := make(chan error, 1)
+	tc_url, close := serve_publish_edge(t, NewEdge("127.0.0.1:1", origin), served)
+	defer close()
+
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+
+	stream_id, err := c.Publish("livestream?key=xxx")
+	if err != nil || stream_id != 1 {
+		t.Fatalf("publish stream_id=%v, %v", stream_id, err)
+	}
+	if err = c.Protocol().SendMessage(new_av_message(RTMP_MSG_AudioMessage, 0, aac_sequence_header), stream_id); err != nil {
+		t.Error(err)
+	}
+	if err = c.Protocol().SendMessage(new_av_message(RTMP_MSG_VideoMessage, 40, conformance_frame(true, 1024)), stream_id); err != nil {
+		t.Error(err)
+	}
+
+	expect := []conformance_av{
+		{RTMP_MSG_AudioMessage, 0, 1, len(aac_sequence_header)},
+		{RTMP_MSG_VideoMessage, 40, 1, 1024},
+	}
+	if msgs := <-origin_msgs; !reflect.DeepEqual(msgs, expect) {
+		t.Errorf("expect %v, actual %v", expect, msgs)
+	}
+
+	// the FCUnpublish is responsed with the transaction id of publisher.
+	pkt := NewFMLEStartPacket()
+	pkt.CommandName, pkt.TransactionId, pkt.StreamName = AMF0_COMMAND_UNPUBLISH, 10, "livestream"
+	if err = c.Protocol().SendPacket(pkt, uint32(0)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := c.Protocol().RecvMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := c.Protocol().DecodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, ok := res.(*FMLEStartResPacket); ok {
+			if res.TransactionId != 10 {
+				t.Errorf("expect transaction id 10, actual %v", res.TransactionId)
+			}
+			break
+		}
+	}
+	if err = <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEdgePublishRejected(t *testing.T) {
+	origin, close_origin := serve_publish_origin(t, nil)
+	defer close_origin()
+
+	served := make(chan error, 1)
+	tc_url, close := serve_publish_edge(t, NewEdge(origin), served)
+	defer close()
+
+	// the origin reject the publish.
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+	_, err := c.Publish("livestream?key=yyy")
+	if v, ok := err.(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED || !strings.Contains(v.Desc(), "invalid key") {
+		t.Errorf("expect publish rejected, actual %v", err)
+	}
+	if v, ok := (<-served).(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED {
+		t.Errorf("expect served rejected, actual %v", v)
+	}
+	c.Destroy()
+
+	// the origin kick the publish after started.
+	c = dial_client(t, tc_url)
+	defer c.Destroy()
+	if _, err = c.Publish("livestream?key=kick"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := c.Protocol().RecvMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, err := c.Protocol().DecodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt, ok := pkt.(*OnStatusCallPacket); ok {
+			if v, _ := pkt.Data.GetPropertyString(SDESC); !strings.Contains(v, "stream is kicked") {
+				t.Errorf("expect kicked, actual %v", v)
+			}
+			break
+		}
+	}
+	if v, ok := (<-served).(Error); !ok || v.Code() != ERROR_RTMP_ACCESS_DENIED {
+		t.Errorf("expect served kicked, actual %v", v)
+	}
+}
@@ -31,6 +31,16 @@ const ERROR_GO_REFLECT_CAN_SET = 102
 const ERROR_GO_AMF0_NIL_PROPERTY = 103
 const ERROR_GO_RTMP_NOT_SUPPORT_MSG = 104
 const ERROR_GO_PROTOCOL_DESTROYED = 105
+const ERROR_GO_CONTEXT_CANCELED = 106
+const ERROR_GO_SEND_QUEUE_OVERFLOW = 107
+const ERROR_GO_LIMIT_MESSAGE_SIZE = 108
+const ERROR_GO_LIMIT_CHUNK_STREAMS = 109
+const ERROR_GO_LIMIT_PARTIAL_BYTES = 110
+const ERROR_GO_LIMIT_AMF0_DEPTH = 111
+const ERROR_GO_LIMIT_AMF0_PROPERTIES = 112
+const ERROR_GO_BUFFER_OVERFLOW = 113
+const ERROR_GO_KEEPALIVE_TIMEOUT = 114
+const ERROR_GO_AUTH_REJECTED = 115
 
 const ERROR_SOCKET_CREATE = 200
 const ERROR_SOCKET_SETREUSE = 201
@@ -64,6 +74,7 @@ const ERROR_RTMP_VHOST_NOT_FOUND = 314
 const ERROR_RTMP_ACCESS_DENIED = 315
 const ERROR_RTMP_HANDSHAKE = 316
 const ERROR_RTMP_NO_REQUEST = 317
+const ERROR_RTMP_AGGREGATE = 318
 
 const ERROR_SYSTEM_STREAM_INIT = 400
 const ERROR_SYSTEM_PACKET_INVALID = 401
@@ -139,6 +150,8 @@ const ERROR_ENCODER_DUP2 = 716
 const ERROR_HTTP_PARSE_URI = 800
 const ERROR_HTTP_DATA_INVLIAD = 801
 const ERROR_HTTP_PARSE_HEADER = 802
+const ERROR_HTTP_HOOK_REJECTED = 803
+const ERROR_HTTP_HOOK_FAILED = 804
 
 type Error struct {
 	code int
@@ -147,3 +160,11 @@ type Error struct {
 func (err Error) Error() string {
 	return fmt.Sprintf("rtmp error code=%v: %s", err.code, err.desc)
 }
+func (err Error) Code() int {
+	return err.code
+}
+// the description of error, without the code.
+func (err Error) Desc() string {
+	return err.desc
+}
+
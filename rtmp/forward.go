@@ -0,0 +1,387 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+* the property of connect object, the ids of servers which forwarded the stream,
+* joined by comma, for example, forwardedBy:"server-a,server-b"
+* @see Request.ForwardedBy
+ */
+const FORWARD_MARKER = "forwardedBy"
+
+// the default timeout to connect and publish to upstream.
+const FORWARD_DEFAULT_TIMEOUT = 10 * time.Second
+// the default backoff to reconnect upstream.
+const FORWARD_DEFAULT_MIN_BACKOFF = 1 * time.Second
+const FORWARD_DEFAULT_MAX_BACKOFF = 30 * time.Second
+// the default messages queued for each upstream.
+const FORWARD_DEFAULT_QUEUE_SIZE = 1024
+
+/**
+* check whether the stream is forwarded by server, to stop the forward loop,
+* for example, A forward to B, B forward to A, then A got the stream forwarded by itself.
+* @return ERROR_SYSTEM_FORWARD_LOOP when loop detected.
+ */
+func CheckForwardLoop(req *Request, server_id string) (err error) {
+	for _, v := range req.ForwardedBy {
+		if v == server_id {
+			return Error{code:ERROR_SYSTEM_FORWARD_LOOP, desc:fmt.Sprintf("forward loop detected, server=%v, forwarded by %v", server_id, strings.Join(req.ForwardedBy, ","))}
+		}
+	}
+	return
+}
+
+/**
+* the forwarder, relay the published stream to the upstream rtmp servers,
+* for example, push each ingest to the CDNs:
+* 		f := NewForwarder("server-a", "rtmp://cdn1/live", "rtmp://cdn2/live?token=xxx")
+* 		if err := f.Start(req); err != nil {
+* 			// ERROR_SYSTEM_FORWARD_LOOP
+* 		}
+* 		defer f.Stop()
+* 		for {
+* 			msg, err := s.Protocol().RecvMessage()
+* 			f.OnMessage(msg)
+* 		}
+* the forwarder publish the req.Stream to each upstream, and reconnect with backoff when failed,
+* the metadata and sequence headers are cached and sent to upstream when published.
+* the ServerId is appended to the FORWARD_MARKER of connect object, to stop the forward loop.
+ */
+type Forwarder struct {
+	// the id of server, unique in cluster, to detect the forward loop.
+	ServerId string
+	// the tcUrls of upstreams, the stream is the req.Stream.
+	Upstreams []string
+	// the timeout to connect and publish to upstream.
+	Timeout time.Duration
+	// the backoff to reconnect, doubled for each failure from min to max.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// the max messages queued for each upstream, drop the message when full.
+	QueueSize int
+	logger Logger
+	// the cached metadata and sequence headers.
+	headers *header_cache
+	upstreams []*forward_upstream
+	cancel context.CancelFunc
+	wait *sync.WaitGroup
+}
+func NewForwarder(server_id string, upstreams ...string) (*Forwarder) {
+	r := &Forwarder{}
+	r.ServerId = server_id
+	r.Upstreams = upstreams
+	r.Timeout = FORWARD_DEFAULT_TIMEOUT
+	r.MinBackoff = FORWARD_DEFAULT_MIN_BACKOFF
+	r.MaxBackoff = FORWARD_DEFAULT_MAX_BACKOFF
+	r.QueueSize = FORWARD_DEFAULT_QUEUE_SIZE
+	r.logger = null_logger{}
+	r.headers = new_header_cache()
+	r.wait = &sync.WaitGroup{}
+	return r
+}
+
+/**
+* set the logger of forwarder and upstream connections, nil to discard.
+* @remark user should set the logger before Start.
+ */
+func (r *Forwarder) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = null_logger{}
+	}
+	r.logger = logger
+}
+
+/**
+* start to forward the stream of req to upstreams.
+* @param req the request of publish client, the stream is identified.
+* @return ERROR_SYSTEM_FORWARD_LOOP when the stream is forwarded by this server.
+ */
+func (r *Forwarder) Start(req *Request) (err error) {
+	if err = CheckForwardLoop(req, r.ServerId); err != nil {
+		return
+	}
+
+	forwarded_by := append([]string{}, req.ForwardedBy...)
+	forwarded_by = append(forwarded_by, r.ServerId)
+
+	var ctx context.Context
+	ctx, r.cancel = context.WithCancel(context.Background())
+	for _, v := range r.Upstreams {
+		u := &forward_upstream{}
+		u.forwarder = r
+		u.tc_url = v
+		u.stream = req.Stream
+		u.forwarded_by = forwarded_by
+		u.msgs = make(chan *Message, r.QueueSize)
+		u.log_ctx = new_log_context(v)
+		u.log_ctx.Vhost, u.log_ctx.App, u.log_ctx.Stream = req.Vhost, req.App, req.Stream
+		r.upstreams = append(r.upstreams, u)
+
+		r.wait.Add(1)
+		go func(u *forward_upstream) {
+			defer r.wait.Done()
+			u.run(ctx)
+		}(u)
+	}
+	return
+}
+
+/**
+* stop to forward, close all upstream connections.
+ */
+func (r *Forwarder) Stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wait.Wait()
+
+	for _, u := range r.upstreams {
+		u.drop_queued()
+	}
+	r.headers.release()
+}
+
+/**
+* forward the message of publish client to all upstreams,
+* the message is copied, user still owns the msg.
+* the message is dropped for the upstream when its queue is full.
+ */
+func (r *Forwarder) OnMessage(msg *Message) {
+	r.headers.update(msg)
+
+	for _, u := range r.upstreams {
+		copy := msg.Copy()
+		select {
+		case u.msgs <- copy:
+		default:
+			copy.Release()
+			u.warn("queue full, drop %v", message_dump(msg))
+		}
+	}
+}
+
+/**
+* the cache of metadata and sequence headers, which is sent first
+* to the new upstream or player, before the audio and video.
+ */
+type header_cache struct {
+	lock *sync.Mutex
+	metadata *Message
+	audio_sh *Message
+	video_sh *Message
+}
+
+func new_header_cache() (*header_cache) {
+	return &header_cache{lock:&sync.Mutex{}}
+}
+
+// cache the copy of msg if it's the metadata or sequence header.
+func (r *header_cache) update(msg *Message) {
+	var cached **Message
+	switch {
+	case is_metadata(msg):
+		cached = &r.metadata
+	case msg.Header.IsAudio() && is_sequence_header(msg):
+		cached = &r.audio_sh
+	case msg.Header.IsVideo() && is_sequence_header(msg):
+		cached = &r.video_sh
+	default:
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if *cached != nil {
+		(*cached).Release()
+	}
+	*cached = msg.Copy()
+}
+
+// get the copy of cached metadata and sequence headers, in order.
+func (r *header_cache) copies() (msgs []*Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, msg := range []*Message{r.metadata, r.audio_sh, r.video_sh} {
+		if msg != nil {
+			msgs = append(msgs, msg.Copy())
+		}
+	}
+	return
+}
+
+// release the cached messages.
+func (r *header_cache) release() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, msg := range []*Message{r.metadata, r.audio_sh, r.video_sh} {
+		if msg != nil {
+			msg.Release()
+		}
+	}
+	r.metadata, r.audio_sh, r.video_sh = nil, nil, nil
+}
+
+/**
+* whether the msg is the metadata, the onMetaData or @setDataFrame.
+ */
+func is_metadata(msg *Message) (bool) {
+	payload := msg.Payload
+	if msg.Header.IsAmf3Data() && len(payload) > 0 {
+		payload = payload[1:]
+	} else if !msg.Header.IsAmf0Data() {
+		return false
+	}
+
+	name, err := NewAmf0Codec(NewRtmpStream(payload)).ReadString()
+	return err == nil && (name == AMF0_DATA_ON_METADATA || name == AMF0_DATA_SET_DATAFRAME)
+}
+
+// the upstream of forwarder.
+type forward_upstream struct {
+	forwarder *Forwarder
+	tc_url string
+	stream string
+	forwarded_by []string
+	// the queued messages to forward.
+	msgs chan *Message
+	log_ctx *LogContext
+}
+
+func (r *forward_upstream) warn(format string, v ...interface {}) {
+	if logger := r.forwarder.logger; logger.Enabled(LogLevelWarn) {
+		logger.Log(LogLevelWarn, r.log_ctx, format, v...)
+	}
+}
+
+// forward util the ctx is done, reconnect with backoff when failed.
+func (r *forward_upstream) run(ctx context.Context) {
+	f := r.forwarder
+	backoff := f.MinBackoff
+	for {
+		published, err := r.forward(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// reset the backoff when published, for the upstream is ok.
+		if published {
+			backoff = f.MinBackoff
+		}
+		r.warn("forward to %v failed, retry in %v, %v", r.tc_url, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > f.MaxBackoff {
+			backoff = f.MaxBackoff
+		}
+	}
+}
+
+// connect and publish to upstream, then forward messages util failed.
+func (r *forward_upstream) forward(ctx context.Context) (published bool, err error) {
+	f := r.forwarder
+
+	publish_ctx, cancel := context.WithTimeout(ctx, f.Timeout)
+	defer cancel()
+
+	var c Client
+	if c, err = DialClient(publish_ctx, r.tc_url); err != nil {
+		return
+	}
+	defer c.Destroy()
+	c.SetLogger(f.logger)
+
+	if err = c.HandshakeContext(publish_ctx); err != nil {
+		return
+	}
+
+	req := NewRequest()
+	req.TcUrl = r.tc_url
+	req.ForwardedBy = r.forwarded_by
+	if err = c.ConnectAppContext(publish_ctx, req); err != nil {
+		return
+	}
+
+	var stream_id uint32
+	if stream_id, err = c.PublishContext(publish_ctx, r.stream); err != nil {
+		return
+	}
+	published = true
+
+	// drop the messages queued when disconnected, start with the cached headers.
+	r.drop_queued()
+	for _, msg := range f.headers.copies() {
+		if err = c.Protocol().SendMessage(msg, stream_id); err != nil {
+			return
+		}
+	}
+
+	// drop the messages from upstream, for example, the ack and ping.
+	go func() {
+		for {
+			msg, err := c.Protocol().RecvMessage()
+			if err != nil {
+				return
+			}
+			msg.Release()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.Done():
+			return published, c.Err()
+		case msg := <-r.msgs:
+			if err = c.Protocol().SendMessage(msg, stream_id); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// drop all queued messages.
+func (r *forward_upstream) drop_queued() {
+	for {
+		select {
+		case msg := <-r.msgs:
+			msg.Release()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwardLoop(t *testing.T) {
+	req := NewRequest()
+	req.ForwardedBy = []string{"server-a", "server-b"}
+
+	err := NewForwarder("server-b").Start(req)
+	if v, ok := err.(Error); !ok || v.Code() != ERROR_SYSTEM_FORWARD_LOOP {
+		t.Errorf("expect forward loop, actual %v", err)
+	}
+
+	f := NewForwarder("server-c")
+	if err = f.Start(req); err != nil {
+		t.Error(err)
+	}
+	f.Stop()
+}
+
+func TestForwarder(t *testing.T) {
+	metadata := seed_amf0(AMF0_DATA_SET_DATAFRAME, AMF0_DATA_ON_METADATA)
+	headers := []conformance_av{
+		{RTMP_MSG_AMF0DataMessage, 0, 1, len(metadata)},
+		{RTMP_MSG_AudioMessage, 0, 1, len(aac_sequence_header)},
+		{RTMP_MSG_VideoMessage, 0, 1, len(avc_sequence_header)},
+	}
+
+	// the upstream got the cached headers, then the frame for the first connection.
+	upstreams := make(chan []conformance_av)
+	frame := make(chan bool)
+	var nb_connections int32
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		// only serve two connections, the forwarder retry util stopped.
+		if atomic.AddInt32(&nb_connections, 1) > 2 {
+			return
+		}
+
+		req := NewRequest()
+		serve_connect(t, s, req)
+		if !reflect.DeepEqual(req.ForwardedBy, []string{"origin", "edge"}) {
+			t.Errorf("forwarded by %v", req.ForwardedBy)
+		}
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+			return
+		}
+
+		msgs := recv_av_messages(t, s, len(headers))
+		if <-frame {
+			msgs = append(msgs, recv_av_messages(t, s, 1)...)
+		}
+		upstreams <- msgs
+	})
+	defer close()
+
+	req := NewRequest()
+	req.Vhost, req.App, req.Stream = "127.0.0.1", "live", "livestream"
+	req.ForwardedBy = []string{"origin"}
+
+	// the headers before start are cached.
+	f := NewForwarder("edge", tc_url)
+	f.MinBackoff = 10 * time.Millisecond
+	f.OnMessage(new_av_message(RTMP_MSG_AMF0DataMessage, 0, metadata))
+	f.OnMessage(new_av_message(RTMP_MSG_VideoMessage, 0, avc_sequence_header))
+	f.OnMessage(new_av_message(RTMP_MSG_AudioMessage, 0, aac_sequence_header))
+
+	if err := f.Start(req); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+
+	// the upstream got the headers, forward the frame, then disconnect.
+	frame <- true
+	f.OnMessage(new_av_message(RTMP_MSG_VideoMessage, 40, conformance_frame(true, 1024)))
+	expect := append(append([]conformance_av{}, headers...), conformance_av{RTMP_MSG_VideoMessage, 40, 1, 1024})
+	if msgs := <-upstreams; !reflect.DeepEqual(msgs, expect) {
+		t.Errorf("expect %v, actual %v", expect, msgs)
+	}
+
+	// reconnect, the cached headers are sent again.
+	frame <- false
+	if msgs := <-upstreams; !reflect.DeepEqual(msgs, headers) {
+		t.Errorf("expect %v, actual %v", headers, msgs)
+	}
+}
@@ -0,0 +1,228 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"testing"
+)
+
+/**
+* the seed corpus of fuzz targets is in testdata/fuzz, the messages and sessions
+* of FMLE 3.0, OBS 27, ffmpeg(Lavf58), librtmp and flash player 11,
+* for example, the field of connect, the sequence of publish/play commands
+* and the chunk header format(fmt=1/2/3, extended timestamp) they use.
+* the seeds are synthetic, encoded by seed_session, except the *-capture seeds of
+* FuzzChunkStream, which are the captured sessions of testdata/sessions after handshake.
+* to add a capture, write the bytes after handshake to the corpus of FuzzChunkStream.
+ */
+
+// create an amf0 object with the key-values.
+func seed_amf0_object(kvs ...interface {}) (v *Amf0Object) {
+	v = NewAmf0Object()
+	for i := 0; i < len(kvs); i += 2 {
+		v.Set(kvs[i].(string), NewAmf0(kvs[i + 1]))
+	}
+	return
+}
+
+// create an amf0 ecma array with the key-values.
+func seed_amf0_ecma_array(kvs ...interface {}) (v *Amf0EcmaArray) {
+	v = NewAmf0EcmaArray()
+	for i := 0; i < len(kvs); i += 2 {
+		v.Set(kvs[i].(string), NewAmf0(kvs[i + 1]))
+	}
+	return
+}
+
+// encode the values in amf0, nil for amf0 null.
+func seed_amf0(values ...interface {}) (b []byte) {
+	var anys []*Amf0Any
+	size := 0
+	for _, v := range values {
+		a := NewAmf0Null()
+		if v != nil {
+			a = NewAmf0(v)
+		}
+		anys = append(anys, a)
+		size += a.Size()
+	}
+
+	stream := NewRtmpStream(make([]byte, size))
+	codec := NewAmf0Codec(stream)
+	for _, a := range anys {
+		if err := a.Write(codec); err != nil {
+			panic(err)
+		}
+	}
+	return stream.WrittenBytes()
+}
+
+// the client->server bytes of session, start with the c0c1 and c2 of simple handshake,
+// the messages are chunked by the client protocol stack.
+type seed_session struct {
+	enc *protocol
+	b []byte
+}
+
+func new_seed_session() (*seed_session) {
+	c0c1 := append([]byte{0x03}, make([]byte, 1536)...)
+	return &seed_session{enc:new_protocol(NewSocket(nil)), b:append(c0c1, make([]byte, 1536)...)}
+}
+
+func (r *seed_session) send(cid int, message_type byte, timestamp uint64, stream_id uint32, payload []byte) (*seed_session) {
+	msg := NewMessage()
+	msg.Header.MessageType = message_type
+	msg.Header.PayloadLength = uint32(len(payload))
+	msg.Header.Timestamp = timestamp
+	msg.Header.StreamId = stream_id
+	msg.Payload = payload
+	msg.PerferCid = cid
+
+	iovs, _, err := r.enc.encode_chunks(msg, nil, nil)
+	if err != nil {
+		panic(err)
+	}
+	for _, iov := range iovs {
+		r.b = append(r.b, iov...)
+	}
+
+	if err = r.enc.on_sent_message(msg); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r *seed_session) raw(b ...byte) (*seed_session) {
+	r.b = append(r.b, b...)
+	return r
+}
+
+// the error must be the Error of decoder, never panic or unknown error.
+func fuzz_assert_error(t *testing.T, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := err.(Error); !ok {
+		t.Fatalf("unexpected error %T %v", err, err)
+	}
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	f.Fuzz(func(t *testing.T, message_type byte, payload []byte) {
+		p := new_protocol(NewSocket(nil))
+		// the requests sent by client, to decode the _result and _error.
+		p.requests[1.0] = AMF0_COMMAND_CONNECT
+		p.requests[2.0] = AMF0_COMMAND_RELEASE_STREAM
+		p.requests[4.0] = AMF0_COMMAND_CREATE_STREAM
+
+		header := &MessageHeader{MessageType:message_type, PayloadLength:uint32(len(payload))}
+		_, err := DecodePacket(p, header, payload)
+		fuzz_assert_error(t, err)
+	})
+}
+
+func FuzzChunkStream(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := new_protocol(NewSocket(nil))
+		p.buffer = NewRtmpStream(append([]byte(nil), data...))
+
+		for {
+			msg, err := p.do_recv_msg_goroutine_job()
+			if err != nil {
+				fuzz_assert_error(t, err)
+				return
+			}
+
+			if msg == nil {
+				continue
+			}
+
+			msgs := []*Message{msg}
+			if msg.Header.IsAggregate() {
+				if msgs, err = demux_aggregate(msg); err != nil {
+					fuzz_assert_error(t, err)
+					return
+				}
+			}
+			for _, msg = range msgs {
+				_, err = p.DecodeMessage(msg)
+				fuzz_assert_error(t, err)
+			}
+		}
+	})
+}
+
+func FuzzAmf0Any(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		codec := NewAmf0Codec(NewRtmpStream(data))
+		for !codec.stream.Empty() {
+			var v Amf0Any
+			if err := v.Read(codec); err != nil {
+				fuzz_assert_error(t, err)
+				return
+			}
+		}
+	})
+}
+
+func TestRecoverDecode(t *testing.T) {
+	// the buffer overflow is recovered to the decode error.
+	read := func() (err error) {
+		defer recover_decode(&err, ERROR_RTMP_MESSAGE_DECODE)
+		NewRtmpStream([]byte{0x00, 0x01}).ReadUInt32()
+		return
+	}
+	assert_error_code(t, read(), ERROR_RTMP_MESSAGE_DECODE)
+
+	// the other panic is raised again.
+	defer func() {
+		if v := recover(); v != "bug" {
+			t.Errorf("expect panic bug, actual %v", v)
+		}
+	}()
+	func() (err error) {
+		defer recover_decode(&err, ERROR_RTMP_MESSAGE_DECODE)
+		panic("bug")
+	}()
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	messages := []struct {
+		message_type byte
+		payload []byte
+	} {
+		{RTMP_MSG_AMF0CommandMessage, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object("app", "live", "tcUrl", "rtmp://127.0.0.1/live"))},
+		{RTMP_MSG_AMF0CommandMessage, seed_amf0(AMF0_COMMAND_PLAY, 4.0, nil, "livestream", -2.0, -1.0, true)},
+		{RTMP_MSG_AMF0DataMessage, seed_amf0(AMF0_DATA_SET_DATAFRAME, AMF0_DATA_ON_METADATA, seed_amf0_ecma_array("width", 1280.0))},
+		{RTMP_MSG_SetPeerBandwidth, []byte{0x00, 0x26, 0x25, 0xa0, 0x02}},
+		{RTMP_MSG_UserControlMessage, []byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0xb8}},
+	}
+
+	// each truncated payload fails with the decode error, never panic.
+	for _, m := range messages {
+		for i := 0; i < len(m.payload); i++ {
+			header := &MessageHeader{MessageType:m.message_type, PayloadLength:uint32(i)}
+			_, err := DecodePacket(new_protocol(NewSocket(nil)), header, m.payload[:i])
+			fuzz_assert_error(t, err)
+		}
+	}
+}
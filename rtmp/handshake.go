@@ -22,6 +22,7 @@
 package rtmp
 
 import (
+	"context"
 	"io"
 	"math/rand"
 )
@@ -61,6 +62,96 @@ func (r *protocol) handshake_read_c2() (err error) {
 }
 
 func (r *protocol) SimpleHandshake2Client() (err error) {
+	return r.SimpleHandshake2ClientContext(context.Background())
+}
+
+func (r *protocol) SimpleHandshake2ClientContext(ctx context.Context) (err error) {
+	r.UpdateLogContext(func(v *LogContext) {
+		v.State = LogStateHandshake
+	})
+
+	// apply the deadline and cancel of ctx to the handshake io.
+	stop := r.conn.WatchContext(ctx)
+	err = r.simple_handshake_to_client()
+	stop()
+
+	if err != nil {
+		err = r.close_by_context(ctx, err)
+		r.warn("simple handshake failed, %v", err)
+		return
+	}
+	r.info("simple handshake ok")
+
+	// start messages input/outout goroutines
+	r.start_message_pump_goroutines()
+
+	return
+}
+
+func (r *protocol) SimpleHandshake2Server() (err error) {
+	return r.SimpleHandshake2ServerContext(context.Background())
+}
+
+func (r *protocol) SimpleHandshake2ServerContext(ctx context.Context) (err error) {
+	r.UpdateLogContext(func(v *LogContext) {
+		v.State = LogStateHandshake
+	})
+
+	// apply the deadline and cancel of ctx to the handshake io.
+	stop := r.conn.WatchContext(ctx)
+	err = r.simple_handshake_to_server()
+	stop()
+
+	if err != nil {
+		err = r.close_by_context(ctx, err)
+		r.warn("simple handshake with server failed, %v", err)
+		return
+	}
+	r.info("simple handshake with server ok")
+
+	// start messages input/outout goroutines
+	r.start_message_pump_goroutines()
+
+	return
+}
+
+func (r *protocol) simple_handshake_to_server() (err error) {
+	var handshake *Handshake = r.handshake
+
+	// for simple handshake, fill the c0c1 with random data
+	handshake.c0c1 = make([]byte, 1537)
+	for i, _ := range handshake.c0c1 {
+		handshake.c0c1[i] = byte(rand.Int())
+	}
+	// plain text required.
+	handshake.c0c1[0] = 0x03
+
+	if _, err = r.conn.Write(handshake.c0c1); err != nil {
+		return
+	}
+
+	handshake.s0s1s2 = make([]byte, 3073)
+	if _, err = io.ReadFull(r.conn, handshake.s0s1s2); err != nil {
+		return
+	}
+
+	// plain text required.
+	if handshake.s0s1s2[0] != 0x03 {
+		err = Error{code:ERROR_RTMP_PLAIN_REQUIRED, desc:"only support rtmp plain text"}
+		return
+	}
+
+	// for simple handshake, the c2 is the echo of s1.
+	handshake.c2 = make([]byte, 1536)
+	copy(handshake.c2, handshake.s0s1s2[1:1537])
+	if _, err = r.conn.Write(handshake.c2); err != nil {
+		return
+	}
+
+	return
+}
+
+func (r *protocol) simple_handshake_to_client() (err error) {
 	var handshake *Handshake = r.handshake
 
 	// read the c0c1 from connection if not read yet
@@ -96,8 +187,5 @@ func (r *protocol) SimpleHandshake2Client() (err error) {
 		return
 	}
 
-	// start messages input/outout goroutines
-	r.start_message_pump_goroutines()
-
 	return
 }
@@ -0,0 +1,373 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the actions of http hooks, the action field of event.
+const (
+	HOOK_ACTION_OnConnect = "on_connect"
+	HOOK_ACTION_OnPublish = "on_publish"
+	HOOK_ACTION_OnUnpublish = "on_unpublish"
+	HOOK_ACTION_OnPlay = "on_play"
+	HOOK_ACTION_OnStop = "on_stop"
+	HOOK_ACTION_OnDvr = "on_dvr"
+)
+
+// the default timeout of each http hook request.
+const HOOK_DEFAULT_TIMEOUT = 3 * time.Second
+// the default retries when http hook failed, for example, 5xx or timeout.
+const HOOK_DEFAULT_RETRIES = 2
+// the default interval between retries.
+const HOOK_DEFAULT_RETRY_INTERVAL = 100 * time.Millisecond
+// the max size of hook response body.
+const HOOK_MAX_RESPONSE_SIZE = 4096
+
+/**
+* the urls of http hooks for a vhost, each event is POST to all urls in order,
+* empty to ignore the event. for example,
+* 		OnPublish: []string{"http://127.0.0.1:8085/api/v1/streams"}
+ */
+type HTTPHooksConfig struct {
+	OnConnect []string
+	OnPublish []string
+	OnUnpublish []string
+	OnPlay []string
+	OnStop []string
+	OnDvr []string
+}
+
+/**
+* the client of http hooks, which describe the connection and stream.
+ */
+type HookClient struct {
+	// the id of connection, @see LogContext
+	Id uint64
+	// the ip of client, without port.
+	Ip string
+	// the request of connection, the stream is parsed when identified.
+	Req *Request
+	// the CLIENT_TYPE_* by IdentifyClient, empty for on_connect.
+	ClientType string
+	// the stream id by IdentifyClient, 0 for on_connect.
+	StreamId uint32
+}
+
+/**
+* create the hook client of server, the id and ip is from the log context.
+* @param client_type the client type from IdentifyClient, empty when unknown.
+* @param stream_id the stream id from IdentifyClient, 0 when unknown.
+ */
+func NewHookClient(s Server, req *Request, client_type string, stream_id uint32) (*HookClient) {
+	r := &HookClient{}
+	ctx := s.Protocol().LogContext()
+	r.Id = ctx.Id
+	r.Ip = ctx.RemoteAddr
+	if host, _, err := net.SplitHostPort(ctx.RemoteAddr); err == nil {
+		r.Ip = host
+	}
+	r.Req = req
+	r.ClientType = client_type
+	r.StreamId = stream_id
+	return r
+}
+
+/**
+* the json event POST to hook, for example,
+* 		{"action":"on_publish","client_id":1,"ip":"127.0.0.1","vhost":"__defaultVhost__",
+* 		"app":"live","stream":"livestream","tcUrl":"rtmp://127.0.0.1/live","pageUrl":"",
+* 		"param":"?key=xxx","client_type":"fmle_publish","stream_id":1}
+ */
+type hook_event struct {
+	Action string `json:"action"`
+	ClientId uint64 `json:"client_id"`
+	Ip string `json:"ip"`
+	Vhost string `json:"vhost"`
+	App string `json:"app"`
+	Stream string `json:"stream,omitempty"`
+	TcUrl string `json:"tcUrl"`
+	PageUrl string `json:"pageUrl"`
+	Param string `json:"param"`
+	ClientType string `json:"client_type,omitempty"`
+	StreamId uint32 `json:"stream_id,omitempty"`
+	File string `json:"file,omitempty"`
+}
+
+/**
+* the http callback hooks, POST the json event to the urls of vhost,
+* the hook accept the event by 2xx with body "0" or {"code":0},
+* a non-zero code or non-2xx is rejection, ERROR_HTTP_HOOK_REJECTED,
+* the transport error and 5xx is retried, ERROR_HTTP_HOOK_FAILED when retries exhausted.
+* user should reject the client when hook failed, for example,
+* 		if err := hooks.OnPublish(c); err != nil {
+* 			s.RejectPublish(stream_id, err.(Error).Desc())
+* 		}
+* @remark the config of DefaultVhost is used when vhost not configured.
+ */
+type HTTPHooks struct {
+	// the timeout of each request.
+	Timeout time.Duration
+	// the retries when failed, 0 to never retry.
+	Retries int
+	// the interval between retries.
+	RetryInterval time.Duration
+	client *http.Client
+	lock *sync.Mutex
+	vhosts map[string]*HTTPHooksConfig
+}
+func NewHTTPHooks() (*HTTPHooks) {
+	r := &HTTPHooks{}
+	r.Timeout = HOOK_DEFAULT_TIMEOUT
+	r.Retries = HOOK_DEFAULT_RETRIES
+	r.RetryInterval = HOOK_DEFAULT_RETRY_INTERVAL
+	r.client = &http.Client{}
+	r.lock = &sync.Mutex{}
+	r.vhosts = map[string]*HTTPHooksConfig{}
+	return r
+}
+
+/**
+* set the hooks of vhost, nil to remove it.
+* use DefaultVhost to set the hooks for all vhosts not configured.
+ */
+func (r *HTTPHooks) SetVhost(vhost string, config *HTTPHooksConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if config == nil {
+		delete(r.vhosts, vhost)
+		return
+	}
+	r.vhosts[vhost] = config
+}
+
+/**
+* set the hooks of all vhosts by config, the vhosts not in config are removed,
+* for example, apply the hooks when config reloaded.
+ */
+func (r *HTTPHooks) SetConfig(c *Config) {
+	vhosts := map[string]*HTTPHooksConfig{}
+	for _, v := range c.Vhosts {
+		if v.Hooks != nil {
+			vhosts[v.Name] = v.Hooks
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.vhosts = vhosts
+}
+
+// get the hooks of vhost, or the default vhost, nil if not configured.
+func (r *HTTPHooks) vhost(vhost string) (*HTTPHooksConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if v, ok := r.vhosts[vhost]; ok {
+		return v
+	}
+	return r.vhosts[DefaultVhost]
+}
+
+/**
+* when client connect app, after ConnectApp.
+ */
+func (r *HTTPHooks) OnConnect(c *HookClient) (err error) {
+	return r.on_event(c, HOOK_ACTION_OnConnect, "", func(v *HTTPHooksConfig) []string {
+		return v.OnConnect
+	})
+}
+
+/**
+* when client start publish, after IdentifyClient.
+ */
+func (r *HTTPHooks) OnPublish(c *HookClient) (err error) {
+	return r.on_event(c, HOOK_ACTION_OnPublish, "", func(v *HTTPHooksConfig) []string {
+		return v.OnPublish
+	})
+}
+
+/**
+* when client stop publish, for example, FMLEUnpublish or disconnect.
+ */
+func (r *HTTPHooks) OnUnpublish(c *HookClient) (err error) {
+	return r.on_event(c, HOOK_ACTION_OnUnpublish, "", func(v *HTTPHooksConfig) []string {
+		return v.OnUnpublish
+	})
+}
+
+/**
+* when client start play, after IdentifyClient.
+ */
+func (r *HTTPHooks) OnPlay(c *HookClient) (err error) {
+	return r.on_event(c, HOOK_ACTION_OnPlay, "", func(v *HTTPHooksConfig) []string {
+		return v.OnPlay
+	})
+}
+
+/**
+* when client stop play, for example, closeStream or disconnect.
+ */
+func (r *HTTPHooks) OnStop(c *HookClient) (err error) {
+	return r.on_event(c, HOOK_ACTION_OnStop, "", func(v *HTTPHooksConfig) []string {
+		return v.OnStop
+	})
+}
+
+/**
+* when the dvr file of publish stream is reaped.
+* @param file the path of dvr file.
+ */
+func (r *HTTPHooks) OnDvr(c *HookClient, file string) (err error) {
+	return r.on_event(c, HOOK_ACTION_OnDvr, file, func(v *HTTPHooksConfig) []string {
+		return v.OnDvr
+	})
+}
+
+func (r *HTTPHooks) on_event(c *HookClient, action string, file string, urls func(v *HTTPHooksConfig) []string) (err error) {
+	config := r.vhost(c.Req.Vhost)
+	if config == nil || len(urls(config)) == 0 {
+		return
+	}
+
+	var body []byte
+	if body, err = json.Marshal(new_hook_event(c, action, file)); err != nil {
+		return
+	}
+
+	for _, url := range urls(config) {
+		if err = r.post(url, body); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func new_hook_event(c *HookClient, action string, file string) (*hook_event) {
+	r := &hook_event{}
+	r.Action = action
+	r.ClientId = c.Id
+	r.Ip = c.Ip
+	r.Vhost = c.Req.Vhost
+	r.App = c.Req.App
+	r.Stream = c.Req.Stream
+	r.TcUrl = c.Req.TcUrl
+	r.PageUrl = c.Req.PageUrl
+	r.ClientType = c.ClientType
+	r.StreamId = c.StreamId
+	r.File = file
+
+	// the params of stream is prefered, for the OBS stream key.
+	if len(c.Req.StreamParams) > 0 {
+		r.Param = "?" + c.Req.StreamParams.Encode()
+	} else if len(c.Req.Param) > 0 {
+		r.Param = "?" + c.Req.Param.Encode()
+	}
+	return r
+}
+
+// post the body to url, retry when failed.
+func (r *HTTPHooks) post(url string, body []byte) (err error) {
+	for i := 0; ; i++ {
+		var retry bool
+		if retry, err = r.do_post(url, body); err == nil || !retry || i >= r.Retries {
+			return
+		}
+		time.Sleep(r.RetryInterval)
+	}
+}
+
+// post the body to url once, retry is true when the error is retryable.
+func (r *HTTPHooks) do_post(url string, body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	var req *http.Request
+	if req, err = http.NewRequest("POST", url, bytes.NewReader(body)); err != nil {
+		return false, Error{code:ERROR_HTTP_PARSE_URI, desc:fmt.Sprintf("invalid hook url %v, %v", url, err)}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	var res *http.Response
+	if res, err = r.client.Do(req); err != nil {
+		return true, Error{code:ERROR_HTTP_HOOK_FAILED, desc:fmt.Sprintf("hook %v failed, %v", url, err)}
+	}
+	defer res.Body.Close()
+
+	var data []byte
+	if data, err = ioutil.ReadAll(io.LimitReader(res.Body, HOOK_MAX_RESPONSE_SIZE)); err != nil {
+		return true, Error{code:ERROR_HTTP_HOOK_FAILED, desc:fmt.Sprintf("hook %v read failed, %v", url, err)}
+	}
+
+	if res.StatusCode >= http.StatusInternalServerError {
+		return true, Error{code:ERROR_HTTP_HOOK_FAILED, desc:fmt.Sprintf("hook %v failed, status=%v", url, res.StatusCode)}
+	}
+	if res.StatusCode < http.StatusOK || res.StatusCode >= http.StatusMultipleChoices {
+		return false, Error{code:ERROR_HTTP_HOOK_REJECTED, desc:fmt.Sprintf("hook rejected, status=%v", res.StatusCode)}
+	}
+
+	var code int
+	if code, err = parse_hook_response(data); err != nil {
+		return false, err
+	}
+	if code != 0 {
+		return false, Error{code:ERROR_HTTP_HOOK_REJECTED, desc:fmt.Sprintf("hook rejected, code=%v", code)}
+	}
+	return false, nil
+}
+
+/**
+* parse the code of hook response, the body is "0" or {"code":0},
+* the empty body is 0 for hooks which only response the status.
+ */
+func parse_hook_response(data []byte) (code int, err error) {
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return 0, nil
+	}
+
+	if v, err := strconv.Atoi(s); err == nil {
+		return v, nil
+	}
+
+	var res struct {
+		Code *int `json:"code"`
+	}
+	if err = json.Unmarshal([]byte(s), &res); err != nil || res.Code == nil {
+		return 0, Error{code:ERROR_HTTP_DATA_INVLIAD, desc:fmt.Sprintf("invalid hook response %v", s)}
+	}
+	return *res.Code, nil
+}
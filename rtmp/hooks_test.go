@@ -0,0 +1,314 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the stand-in control plane, record the events and response by the handler.
+type hook_control_plane struct {
+	*httptest.Server
+	lock sync.Mutex
+	events []map[string]interface {}
+}
+
+func new_hook_control_plane(t *testing.T, handler func(w http.ResponseWriter, event map[string]interface {})) (*hook_control_plane) {
+	r := &hook_control_plane{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("method=%v, content-type=%v", req.Method, req.Header.Get("Content-Type"))
+		}
+		event := map[string]interface {}{}
+		if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+
+		r.lock.Lock()
+		r.events = append(r.events, event)
+		r.lock.Unlock()
+
+		handler(w, event)
+	}))
+	return r
+}
+
+func (r *hook_control_plane) nb_events() (int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.events)
+}
+
+func new_hook_client(vhost string) (*HookClient) {
+	req := NewRequest()
+	req.TcUrl = "rtmp://" + vhost + "/live?token=abc"
+	req.Vhost, req.App = vhost, "live"
+	req.ParseStream("livestream?key=secret")
+	return &HookClient{Id:7, Ip:"127.0.0.1", Req:req, ClientType:CLIENT_TYPE_FMLEPublish, StreamId:1}
+}
+
+func assert_hook_error(t *testing.T, err error, code int) {
+	if v, ok := err.(Error); !ok || v.Code() != code {
+		t.Errorf("expect code %v, actual %v", code, err)
+	}
+}
+
+func TestHTTPHooksEvent(t *testing.T) {
+	cp := new_hook_control_plane(t, func(w http.ResponseWriter, event map[string]interface {}) {
+		w.Write([]byte(`{"code":0}`))
+	})
+	defer cp.Close()
+
+	hooks := NewHTTPHooks()
+	hooks.SetVhost(DefaultVhost, &HTTPHooksConfig{OnPublish:[]string{cp.URL}, OnDvr:[]string{cp.URL}})
+
+	c := new_hook_client("127.0.0.1")
+	if err := hooks.OnPublish(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooks.OnDvr(c, "./objs/livestream.flv"); err != nil {
+		t.Fatal(err)
+	}
+	// not configured.
+	if err := hooks.OnPlay(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cp.events) != 2 {
+		t.Fatalf("expect 2 events, actual %v", cp.events)
+	}
+	expect := map[string]interface {}{
+		"action":"on_publish", "client_id":7.0, "ip":"127.0.0.1", "vhost":"127.0.0.1", "app":"live",
+		"stream":"livestream", "tcUrl":"rtmp://127.0.0.1/live?token=abc", "pageUrl":"", "param":"?key=secret",
+		"client_type":"fmle_publish", "stream_id":1.0,
+	}
+	for k, v := range expect {
+		if cp.events[0][k] != v {
+			t.Errorf("%v expect %v, actual %v", k, v, cp.events[0][k])
+		}
+	}
+	if cp.events[1]["action"] != "on_dvr" || cp.events[1]["file"] != "./objs/livestream.flv" {
+		t.Errorf("dvr event %v", cp.events[1])
+	}
+}
+
+func TestHTTPHooksReject(t *testing.T) {
+	for _, c := range []struct {
+		status int
+		body string
+		code int
+	}{
+		{200, "0", 0},
+		{200, "", 0},
+		{200, `{"code":0,"data":{}}`, 0},
+		{200, "1", ERROR_HTTP_HOOK_REJECTED},
+		{200, `{"code":403}`, ERROR_HTTP_HOOK_REJECTED},
+		{200, "forbidden", ERROR_HTTP_DATA_INVLIAD},
+		{200, `{"msg":"ok"}`, ERROR_HTTP_DATA_INVLIAD},
+		{403, "0", ERROR_HTTP_HOOK_REJECTED},
+		{302, "0", ERROR_HTTP_HOOK_REJECTED},
+	} {
+		cp := new_hook_control_plane(t, func(w http.ResponseWriter, event map[string]interface {}) {
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		})
+
+		hooks := NewHTTPHooks()
+		hooks.SetVhost(DefaultVhost, &HTTPHooksConfig{OnConnect:[]string{cp.URL}})
+		err := hooks.OnConnect(new_hook_client("127.0.0.1"))
+		if c.code == 0 && err != nil {
+			t.Errorf("status=%v, body=%v, expect ok, actual %v", c.status, c.body, err)
+		} else if c.code != 0 {
+			assert_hook_error(t, err, c.code)
+		}
+		// never retry the rejection.
+		if cp.nb_events() != 1 {
+			t.Errorf("status=%v, body=%v, expect 1 request, actual %v", c.status, c.body, cp.nb_events())
+		}
+		cp.Close()
+	}
+}
+
+func TestHTTPHooksRetry(t *testing.T) {
+	// the number of requests to fail.
+	failures := 1
+	cp := new_hook_control_plane(t, func(w http.ResponseWriter, event map[string]interface {}) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("0"))
+	})
+	defer cp.Close()
+
+	hooks := NewHTTPHooks()
+	hooks.RetryInterval = time.Millisecond
+	hooks.SetVhost(DefaultVhost, &HTTPHooksConfig{OnUnpublish:[]string{cp.URL}})
+	if err := hooks.OnUnpublish(new_hook_client("127.0.0.1")); err != nil {
+		t.Error(err)
+	}
+	if cp.nb_events() != 2 {
+		t.Errorf("expect 2 requests, actual %v", cp.nb_events())
+	}
+
+	// always failed, retry then give up.
+	failures = 100
+	hooks.Retries = 2
+	err := hooks.OnUnpublish(new_hook_client("127.0.0.1"))
+	assert_hook_error(t, err, ERROR_HTTP_HOOK_FAILED)
+	if cp.nb_events() != 5 {
+		t.Errorf("expect 5 requests, actual %v", cp.nb_events())
+	}
+}
+
+func TestHTTPHooksTimeout(t *testing.T) {
+	done := make(chan struct{})
+	cp := new_hook_control_plane(t, func(w http.ResponseWriter, event map[string]interface {}) {
+		<-done
+	})
+	defer cp.Close()
+	defer close(done)
+
+	hooks := NewHTTPHooks()
+	hooks.Timeout = 50 * time.Millisecond
+	hooks.Retries = 1
+	hooks.RetryInterval = time.Millisecond
+	hooks.SetVhost(DefaultVhost, &HTTPHooksConfig{OnStop:[]string{cp.URL}})
+
+	starttime := time.Now()
+	err := hooks.OnStop(new_hook_client("127.0.0.1"))
+	assert_hook_error(t, err, ERROR_HTTP_HOOK_FAILED)
+	if elapsed := time.Since(starttime); elapsed > 2 * time.Second {
+		t.Errorf("timeout too long %v", elapsed)
+	}
+	if cp.nb_events() != 2 {
+		t.Errorf("expect 2 requests, actual %v", cp.nb_events())
+	}
+}
+
+func TestHTTPHooksVhost(t *testing.T) {
+	var actions []string
+	var lock sync.Mutex
+	handler := func(name string) func(w http.ResponseWriter, event map[string]interface {}) {
+		return func(w http.ResponseWriter, event map[string]interface {}) {
+			lock.Lock()
+			actions = append(actions, name + ":" + event["vhost"].(string))
+			lock.Unlock()
+			w.Write([]byte("0"))
+		}
+	}
+	default_cp := new_hook_control_plane(t, handler("default"))
+	defer default_cp.Close()
+	vhost_cp := new_hook_control_plane(t, handler("vhost"))
+	defer vhost_cp.Close()
+
+	hooks := NewHTTPHooks()
+	hooks.SetVhost(DefaultVhost, &HTTPHooksConfig{OnPlay:[]string{default_cp.URL}})
+	hooks.SetVhost("hooks.test", &HTTPHooksConfig{OnPlay:[]string{vhost_cp.URL, default_cp.URL}})
+	// the vhost without hooks.
+	hooks.SetVhost("nohooks.test", &HTTPHooksConfig{})
+
+	for _, vhost := range []string{"hooks.test", "other.test", "nohooks.test"} {
+		if err := hooks.OnPlay(new_hook_client(vhost)); err != nil {
+			t.Error(err)
+		}
+	}
+	hooks.SetVhost("hooks.test", nil)
+	if err := hooks.OnPlay(new_hook_client("hooks.test")); err != nil {
+		t.Error(err)
+	}
+
+	expect := []string{"vhost:hooks.test", "default:hooks.test", "default:other.test", "default:hooks.test"}
+	if len(actions) != len(expect) {
+		t.Fatalf("expect %v, actual %v", expect, actions)
+	}
+	for i, v := range expect {
+		if actions[i] != v {
+			t.Errorf("expect %v, actual %v", expect, actions)
+		}
+	}
+}
+
+func TestHTTPHooksRejectPublish(t *testing.T) {
+	cp := new_hook_control_plane(t, func(w http.ResponseWriter, event map[string]interface {}) {
+		w.Write([]byte(`{"code":403}`))
+	})
+	defer cp.Close()
+
+	hooks := NewHTTPHooks()
+	hooks.SetVhost(DefaultVhost, &HTTPHooksConfig{OnPublish:[]string{cp.URL}})
+
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	c.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 3.0, nil, "livestream", "live"))
+
+	responses := replay_session(t, c.b, 2, func(s Server) {
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		client_type, _, err := s.IdentifyClient(1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = hooks.OnPublish(NewHookClient(s, req, client_type, 1))
+		assert_hook_error(t, err, ERROR_HTTP_HOOK_REJECTED)
+		if err := s.RejectPublish(1, err.(Error).Desc()); err != nil {
+			t.Error(err)
+		}
+	})
+
+	if len(cp.events) != 1 || cp.events[0]["client_type"] != CLIENT_TYPE_FlashPublish || cp.events[0]["stream"] != "livestream" {
+		t.Errorf("events %v", cp.events)
+	}
+	assert_responses(t, responses[len(responses) - 1:], []string{
+		`cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Publish.BadName",description:"hook rejected, code=403",clientid:"ASAICiss"}`,
+	})
+}
+
+func TestHTTPHooksSetConfig(t *testing.T) {
+	c, err := ParseConfig([]byte(test_config))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := NewHTTPHooks()
+	hooks.SetVhost("removed.test", &HTTPHooksConfig{})
+	hooks.SetConfig(c)
+	if v := hooks.vhost("config.test"); v == nil || len(v.OnPublish) != 2 {
+		t.Errorf("hooks %+v", v)
+	}
+	if v := hooks.vhost("removed.test"); v != nil {
+		t.Errorf("hooks %+v", v)
+	}
+}
@@ -21,6 +21,17 @@
 
 package rtmp
 
+import (
+	"fmt"
+	"io"
+)
+
+/**
+* the threshold of removed bytes to compact the BytesList,
+* for the long-lived connection never drain the read buffer.
+*/
+const RTMP_BYTES_LIST_COMPACT_THRESHOLD = 64 * 1024
+
 // to cache bytes
 // user can use the bytes buffer like a list:
 // list.Append([1, 2, 3]), the list.Bytes() is [1, 2, 3]
@@ -56,6 +67,7 @@ func (r *BytesList) Append(b []byte) {
 }
 // remove n bytes, from the start of buf
 // if all bytes removed, reset the start and end to zero
+// compact the buf when the removed bytes exceed the threshold.
 func (r *BytesList) Remove(n int) {
 	if n <= 0 {
 		return
@@ -67,6 +79,54 @@ func (r *BytesList) Remove(n int) {
 	} else {
 		r.start += n
 	}
+
+	if r.start >= RTMP_BYTES_LIST_COMPACT_THRESHOLD {
+		r.compact()
+	}
+}
+// read at most n bytes from reader, append to the end of bytes.
+// the bytes is read into the buf directly, without copy.
+func (r *BytesList) FillFrom(reader io.Reader, n int) (nread int, err error) {
+	r.reserve(r.Len() + n)
+
+	nread, err = reader.Read(r.buf[r.end:r.end+n])
+	if nread > 0 {
+		r.end += nread
+	}
+	return
+}
+// move the bytes to the start of buf, to reuse the removed space.
+func (r *BytesList) compact() {
+	if r.start <= 0 {
+		return
+	}
+
+	r.end = copy(r.buf, r.buf[r.start:r.end])
+	r.start = 0
+}
+// ensure the capacity from start is greater than or equals to n,
+// compact or grow the buf if need more space.
+func (r *BytesList) reserve(n int) {
+	if len(r.buf) - r.start >= n {
+		return
+	}
+
+	// reuse the removed space.
+	if len(r.buf) >= n {
+		r.compact()
+		return
+	}
+
+	// double the capacity, to avoid grow for each append.
+	capacity := 2 * len(r.buf)
+	if capacity < n {
+		capacity = n
+	}
+
+	buf := make([]byte, capacity)
+	r.end = copy(buf, r.buf[r.start:r.end])
+	r.start = 0
+	r.buf = buf
 }
 // grow the end of bytes, ensure can use copy always,
 // that is, ensure the Len() always greater than or equals to n
@@ -77,10 +137,7 @@ func (r *BytesList) grow_to(n int) {
 	}
 
 	// grow the capacity
-	capacity_grow := n - (len(r.buf) - r.start)
-	if capacity_grow > 0 {
-		r.buf = append(r.buf, make([]byte, capacity_grow)...)
-	}
+	r.reserve(n)
 
 	// grow the r.end to grow the Bytes()
 	r.end += n - r.Len()
@@ -118,6 +175,9 @@ func (r *HPBuffer) WrittenBytes() ([]byte) {
 	b := r.buffer.Bytes()
 	return b[0:r.off]
 }
+func (r *HPBuffer) FillFrom(reader io.Reader, n int) (nread int, err error) {
+	return r.buffer.FillFrom(reader, n)
+}
 func (r *HPBuffer) Append(b []byte) (n int, err error) {
 	r.buffer.Append(b)
 
@@ -125,31 +185,40 @@ func (r *HPBuffer) Append(b []byte) (n int, err error) {
 	return
 }
 func (r *HPBuffer) Consume(n int) (err error) {
+	if n < 0 || n > r.buffer.Len() {
+		return Error{code:ERROR_GO_BUFFER_OVERFLOW, desc:fmt.Sprintf("consume %v bytes, total %v bytes", n, r.buffer.Len())}
+	}
 	r.buffer.Remove(n)
 	r.off -= n
-	// TODO: FIXME: return err
 	return
 }
+// skip n bytes, n can be negative to rollback, the off must in [0, total].
 func (r *HPBuffer) Skip(n int) (err error) {
+	if off := r.off + n; off < 0 || off > r.buffer.Len() {
+		return Error{code:ERROR_GO_BUFFER_OVERFLOW, desc:fmt.Sprintf("skip %v bytes, off %v, total %v bytes", n, r.off, r.buffer.Len())}
+	}
 	r.off += n
-	// TODO: FIXME: return err
 	return
 }
 func (r *HPBuffer) Read(b []byte) (n int, err error) {
 	bytes := r.Bytes()
+	if len(b) > len(bytes) {
+		return 0, Error{code:ERROR_GO_BUFFER_OVERFLOW, desc:fmt.Sprintf("read %v bytes, left %v bytes", len(b), len(bytes))}
+	}
 
 	n = len(b)
 	copy(b, bytes[0:n])
 	r.off += n
-	// TODO: FIXME: return err
 	return
 }
 func (r *HPBuffer) Write(b []byte) (n int, err error) {
 	bytes := r.Bytes()
+	if len(b) > len(bytes) {
+		return 0, Error{code:ERROR_GO_BUFFER_OVERFLOW, desc:fmt.Sprintf("write %v bytes, left %v bytes", len(b), len(bytes))}
+	}
 
 	n = len(b)
 	copy(bytes[0:n], b)
 	r.off += n
-	// TODO: FIXME: return err
 	return
 }
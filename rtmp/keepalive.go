@@ -0,0 +1,188 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the max pending pings, the oldest is dropped when exceed.
+const RTMP_MAX_PENDING_PINGS = 64
+
+// the ping request sent to peer, wait for the ping response.
+type ping_request struct {
+	timestamp uint32
+	sent time.Time
+}
+
+/**
+* the keepalive of connection, send ping request every interval,
+* the connection is closed when the peer misses max_missed pings.
+ */
+type keepalive struct {
+	lock *sync.Mutex
+	// the interval to send ping, disabled when 0.
+	interval time.Duration
+	// the max unanswered pings, never timeout when 0.
+	max_missed int
+	// notify the keepalive goroutine that the interval changed.
+	update chan struct{}
+	// the pings wait for response, the oldest first.
+	pings []ping_request
+}
+func new_keepalive() (*keepalive) {
+	r := &keepalive{}
+	r.lock = &sync.Mutex{}
+	r.update = make(chan struct{}, 1)
+	return r
+}
+
+func (r *keepalive) set(interval time.Duration, max_missed int) {
+	r.lock.Lock()
+	r.interval, r.max_missed = interval, max_missed
+	r.lock.Unlock()
+
+	select {
+	case r.update <- struct{}{}:
+	default:
+	}
+}
+
+func (r *keepalive) get() (interval time.Duration, max_missed int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.interval, r.max_missed
+}
+
+// the ping request is sent, wait for response.
+func (r *keepalive) on_ping(timestamp uint32, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.pings) >= RTMP_MAX_PENDING_PINGS {
+		r.pings = r.pings[1:]
+	}
+	r.pings = append(r.pings, ping_request{timestamp:timestamp, sent:now})
+}
+
+/**
+* match the ping response to request, the request and all before it are answered.
+* @return the rtt, ok is false when no request matched.
+ */
+func (r *keepalive) on_pong(timestamp uint32, now time.Time) (rtt time.Duration, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, ping := range r.pings {
+		if ping.timestamp == timestamp {
+			r.pings = append(r.pings[:0], r.pings[i + 1:]...)
+			return now.Sub(ping.sent), true
+		}
+	}
+	return
+}
+
+// the pings not answered.
+func (r *keepalive) missed() (int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pings)
+}
+
+func (r *protocol) SetKeepalive(interval time.Duration, max_missed int) {
+	r.keepalive.set(interval, max_missed)
+}
+
+func (r *protocol) Rtt() (time.Duration) {
+	return time.Duration(atomic.LoadInt64(&r.rtt))
+}
+
+/**
+* the keepalive goroutine, send the ping request every interval,
+* and close the stack when peer missed the max pings.
+ */
+func (r *protocol) keepalive_goroutine() {
+	defer r.msg_io_wait.Done()
+
+	for {
+		interval, max_missed := r.keepalive.get()
+
+		var timer *time.Timer
+		var tick <-chan time.Time
+		if interval > 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+
+		select {
+		case <- r.msg_io_done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <- r.keepalive.update:
+			if timer != nil {
+				timer.Stop()
+			}
+		case <- tick:
+			if err := r.do_keepalive(max_missed); err != nil {
+				r.close(err)
+				return
+			}
+		}
+	}
+}
+
+func (r *protocol) do_keepalive(max_missed int) (err error) {
+	if missed := r.keepalive.missed(); max_missed > 0 && missed >= max_missed {
+		return Error{code:ERROR_GO_KEEPALIVE_TIMEOUT, desc:"keepalive timeout, peer missed pings"}
+	}
+
+	// the timestamp of ping is the time in ms since the stack created.
+	pkt := NewUserControlPacket()
+	pkt.EventType = PCUCPingRequest
+	pkt.EventData = uint32(time.Since(r.created) / time.Millisecond)
+	return r.SendPacket(pkt, 0)
+}
+
+/**
+* handle the ping of user control, response the ping request,
+* and calc the rtt by ping response.
+ */
+func (r *protocol) on_recv_ping(pkt *UserControlPacket) (err error) {
+	if pkt.EventType == PCUCPingRequest {
+		res := NewUserControlPacket()
+		res.EventType = PCUCPingResponse
+		res.EventData = pkt.EventData
+		return r.SendPacket(res, 0)
+	}
+
+	if pkt.EventType == PCUCPingResponse {
+		if rtt, ok := r.keepalive.on_pong(pkt.EventData, time.Now()); ok {
+			atomic.StoreInt64(&r.rtt, int64(rtt))
+			r.trace("ping response timestamp=%v, rtt=%v", pkt.EventData, rtt)
+		}
+	}
+	return
+}
@@ -0,0 +1,135 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestKeepalivePongMatch(t *testing.T) {
+	r := new_keepalive()
+	now := time.Unix(10000, 0)
+	r.on_ping(100, now)
+	r.on_ping(200, now.Add(time.Second))
+	r.on_ping(300, now.Add(2 * time.Second))
+
+	if _, ok := r.on_pong(400, now); ok || r.missed() != 3 {
+		t.Error("unknown pong should be ignored")
+	}
+
+	// the pings before the answered are also answered.
+	rtt, ok := r.on_pong(200, now.Add(time.Second + 30 * time.Millisecond))
+	if !ok || rtt != 30 * time.Millisecond || r.missed() != 1 {
+		t.Errorf("rtt=%v, ok=%v, missed=%v", rtt, ok, r.missed())
+	}
+
+	for i := 0; i < RTMP_MAX_PENDING_PINGS + 10; i++ {
+		r.on_ping(uint32(i), now)
+	}
+	if r.missed() != RTMP_MAX_PENDING_PINGS {
+		t.Errorf("missed=%v", r.missed())
+	}
+}
+
+func TestKeepaliveResponsePing(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_ProtocolControl, RTMP_MSG_UserControlMessage, 0, 0, []byte{0x00, 0x06, 0x00, 0x00, 0x04, 0xd2})
+
+	responses := replay_session(t, c.b, 1, func(s Server) {})
+	assert_responses(t, responses, []string{"cid=2 sid=0 UserControl(7,1234)"})
+}
+
+func TestKeepaliveRtt(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+	defer p.Destroy()
+
+	// the client stack responses the ping.
+	c := new_protocol(NewSocket(client))
+	c.start_message_pump_goroutines()
+	defer c.Destroy()
+
+	p.SetKeepalive(10 * time.Millisecond, 3)
+	must_complete(t, 3 * time.Second, "rtt", func() {
+		for p.Rtt() <= 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	if stats := p.Stats(); stats.Rtt <= 0 || stats.SendMessages["user_control"] == 0 {
+		t.Errorf("stats rtt=%v, messages=%v", stats.Rtt, stats.SendMessages)
+	}
+	select {
+	case <- p.Done():
+		t.Fatalf("keepalive should be alive, %v", p.Err())
+	default:
+	}
+}
+
+func TestKeepalivePingSent(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+	defer p.Destroy()
+	go io.Copy(io.Discard, client)
+
+	// the 2500B video waits about 1.5s for the tokens of 1000B/s.
+	p.SetSendRate(8)
+	if err := p.SendMessage(new_av_message(RTMP_MSG_VideoMessage, 0, make([]byte, 2500)), 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// the ping in queue is not sent, never wait for response.
+	pkt := NewUserControlPacket()
+	pkt.EventType = PCUCPingRequest
+	pkt.EventData = 100
+	if err := p.SendPacket(pkt, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if missed := p.keepalive.missed(); missed != 0 {
+		t.Errorf("the ping in queue, missed %v", missed)
+	}
+
+	must_complete(t, 3 * time.Second, "ping sent", func() {
+		for p.keepalive.missed() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+	defer p.Destroy()
+
+	// the dead peer, never response the ping.
+	go io.Copy(io.Discard, client)
+
+	p.SetKeepalive(10 * time.Millisecond, 2)
+	must_complete(t, 3 * time.Second, "keepalive timeout", func() {
+		<- p.Done()
+	})
+	assert_error_code(t, p.Err(), ERROR_GO_KEEPALIVE_TIMEOUT)
+}
@@ -0,0 +1,106 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+)
+
+/**
+* the limits of protocol stack, to protect the server from the malicious peer,
+* which declares huge messages on lots of chunk streams, or deep nested amf0.
+* the zero value of each field means no limit.
+ */
+type Limits struct {
+	/**
+	* the max payload size of a message, in bytes.
+	* the PayloadLength of message header is 3bytes, so it's never exceed 16MB.
+	 */
+	MaxMessageSize int
+	/**
+	* the max chunk streams(cid) of a connection,
+	* the state of each chunk stream is cached util the connection closed.
+	 */
+	MaxChunkStreams int
+	/**
+	* the max bytes of all partial messages of a connection, in bytes.
+	* the payload is allocated when the first chunk of message arrived,
+	* so the peer can declare a huge message on each chunk stream without data.
+	 */
+	MaxPartialBytes int
+	// the max nesting depth of amf0 object and ecma array.
+	MaxAmf0Depth int
+	// the max properties of an amf0 object or ecma array.
+	MaxAmf0Properties int
+}
+
+/**
+* create the default limits, which is large enough for the normal encoders,
+* for example, the keyframe of 1080p is about 500KB, FMLE use about 8 cids.
+ */
+func NewLimits() (*Limits) {
+	r := &Limits{}
+	r.MaxMessageSize = 8 * 1024 * 1024
+	r.MaxChunkStreams = 256
+	r.MaxPartialBytes = 32 * 1024 * 1024
+	r.MaxAmf0Depth = 32
+	r.MaxAmf0Properties = 1024
+	return r
+}
+
+// the limits to decode the packet without protocol stack.
+var default_limits = NewLimits()
+
+func (r *Limits) check_message_size(size int) (err error) {
+	if r.MaxMessageSize > 0 && size > r.MaxMessageSize {
+		return Error{code:ERROR_GO_LIMIT_MESSAGE_SIZE, desc:fmt.Sprintf("message size exceed limit. size=%v, max=%v", size, r.MaxMessageSize)}
+	}
+	return
+}
+
+func (r *Limits) check_chunk_streams(count int) (err error) {
+	if r.MaxChunkStreams > 0 && count > r.MaxChunkStreams {
+		return Error{code:ERROR_GO_LIMIT_CHUNK_STREAMS, desc:fmt.Sprintf("chunk streams exceed limit. count=%v, max=%v", count, r.MaxChunkStreams)}
+	}
+	return
+}
+
+func (r *Limits) check_partial_bytes(size int) (err error) {
+	if r.MaxPartialBytes > 0 && size > r.MaxPartialBytes {
+		return Error{code:ERROR_GO_LIMIT_PARTIAL_BYTES, desc:fmt.Sprintf("partial message bytes exceed limit. size=%v, max=%v", size, r.MaxPartialBytes)}
+	}
+	return
+}
+
+func (r *Limits) check_amf0_depth(depth int) (err error) {
+	if r.MaxAmf0Depth > 0 && depth > r.MaxAmf0Depth {
+		return Error{code:ERROR_GO_LIMIT_AMF0_DEPTH, desc:fmt.Sprintf("amf0 nesting depth exceed limit. depth=%v, max=%v", depth, r.MaxAmf0Depth)}
+	}
+	return
+}
+
+func (r *Limits) check_amf0_properties(count int) (err error) {
+	if r.MaxAmf0Properties > 0 && count > r.MaxAmf0Properties {
+		return Error{code:ERROR_GO_LIMIT_AMF0_PROPERTIES, desc:fmt.Sprintf("amf0 properties exceed limit. count=%v, max=%v", count, r.MaxAmf0Properties)}
+	}
+	return
+}
@@ -0,0 +1,145 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// the fmt=0 chunk header of message, without the payload.
+func fmt0_chunk_header(cid int, message_type byte, size int) (b []byte) {
+	return []byte{
+		byte(cid & 0x3f), 0x00, 0x00, 0x00,
+		byte(size >> 16), byte(size >> 8), byte(size),
+		message_type, 0x01, 0x00, 0x00, 0x00,
+	}
+}
+
+// write the chunks to the protocol, expect the stack failed with code.
+func expect_recv_error(t *testing.T, limits *Limits, chunks []byte, code int) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+	defer p.Destroy()
+	p.SetLimits(limits)
+
+	if _, err := client.Write(chunks); err != nil {
+		t.Fatal(err)
+	}
+
+	must_complete(t, 3 * time.Second, "recv", func() {
+		for {
+			if _, err := p.RecvMessage(); err != nil {
+				assert_error_code(t, err, code)
+				return
+			}
+		}
+	})
+}
+
+func TestLimitsMessageSize(t *testing.T) {
+	limits := NewLimits()
+	limits.MaxMessageSize = 1024
+
+	chunks := fmt0_chunk_header(RTMP_CID_Video, RTMP_MSG_VideoMessage, 1025)
+	expect_recv_error(t, limits, chunks, ERROR_GO_LIMIT_MESSAGE_SIZE)
+}
+
+func TestLimitsChunkStreams(t *testing.T) {
+	limits := NewLimits()
+	limits.MaxChunkStreams = 8
+
+	var chunks []byte
+	for cid := 2; cid < 2 + 9; cid++ {
+		chunks = append(chunks, fmt0_chunk_header(cid, RTMP_MSG_AudioMessage, 1)...)
+		chunks = append(chunks, 0xaf)
+	}
+	expect_recv_error(t, limits, chunks, ERROR_GO_LIMIT_CHUNK_STREAMS)
+}
+
+func TestLimitsPartialBytes(t *testing.T) {
+	limits := NewLimits()
+	limits.MaxPartialBytes = 4 * 1024 * 1024
+
+	// declare 1MB message on each cid, but only send the first chunk.
+	var chunks []byte
+	for cid := 2; cid < 2 + 5; cid++ {
+		chunks = append(chunks, fmt0_chunk_header(cid, RTMP_MSG_VideoMessage, 1024 * 1024)...)
+		chunks = append(chunks, make([]byte, RTMP_DEFAULT_CHUNK_SIZE)...)
+	}
+	expect_recv_error(t, limits, chunks, ERROR_GO_LIMIT_PARTIAL_BYTES)
+}
+
+// the amf0 objects nested in depth, the innermost property is boolean.
+func nested_amf0_objects(depth int) (b []byte) {
+	for i := 0; i < depth; i++ {
+		if i > 0 {
+			b = append(b, 0x00, 0x01, 'o')
+		}
+		b = append(b, AMF0_Object)
+	}
+	b = append(b, 0x00, 0x01, 'v', AMF0_Boolean, 0x01)
+	for i := 0; i < depth; i++ {
+		b = append(b, 0x00, 0x00, AMF0_ObjectEnd)
+	}
+	return
+}
+
+func TestLimitsAmf0Depth(t *testing.T) {
+	limits := NewLimits()
+	limits.MaxAmf0Depth = 4
+
+	for depth, code := range map[int]int{4:ERROR_SUCCESS, 5:ERROR_GO_LIMIT_AMF0_DEPTH} {
+		stream := NewRtmpStream(nested_amf0_objects(depth))
+		stream.limits = limits
+
+		var v Amf0Any
+		if err := v.Read(NewAmf0Codec(stream)); code == ERROR_SUCCESS && err != nil {
+			t.Fatalf("depth=%v, %v", depth, err)
+		} else if code != ERROR_SUCCESS {
+			assert_error_code(t, err, code)
+		}
+	}
+
+	// the default limits protect the decoder without protocol stack.
+	var v Amf0Any
+	err := v.Read(NewAmf0Codec(NewRtmpStream(nested_amf0_objects(100000))))
+	assert_error_code(t, err, ERROR_GO_LIMIT_AMF0_DEPTH)
+}
+
+func TestLimitsAmf0Properties(t *testing.T) {
+	limits := NewLimits()
+	limits.MaxAmf0Properties = 3
+
+	var b bytes.Buffer
+	b.Write([]byte{AMF0_Object})
+	for _, k := range []string{"a", "b", "c", "d"} {
+		b.Write([]byte{0x00, 0x01, k[0], AMF0_Boolean, 0x01})
+	}
+	b.Write([]byte{0x00, 0x00, AMF0_ObjectEnd})
+
+	stream := NewRtmpStream(b.Bytes())
+	stream.limits = limits
+	_, err := NewAmf0Codec(stream).ReadObject()
+	assert_error_code(t, err, ERROR_GO_LIMIT_AMF0_PROPERTIES)
+}
@@ -0,0 +1,231 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+* the log level, the trace level dumps the chunk header and packets,
+* which is used to debug the interop issue of encoders.
+ */
+const (
+	LogLevelTrace = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	// disable all logs.
+	LogLevelDisabled
+)
+
+var log_level_names = []string{"trace", "info", "warn", "error"}
+
+/**
+* the state of connection, in the log context.
+ */
+const (
+	LogStateHandshake = "handshake"
+	LogStateConnect = "connect"
+	LogStateIdentify = "identify"
+	LogStatePublish = "publish"
+	LogStatePlay = "play"
+)
+
+/**
+* the context of connection for each log line,
+* the vhost/app/stream is empty util known.
+* @remark the context is never changed once created, user must copy it to update.
+ */
+type LogContext struct {
+	// the id of connection, unique in process.
+	Id uint64
+	RemoteAddr string
+	Vhost string
+	App string
+	Stream string
+	// the LogState* of connection.
+	State string
+}
+
+func (r *LogContext) String() (string) {
+	s := fmt.Sprintf("[id=%v][%v]", r.Id, r.RemoteAddr)
+	if r.Vhost != "" || r.App != "" || r.Stream != "" {
+		s += fmt.Sprintf("[%v/%v/%v]", r.Vhost, r.App, r.Stream)
+	}
+	if r.State != "" {
+		s += fmt.Sprintf("[%v]", r.State)
+	}
+	return s
+}
+
+/**
+* the logger of protocol and server, user can adapt it to any log library,
+* for example, the log/slog.
+ */
+type Logger interface {
+	/**
+	* whether the level is enabled, the protocol never format the log when disabled,
+	* for the trace logs are expensive.
+	 */
+	Enabled(level int) (bool)
+	/**
+	* write a log line with the context of connection.
+	* @param level the LogLevel*.
+	 */
+	Log(level int, ctx *LogContext, format string, v ...interface {})
+}
+
+/**
+* the text logger, write a line for each log to w, for example:
+* 		[2026-01-02 15:04:05.000][info][id=1][127.0.0.1:50522][__defaultVhost__/live/livestream][publish] start publish
+* @param level the min level to write, LogLevel*.
+ */
+func NewLogger(w io.Writer, level int) (Logger) {
+	r := &text_logger{}
+	r.w = w
+	r.level = level
+	r.lock = &sync.Mutex{}
+	return r
+}
+
+type text_logger struct {
+	w io.Writer
+	level int
+	// to write the line atomic.
+	lock *sync.Mutex
+}
+
+func (r *text_logger) Enabled(level int) (bool) {
+	return level >= r.level && level < LogLevelDisabled
+}
+
+func (r *text_logger) Log(level int, ctx *LogContext, format string, v ...interface {}) {
+	if !r.Enabled(level) {
+		return
+	}
+
+	line := fmt.Sprintf("[%v][%v]%v %v\n", time.Now().Format("2006-01-02 15:04:05.000"), log_level_names[level], ctx, fmt.Sprintf(format, v...))
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	io.WriteString(r.w, line)
+}
+
+// the logger which discard all logs, the default logger.
+type null_logger struct {
+}
+
+func (r null_logger) Enabled(level int) (bool) {
+	return false
+}
+
+func (r null_logger) Log(level int, ctx *LogContext, format string, v ...interface {}) {
+}
+
+// the id of connection.
+var log_context_id uint64
+
+func new_log_context(remote_addr string) (*LogContext) {
+	r := &LogContext{}
+	r.Id = atomic.AddUint64(&log_context_id, 1)
+	r.RemoteAddr = remote_addr
+	return r
+}
+
+/**
+* dump the amf0 values in payload, for the trace log of command and data,
+* for example, "_result",1,null,{level:"status",code:"NetStream.Publish.Start"}
+ */
+func amf0_dump(payload []byte) (string) {
+	codec := NewAmf0Codec(NewRtmpStream(payload))
+
+	var values []string
+	for !codec.stream.Empty() {
+		var v Amf0Any
+		if err := v.Read(codec); err != nil {
+			return fmt.Sprintf("%v <%v>", strings.Join(values, ","), err)
+		}
+		values = append(values, amf0_dump_any(&v))
+	}
+	return strings.Join(values, ",")
+}
+
+func amf0_dump_any(v *Amf0Any) (string) {
+	switch v.Marker {
+	case AMF0_String:
+		return fmt.Sprintf("%q", v.Value)
+	case AMF0_Null:
+		return "null"
+	case AMF0_Undefined:
+		return "undefined"
+	case AMF0_Object:
+		o, _ := v.Object()
+		return fmt.Sprintf("{%v}", amf0_dump_properties(o.properties))
+	case AMF0_EcmaArray:
+		o, _ := v.EcmaArray()
+		return fmt.Sprintf("[%v]", amf0_dump_properties(o.properties))
+	}
+	return fmt.Sprintf("%v", v.Value)
+}
+
+func amf0_dump_properties(p *Amf0UnSortedHashtable) (string) {
+	var props []string
+	for _, k := range p.property_index {
+		props = append(props, fmt.Sprintf("%v:%v", k, amf0_dump_any(p.properties[k])))
+	}
+	return strings.Join(props, ",")
+}
+
+/**
+* dump the message for the trace log, the amf0 values for command and data,
+* the decoded fields for control messages, or the size for others.
+ */
+func message_dump(msg *Message) (string) {
+	h := msg.Header
+	s := fmt.Sprintf("type=%v, ts=%v, sid=%v, size=%v", h.MessageType, h.Timestamp, h.StreamId, len(msg.Payload))
+
+	payload := msg.Payload
+	if h.IsAmf3Command() && len(payload) > 0 {
+		payload = payload[1:]
+	}
+
+	stream := NewRtmpStream(payload)
+	switch {
+	case h.IsAmf0Command() || h.IsAmf3Command() || h.IsAmf0Data():
+		s += ", " + amf0_dump(payload)
+	case h.IsSetChunkSize() && stream.Requires(4):
+		s += fmt.Sprintf(", SetChunkSize(%v)", stream.ReadUInt32())
+	case h.IsWindowAcknowledgementSize() && stream.Requires(4):
+		s += fmt.Sprintf(", WindowAckSize(%v)", stream.ReadUInt32())
+	case h.MessageType == RTMP_MSG_SetPeerBandwidth && stream.Requires(5):
+		s += fmt.Sprintf(", SetPeerBandwidth(%v,%v)", stream.ReadUInt32(), stream.ReadByte())
+	case h.IsUserControlMessage() && stream.Requires(6):
+		s += fmt.Sprintf(", UserControl(%v,%v)", stream.ReadUInt16(), stream.ReadUInt32())
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the writer for logger, safe for the goroutines.
+type log_buffer struct {
+	lock sync.Mutex
+	b bytes.Buffer
+}
+
+func (r *log_buffer) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.b.Write(p)
+}
+
+func (r *log_buffer) String() (string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.b.String()
+}
+
+func TestLoggerContextAndTrace(t *testing.T) {
+	server_conn, client_conn := net.Pipe()
+	defer client_conn.Close()
+
+	s, err := NewServer(server_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w log_buffer
+	s.SetLogger(NewLogger(&w, LogLevelTrace))
+
+	tc_url := "rtmp://127.0.0.1/live"
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", tc_url)))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "livestream"))
+
+	// the client got all responses of play, _result, StreamBegin and 4 onStatus.
+	played := make(chan bool)
+	go func() {
+		defer close(played)
+		if err := replay_handshake(client_conn, c.b); err != nil {
+			return
+		}
+
+		parser := new_protocol(NewSocket(client_conn))
+		for nb_msgs := 0; nb_msgs < 6; {
+			msg, err := parser.do_recv_msg_goroutine_job()
+			if err != nil {
+				return
+			}
+			if msg != nil {
+				nb_msgs++
+			}
+		}
+	}()
+
+	must_complete(t, 3 * time.Second, "serve", func() {
+		if err := s.Handshake(); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, _, err := s.IdentifyClient(1); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+		}
+	})
+	must_complete(t, 3 * time.Second, "play", func() {
+		<- played
+	})
+	s.Destroy()
+
+	id := strconv.FormatUint(s.Protocol().LogContext().Id, 10)
+	logs := w.String()
+	for _, expect := range []string{
+		"[info][id=" + id + "][pipe][handshake] simple handshake ok",
+		"recv chunk fmt=0, cid=3, ts=0, delta=0, ext=false, size=",
+		`recv message cid=3, type=20, ts=0, sid=0, size=`,
+		`"connect",1,{app:"live",tcUrl:"rtmp://127.0.0.1/live"}`,
+		"decode message to *rtmp.ConnectAppPacket",
+		"[info][id=" + id + "][pipe][127.0.0.1/live/][connect] connect app, tcUrl=rtmp://127.0.0.1/live",
+		"[info][id=" + id + "][pipe][127.0.0.1/live/livestream][identify] identify client, type=play, stream=livestream",
+		"[127.0.0.1/live/livestream][play] start play, stream_id=1",
+		`send message cid=5, type=20, ts=0, sid=1, size=`,
+		"[127.0.0.1/live/livestream][play] connection closed, rtmp error code=105",
+	} {
+		if !strings.Contains(logs, expect) {
+			t.Errorf("log not found: %v\nlogs:\n%v", expect, logs)
+		}
+	}
+
+	// the info logger never dump the chunks.
+	var info log_buffer
+	logger := NewLogger(&info, LogLevelInfo)
+	if logger.Enabled(LogLevelTrace) || !logger.Enabled(LogLevelError) {
+		t.Error("invalid logger level")
+	}
+}
@@ -22,6 +22,7 @@
 package rtmp
 
 import (
+	"context"
 	"net"
 	"math/rand"
 	"time"
@@ -63,6 +64,14 @@ type Message struct {
 	* the payload sent length.
 	 */
 	SentPayloadLength int
+	/**
+	* the pooled buffer of payload, nil if not pooled.
+	* the copies of message share the buffer, @see Release()
+	 */
+	payload_ref *payload_buffer
+	// closed by the send goroutine when the message is written, nil to ignore.
+	// @see SendPacketSync
+	sent chan struct{}
 }
 func NewMessage() (*Message) {
 	r := &Message{}
@@ -71,6 +80,7 @@ func NewMessage() (*Message) {
 }
 
 // copy the message, deep copy header and field, share copy the payload
+// @remark for the pooled payload, each copy holds a reference, user should Release() it.
 func (r *Message) Copy() (*Message) {
 	copy := &Message{}
 	copy_header := *r.Header
@@ -79,9 +89,32 @@ func (r *Message) Copy() (*Message) {
 	copy.ReceivedPayloadLength = r.ReceivedPayloadLength
 	copy.PerferCid = r.PerferCid
 	copy.SentPayloadLength = r.SentPayloadLength
+	if r.payload_ref != nil {
+		r.payload_ref.ref()
+		copy.payload_ref = r.payload_ref
+	}
 	return copy
 }
 
+/**
+* release the reference of the pooled payload, the payload is returned to pool
+* when all copies released, the Payload of message is nil after released.
+* it's ok to never release, the payload is collected by gc.
+* @remark the SendMessage take the ownership of the message, and release it when sent,
+* 		so user must send a copy if the message is still used, for example, the GOP cache.
+* @remark ignored when the payload is not pooled.
+ */
+func (r *Message) Release() {
+	if r.payload_ref == nil {
+		return
+	}
+
+	ref := r.payload_ref
+	r.payload_ref = nil
+	r.Payload = nil
+	ref.unref()
+}
+
 /**
 * incoming chunk stream maybe interlaced,
 * use the chunk stream to cache the input RTMP chunk streams.
@@ -162,27 +195,65 @@ type MessageHeader struct {
 
 type Protocol interface {
 	/**
-	* destroy the protocol stack, close channels, stop goroutines.
+	* destroy the protocol stack, close the connection,
+	* and wait for the message pump goroutines to quit.
 	 */
 	Destroy()
 	/**
+	* the done channel is closed when the protocol stack is dead,
+	* for instance, destroyed, peer closed or io failed.
+	 */
+	Done() (<-chan struct{})
+	/**
+	* get the error which closed the protocol stack, nil when alive.
+	* ERROR_GO_PROTOCOL_DESTROYED when closed by Destroy().
+	 */
+	Err() (err error)
+	/**
 	* get the message input channel,
 	* the input goroutine decode and put message into the input channel,
 	* where user can select the channel to recv message.
+	* @remark the channel is never closed, user must select the Done() also.
 	 */
 	MessageInputChannel() (chan *Message)
 	/**
+	* set the idle timeout of the underlayer socket read/write,
+	* the io failed with ERROR_SOCKET_TIMEOUT when timeout, never timeout when 0.
+	* for example, SetRecvTimeout(30 * time.Second) to drop the silent peer.
+	 */
+	SetRecvTimeout(timeout time.Duration)
+	SetSendTimeout(timeout time.Duration)
+	/**
 	* do simple handshake with client, user can try simple/complex interlace,
 	* that is, try complex handshake first, use simple if complex handshake failed.
 	* when handshake success, start the message input/outout goroutines
 	 */
 	SimpleHandshake2Client() (err error)
 	/**
+	* handshake with ctx, which failed with ERROR_SOCKET_TIMEOUT when ctx deadline exceeded,
+	* or ERROR_GO_CONTEXT_CANCELED when ctx canceled, and the stack is closed by the error.
+	 */
+	SimpleHandshake2ClientContext(ctx context.Context) (err error)
+	/**
+	* do simple handshake with server, for the client side of connection.
+	* when handshake success, start the message input/outout goroutines
+	 */
+	SimpleHandshake2Server() (err error)
+	SimpleHandshake2ServerContext(ctx context.Context) (err error)
+	/**
 	* recv message from connection.
 	* the payload of message is []byte, user can decode it by DecodeMessage.
 	 */
 	RecvMessage() (msg *Message, err error)
 	/**
+	* recv message with ctx, which failed with ERROR_SOCKET_TIMEOUT when ctx deadline exceeded,
+	* or ERROR_GO_CONTEXT_CANCELED when ctx canceled.
+	* @remark the cancel only abort this recv, the stack is alive and user can recv again,
+	* 		for example, recv util a duration then send the response, so the stack is
+	* 		never closed by ctx, user should Destroy() it or use ExpectPacketContext.
+	 */
+	RecvMessageContext(ctx context.Context) (msg *Message, err error)
+	/**
 	* decode the received message to pkt.
 	 */
 	DecodeMessage(msg *Message) (pkt interface {}, err error)
@@ -197,6 +268,12 @@ type Protocol interface {
 	 */
 	ExpectPacket(v interface {}) (msg *Message, err error)
 	/**
+	* expect specified packet with ctx, @see ExpectPacket and RecvMessageContext
+	* @remark the stack is closed by the error of ctx when canceled or deadline exceeded,
+	* 		so the message pump goroutines quit and the connection is closed.
+	 */
+	ExpectPacketContext(ctx context.Context, v interface {}) (msg *Message, err error)
+	/**
 	* encode the packet to message, then send out by SendMessage.
 	* return the cid which packet prefer.
 	 */
@@ -208,6 +285,117 @@ type Protocol interface {
 	 */
 	SendPacket(pkt Encoder, stream_id uint32) (err error)
 	SendMessage(pkt *Message, stream_id uint32) (err error)
+	/**
+	* send the packet like SendPacket, and wait until the message is written to the connection,
+	* for example, the rejection before close the connection, for the Destroy() drop the queued messages.
+	* @remark only for the commands, the audio/video maybe dropped by the send queue.
+	 */
+	SendPacketSync(pkt Encoder, stream_id uint32) (err error)
+	/**
+	* whether alloc the payload of received message from the size-classed pool,
+	* user should Release() the message when not used, default to false.
+	* @remark the SendMessage release the message when sent,
+	* 		so user must send the Copy() of message to each connection.
+	 */
+	SetPayloadPool(enabled bool)
+	/**
+	* set the limits of protocol stack, the limits is copied,
+	* default to NewLimits(), the connection is closed when exceed the limits.
+	* @remark user should set the limits before handshake.
+	 */
+	SetLimits(limits *Limits)
+	/**
+	* set the send queue, the messages are sent by priority,
+	* that is, protocol control > commands > audio > video.
+	* @param capacity the max audio/video messages in queue, default to RTMP_MSG_CHANNEL_BUFFER.
+	* @param policy when queue overflow, the SendQueueOverflow*, default to SendQueueOverflowBlock.
+	* 		for example, SetSendQueue(300, SendQueueOverflowDropToKeyframe) for player.
+	 */
+	SetSendQueue(capacity int, policy int)
+	/**
+	* let the SetBufferLength of player drive the send queue, the capacity is
+	* the buffer length in seconds * fps, at least RTMP_MSG_CHANNEL_BUFFER,
+	* applied when player sets the buffer length, and now if it's already set.
+	* @param fps the audio/video messages per second of stream, 0 to disable.
+	* @param policy when queue overflow, the SendQueueOverflow*.
+	* 		for example, SetSendQueueByBufferLength(73, SendQueueOverflowDropToKeyframe)
+	* 		for 30fps video and 44.1kHz aac.
+	 */
+	SetSendQueueByBufferLength(fps int, policy int)
+	/**
+	* get the counters of send queue, for instance, the dropped frames.
+	 */
+	SendQueueStats() (stats SendQueueStats)
+	/**
+	* get the stats of connection, the bytes, kbps, messages, frames and queue.
+	* user can register the connection to Metrics for the prometheus metrics.
+	 */
+	Stats() (stats Stats)
+	/**
+	* limit the output rate of connection by the token bucket,
+	* the burst is one second of rate, default to 0 for no limit.
+	* @param kbps the max output kbps, for example, the vhost send_rate.
+	* @remark the queued messages are batched and aggregated up to the tokens available,
+	* 		so each message is sent alone when the tokens are used up.
+	 */
+	SetSendRate(kbps int)
+	/**
+	* whether to limit the output rate by the Set Peer Bandwidth of peer, default to false,
+	* the bandwidth is used as the bytes per second, and the lower of it and SetSendRate is used.
+	* @remark it's an approximation, the Set Peer Bandwidth is the window of unacknowledged
+	* 		bytes, not a rate, the rate is near to it when the peer ack the window in a second.
+	* @remark the Set Peer Bandwidth is always responsed by Window Acknowledgement Size
+	* 		when the window changed, whether enforced or not.
+	 */
+	EnforcePeerBandwidth(enabled bool)
+	/**
+	* get the Set Peer Bandwidth of peer in effect, after applied the limit type,
+	* ok is false when peer never set it.
+	 */
+	PeerBandwidth() (bandwidth uint32, bw_type byte, ok bool)
+	/**
+	* mux the queued audio/video/data messages of the same stream to aggregate message,
+	* to reduce the chunk headers, default to 0 to never aggregate.
+	* @param max_size the max payload size of aggregate message, for example, 64 * 1024.
+	* @remark the received aggregate message is always demuxed, user never got it.
+	* @remark only the batched messages are muxed, @see SetSendRate for the limit of batch.
+	 */
+	SetAggregate(max_size int)
+	/**
+	* send ping request every interval, and close the connection with
+	* ERROR_GO_KEEPALIVE_TIMEOUT when peer missed max_missed pings.
+	* @param interval the interval of ping, disable keepalive when 0.
+	* @param max_missed the max unanswered pings, never timeout when 0.
+	* 		for example, SetKeepalive(10 * time.Second, 3) to drop the dead peer in 30s.
+	* @remark the ping request of peer is always responsed.
+	 */
+	SetKeepalive(interval time.Duration, max_missed int)
+	/**
+	* the round trip time measured by the last ping response, 0 when unknown.
+	 */
+	Rtt() (time.Duration)
+	/**
+	* get the buffer length of player, set by the SetBufferLength user control event,
+	* ok is false when player never set it.
+	* the send queue follows it when SetSendQueueByBufferLength, and user can use
+	* it to decide whether send the gop cache, for example, send the cached gop
+	* when length is longer than the gop.
+	 */
+	BufferLength(stream_id uint32) (length time.Duration, ok bool)
+	/**
+	* set the logger, default to discard all logs, nil to discard.
+	* @remark user should set the logger before handshake.
+	 */
+	SetLogger(logger Logger)
+	/**
+	* get the log context of connection, user should never modify it.
+	 */
+	LogContext() (*LogContext)
+	/**
+	* update the log context, for example, set the stream when known.
+	* the update is applied on a copy of context, then replace the current one.
+	 */
+	UpdateLogContext(update func(ctx *LogContext))
 }
 /**
 * max rtmp header size:
@@ -226,30 +414,52 @@ const RTMP_MAX_FMT0_HEADER_SIZE = 16
 const RTMP_MAX_FMT3_HEADER_SIZE = 5
 // the buffer size of msg channel
 const RTMP_MSG_CHANNEL_BUFFER = 100
+// the max messages to sendout by one writev.
+const RTMP_MAX_SEND_BATCH = 64
 /**
-* create the rtmp protocol.
+* create the rtmp protocol over the conn, for example, the *net.TCPConn,
+* or the net.Pipe() to serve the client in memory.
  */
-func NewProtocol(conn *net.TCPConn) (Protocol, error) {
+func NewProtocol(conn net.Conn) (Protocol, error) {
+	rand.Seed(time.Now().UnixNano())
+
+	return new_protocol(NewSocket(conn)), nil
+}
+func new_protocol(conn *Socket) (*protocol) {
 	r := &protocol{}
 
-	r.conn = NewSocket(conn)
+	r.conn = conn
+	r.requests = map[float64]string{}
 	r.chunkStreams = map[int]*ChunkStream{}
+	r.limits.Store(NewLimits())
 	r.buffer = NewRtmpBuffer(r.conn)
 	r.handshake = &Handshake{}
 
 	r.inChunkSize = RTMP_DEFAULT_CHUNK_SIZE
 	r.outChunkSize = r.inChunkSize
+	r.out_bandwidth = new_send_bandwidth()
 	r.outHeaderFmt0 = NewRtmpStream(make([]byte, RTMP_MAX_FMT0_HEADER_SIZE))
 	r.outHeaderFmt3 = NewRtmpStream(make([]byte, RTMP_MAX_FMT3_HEADER_SIZE))
 
-	r.msg_in_lock = &sync.Mutex{}
-	r.msg_out_lock = &sync.Mutex{}
 	r.msg_in_queue = make(chan *Message, RTMP_MSG_CHANNEL_BUFFER)
-	r.msg_out_queue = make(chan *Message, RTMP_MSG_CHANNEL_BUFFER)
+	r.msg_out_queue = new_send_queue(RTMP_MSG_CHANNEL_BUFFER, SendQueueOverflowBlock)
+	r.msg_io_done = make(chan struct{})
+	r.msg_io_once = &sync.Once{}
+	r.msg_io_wait = &sync.WaitGroup{}
+	r.requests_lock = &sync.Mutex{}
+
+	r.log_ctx_lock = &sync.Mutex{}
+	r.log_ctx.Store(new_log_context(conn.RemoteAddr()))
+	r.SetLogger(nil)
+
+	r.created = time.Now()
+	r.recv_stats = new_message_stats()
+	r.send_stats = new_message_stats()
+	r.keepalive = new_keepalive()
+	r.buffer_lengths = map[uint32]uint32{}
+	r.buffer_lengths_lock = &sync.Mutex{}
 
-	rand.Seed(time.Now().UnixNano())
-
-	return r, nil
+	return r
 }
 
 /**
@@ -293,14 +503,21 @@ type Encoder interface {
 	Encode(s *Buffer) (err error)
 }
 func DecodePacket(r *protocol, header *MessageHeader, payload []byte) (packet interface {}, err error) {
+	defer recover_decode(&err, ERROR_RTMP_MESSAGE_DECODE)
+
 	var pkt Decoder= nil
 	var stream *Buffer = NewRtmpStream(payload)
+	if r != nil {
+		stream.limits = r.get_limits()
+	}
 
 	// decode specified packet type
 	if header.IsAmf0Command() || header.IsAmf3Command() || header.IsAmf0Data() || header.IsAmf3Data() {
 		// skip 1bytes to decode the amf3 command.
 		if header.IsAmf3Command() &&  stream.Requires(1) {
+			limits := stream.limits
 			stream = NewRtmpStream(payload[1:])
+			stream.limits = limits
 		}
 
 		amf0_codec := NewAmf0Codec(stream)
@@ -323,12 +540,30 @@ func DecodePacket(r *protocol, header *MessageHeader, payload []byte) (packet in
 			stream.Reset()
 
 			var request_name string
-			if request_name = r.HistoryRequestName(transaction_id); request_name == "" {
+			if r != nil {
+				request_name = r.HistoryRequestName(transaction_id)
+			}
+			if request_name == "" {
 				err = Error{code:ERROR_RTMP_NO_REQUEST, desc:"decode AMF0/AMF3 transaction request failed"}
 				return
 			}
 
-			// TODO: FIXME: implements it
+			// the response of connect, always the ConnectAppResPacket,
+			// the _error of other requests is the OnStatusCallPacket like format.
+			switch {
+			case request_name == AMF0_COMMAND_CONNECT:
+				pkt = NewConnectAppResPacket()
+			case command == AMF0_COMMAND_ERROR:
+				pkt = NewOnStatusCallPacket()
+			case request_name == AMF0_COMMAND_CREATE_STREAM:
+				pkt = NewCreateStreamResPacket(0, 0)
+			case request_name == AMF0_COMMAND_RELEASE_STREAM || request_name == AMF0_COMMAND_FC_PUBLISH || request_name == AMF0_COMMAND_UNPUBLISH:
+				pkt = NewFMLEStartResPacket(0)
+			}
+			if pkt != nil {
+				packet, err = pkt, pkt.Decode(stream)
+			}
+			return
 		}
 
 		// reset to zero to restart decode.
@@ -346,12 +581,24 @@ func DecodePacket(r *protocol, header *MessageHeader, payload []byte) (packet in
 			pkt = NewPublishPacket()
 		case AMF0_COMMAND_CLOSE_STREAM:
 			pkt = NewCloseStreamPacket()
+		case AMF0_COMMAND_DELETE_STREAM:
+			pkt = NewDeleteStreamPacket()
+		case AMF0_COMMAND_PAUSE:
+			pkt = NewPausePacket()
+		case AMF0_COMMAND_SEEK:
+			pkt = NewSeekPacket()
 		case AMF0_COMMAND_RELEASE_STREAM:
 			pkt = NewFMLEStartPacket()
 		case AMF0_COMMAND_FC_PUBLISH:
 			pkt = NewFMLEStartPacket()
 		case AMF0_COMMAND_UNPUBLISH:
 			pkt = NewFMLEStartPacket()
+		case AMF0_COMMAND_ON_STATUS, AMF0_COMMAND_ON_FC_PUBLISH, AMF0_COMMAND_ON_FC_UNPUBLISH:
+			pkt = NewOnStatusCallPacket()
+		case SRS_BW_CHECK_START_PLAY, SRS_BW_CHECK_STARTING_PLAY, SRS_BW_CHECK_STOP_PLAY, SRS_BW_CHECK_STOPPED_PLAY,
+			SRS_BW_CHECK_START_PUBLISH, SRS_BW_CHECK_STARTING_PUBLISH, SRS_BW_CHECK_STOP_PUBLISH, SRS_BW_CHECK_STOPPED_PUBLISH,
+			SRS_BW_CHECK_PLAYING, SRS_BW_CHECK_PUBLISHING, SRS_BW_CHECK_FINISHED, SRS_BW_CHECK_FLASH_FINAL:
+			pkt = NewBandwidthPacket("")
 		}
 		// TODO: FIXME: implements it
 	} else if header.IsWindowAcknowledgementSize() {
@@ -360,6 +607,8 @@ func DecodePacket(r *protocol, header *MessageHeader, payload []byte) (packet in
 		pkt = NewUserControlPacket()
 	} else if header.IsSetChunkSize() {
 		pkt = NewSetChunkSizePacket()
+	} else if header.IsSetPeerBandwidth() {
+		pkt = NewSetPeerBandwidthPacket()
 	}
 	// TODO: FIXME: implements it
 
@@ -383,6 +632,7 @@ type ConnectAppPacket struct {
 }
 func NewConnectAppPacket() (*ConnectAppPacket) {
 	r := &ConnectAppPacket{}
+	r.CommandName = AMF0_COMMAND_CONNECT
 	r.TransactionId = float64(1.0)
 	r.CommandObject = NewAmf0Object()
 	return r
@@ -483,6 +733,38 @@ func (r *ConnectAppResPacket) InfoSet(k string, v interface {}) (*ConnectAppResP
 	}
 	return r
 }
+// Decoder
+func (r *ConnectAppResPacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.CommandName != AMF0_COMMAND_RESULT && r.CommandName != AMF0_COMMAND_ERROR {
+		return Error{code:ERROR_RTMP_AMF0_DECODE, desc:fmt.Sprintf("amf0 decode name failed. expect=(%v,%v), actual=%v", AMF0_COMMAND_RESULT, AMF0_COMMAND_ERROR, r.CommandName)}
+	}
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+
+	// the props is null for _error.
+	var props Amf0Any
+	if err = props.Read(codec); err != nil {
+		return
+	}
+	if v, ok := props.Object(); ok {
+		r.Props = v
+	}
+
+	var info Amf0Any
+	if err = info.Read(codec); err != nil {
+		return
+	}
+	if v, ok := info.Object(); ok {
+		r.Info = v
+	}
+	return
+}
 // Encoder
 func (r *ConnectAppResPacket) GetPerferCid() (v int) {
 	return RTMP_CID_OverConnection
@@ -519,6 +801,59 @@ func (r *ConnectAppResPacket) Encode(s *Buffer) (err error) {
 	return
 }
 
+/**
+* response for SrsConnectAppPacket, when server rejected the client,
+* for example, _error(1, null, {level:"error", code:"NetConnection.Connect.Rejected"})
+*/
+type ConnectAppErrorPacket struct {
+	CommandName string
+	TransactionId float64
+	Args *Amf0Any // Null
+	Info *Amf0Object
+}
+func NewConnectAppErrorPacket() (*ConnectAppErrorPacket) {
+	r := &ConnectAppErrorPacket{}
+	r.CommandName = AMF0_COMMAND_ERROR
+	r.TransactionId = float64(1.0)
+	r.Args = NewAmf0Null()
+	r.Info = NewAmf0Object()
+	return r
+}
+func (r *ConnectAppErrorPacket) InfoSet(k string, v interface {}) (*ConnectAppErrorPacket) {
+	// if empty or empty object, any value must has content.
+	if a := NewAmf0(v); a != nil && a.Size() > 0 {
+		r.Info.Set(k, a)
+	}
+	return r
+}
+// Encoder
+func (r *ConnectAppErrorPacket) GetPerferCid() (v int) {
+	return RTMP_CID_OverConnection
+}
+func (r *ConnectAppErrorPacket) GetMessageType() (v byte) {
+	return RTMP_MSG_AMF0CommandMessage
+}
+func (r *ConnectAppErrorPacket) GetSize() (v int) {
+	return Amf0SizeString(r.CommandName) + Amf0SizeNumber() + Amf0SizeNullOrUndefined() + r.Info.Size()
+}
+func (r *ConnectAppErrorPacket) Encode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if err = codec.WriteString(r.CommandName); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TransactionId); err != nil {
+		return
+	}
+	if err = r.Args.Write(codec); err != nil {
+		return
+	}
+	if err = r.Info.Write(codec); err != nil {
+		return
+	}
+	return
+}
+
 /**
 * 5.5. Window Acknowledgement Size (5)
 * The client or the server sends this message to inform the peer which
@@ -580,11 +915,22 @@ func (r *SetChunkSizePacket) Decode(s *Buffer) (err error) {
 	}
 	r.ChunkSize = s.ReadUInt32()
 
-	if r.ChunkSize < RTMP_MIN_CHUNK_SIZE {
-		err = Error{code:ERROR_RTMP_CHUNK_SIZE, desc:"atleast min chunk size."}
+	return ValidateChunkSize(r.ChunkSize)
+}
+/**
+* 5.4.1. Set Chunk Size (1)
+* The first bit of the chunk size MUST be zero, and the rest 31 bits
+* represent the chunk size, which is in [RTMP_MIN_CHUNK_SIZE, RTMP_MAX_CHUNK_SIZE].
+*/
+func ValidateChunkSize(chunk_size uint32) (err error) {
+	if chunk_size & 0x80000000 != 0 {
+		return Error{code:ERROR_RTMP_CHUNK_SIZE, desc:fmt.Sprintf("the first bit of chunk size must be zero. size=%#x", chunk_size)}
 	}
-	if r.ChunkSize > RTMP_MAX_CHUNK_SIZE {
-		err = Error{code:ERROR_RTMP_CHUNK_SIZE, desc:"exceed max chunk size."}
+	if chunk_size < RTMP_MIN_CHUNK_SIZE {
+		return Error{code:ERROR_RTMP_CHUNK_SIZE, desc:fmt.Sprintf("atleast min chunk size. size=%v, min=%v", chunk_size, RTMP_MIN_CHUNK_SIZE)}
+	}
+	if chunk_size > RTMP_MAX_CHUNK_SIZE {
+		return Error{code:ERROR_RTMP_CHUNK_SIZE, desc:fmt.Sprintf("exceed max chunk size. size=%v, max=%v", chunk_size, RTMP_MAX_CHUNK_SIZE)}
 	}
 	return
 }
@@ -614,8 +960,25 @@ func (r *SetChunkSizePacket) Encode(s *Buffer) (err error) {
 // @see: SrsSetPeerBandwidthPacket
 type SetPeerBandwidthPacket struct {
 	Bandwidth uint32
+	// PeerBandwidthHard, PeerBandwidthSoft or PeerBandwidthDynamic
 	BandwidthType byte
 }
+func NewSetPeerBandwidthPacket() (*SetPeerBandwidthPacket) {
+	r := &SetPeerBandwidthPacket{}
+	r.BandwidthType = PeerBandwidthDynamic
+	return r
+}
+// Decoder
+func (r *SetPeerBandwidthPacket) Decode(s *Buffer) (err error) {
+	if !s.Requires(5) {
+		err = Error{code:ERROR_RTMP_MESSAGE_DECODE, desc:"decode set bandwidth packet failed."}
+		return
+	}
+	r.Bandwidth = s.ReadUInt32()
+	// the unknown limit type is ignored by the protocol stack, never fail the connection.
+	r.BandwidthType = s.ReadByte()
+	return
+}
 // Encoder
 func (r *SetPeerBandwidthPacket) GetPerferCid() (v int) {
 	return RTMP_CID_ProtocolControl
@@ -675,6 +1038,84 @@ func (r *OnBWDonePacket) Encode(s *Buffer) (err error) {
 	return
 }
 
+/**
+* the bandwidth check packet, the server and client call the methods of each other,
+* @see SRS_BW_CHECK_START_PLAY, the CommandName must be set.
+* the Data is the params of check, for example, the duration_ms and limit_kbps,
+* the filler of SRS_BW_CHECK_PLAYING, or the report of SRS_BW_CHECK_FINISHED.
+*/
+// @see: SrsBandwidthPacket
+type BandwidthPacket struct {
+	CommandName string
+	TransactionId float64
+	Args *Amf0Any // Null
+	Data *Amf0Object
+}
+func NewBandwidthPacket(command_name string) (*BandwidthPacket) {
+	r := &BandwidthPacket{}
+	r.CommandName = command_name
+	r.Args = NewAmf0Null()
+	r.Data = NewAmf0Object()
+	return r
+}
+func (r *BandwidthPacket) Set(k string, v interface {}) (*BandwidthPacket) {
+	if a := NewAmf0(v); a != nil {
+		r.Data.Set(k, a)
+	}
+	return r
+}
+// Decoder
+func (r *BandwidthPacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+	if err = r.Args.Read(codec); err != nil {
+		return
+	}
+	// the data is optional, for example, the finalClientPacket of flash.
+	if !s.Empty() {
+		if r.Data, err = codec.ReadObject(); err != nil {
+			return
+		}
+	}
+	return
+}
+// Encoder
+func (r *BandwidthPacket) GetPerferCid() (v int) {
+	return RTMP_CID_OverStream
+}
+func (r *BandwidthPacket) GetMessageType() (v byte) {
+	return RTMP_MSG_AMF0CommandMessage
+}
+func (r *BandwidthPacket) GetSize() (v int) {
+	return Amf0SizeString(r.CommandName) + Amf0SizeNumber() + Amf0SizeNullOrUndefined() + r.Data.Size()
+}
+func (r *BandwidthPacket) Encode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if err = codec.WriteString(r.CommandName); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TransactionId); err != nil {
+		return
+	}
+	if err = r.Args.Write(codec); err != nil {
+		return
+	}
+	// the empty data is ignored, for example, the response of client.
+	if r.Data.Size() > 0 {
+		if err = r.Data.Write(codec); err != nil {
+			return
+		}
+	}
+	return
+}
+
 /**
 * 4.1.3. createStream
 * The client sends this command to the server to create a logical
@@ -1115,6 +1556,24 @@ func (r *OnStatusCallPacket) Set(k string, v interface {}) (*OnStatusCallPacket)
 	}
 	return r
 }
+// Decoder
+func (r *OnStatusCallPacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+	if err = r.Args.Read(codec); err != nil {
+		return
+	}
+	if r.Data, err = codec.ReadObject(); err != nil {
+		return
+	}
+	return
+}
 // Encoder
 func (r *OnStatusCallPacket) GetPerferCid() (v int) {
 	return RTMP_CID_OverStream
@@ -1263,6 +1722,220 @@ func (r *CloseStreamPacket) Decode(s *Buffer) (err error) {
 	return
 }
 
+/**
+* client delete stream packet, the NetStream is deleted,
+* for example, OBS sends it after FCUnpublish.
+*/
+type DeleteStreamPacket struct {
+	CommandName string
+	TransactionId float64
+	CommandObject *Amf0Any // Null
+	StreamId float64
+}
+func NewDeleteStreamPacket() (*DeleteStreamPacket) {
+	r := &DeleteStreamPacket{}
+	r.CommandName = AMF0_COMMAND_DELETE_STREAM
+	r.CommandObject = NewAmf0Null()
+	return r
+}
+// Decoder
+func (r *DeleteStreamPacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.CommandName != AMF0_COMMAND_DELETE_STREAM {
+		return Error{code:ERROR_RTMP_AMF0_DECODE, desc:fmt.Sprintf("amf0 decode name failed. expect=%v, actual=%v", AMF0_COMMAND_DELETE_STREAM, r.CommandName)}
+	}
+
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+	if err = r.CommandObject.Read(codec); err != nil {
+		return
+	}
+	if r.StreamId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+
+	return
+}
+// Encoder
+func (r *DeleteStreamPacket) GetPerferCid() (v int) {
+	return RTMP_CID_OverConnection
+}
+func (r *DeleteStreamPacket) GetMessageType() (v byte) {
+	return RTMP_MSG_AMF0CommandMessage
+}
+func (r *DeleteStreamPacket) GetSize() (v int) {
+	return Amf0SizeString(r.CommandName) + Amf0SizeNumber() + Amf0SizeNullOrUndefined() + Amf0SizeNumber()
+}
+func (r *DeleteStreamPacket) Encode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if err = codec.WriteString(r.CommandName); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TransactionId); err != nil {
+		return
+	}
+	if err = r.CommandObject.Write(codec); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.StreamId); err != nil {
+		return
+	}
+	return
+}
+
+/**
+* 4.2.8. pause
+* The client sends the pause command to tell the server to pause or start playing.
+*/
+// @see: SrsPausePacket
+type PausePacket struct {
+	CommandName string
+	TransactionId float64
+	CommandObject *Amf0Any // Null
+	// true to pause, false to unpause.
+	IsPause bool
+	// the stream time in ms at which the stream is paused or unpaused.
+	TimeMs float64
+}
+func NewPausePacket() (*PausePacket) {
+	r := &PausePacket{}
+	r.CommandName = AMF0_COMMAND_PAUSE
+	r.CommandObject = NewAmf0Null()
+	return r
+}
+// Decoder
+func (r *PausePacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.CommandName != AMF0_COMMAND_PAUSE {
+		return Error{code:ERROR_RTMP_AMF0_DECODE, desc:fmt.Sprintf("amf0 decode name failed. expect=%v, actual=%v", AMF0_COMMAND_PAUSE, r.CommandName)}
+	}
+
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+	if err = r.CommandObject.Read(codec); err != nil {
+		return
+	}
+	if r.IsPause, err = codec.ReadBoolean(); err != nil {
+		return
+	}
+	if r.TimeMs, err = codec.ReadNumber(); err != nil {
+		return
+	}
+
+	return
+}
+// Encoder
+func (r *PausePacket) GetPerferCid() (v int) {
+	return RTMP_CID_OverStream
+}
+func (r *PausePacket) GetMessageType() (v byte) {
+	return RTMP_MSG_AMF0CommandMessage
+}
+func (r *PausePacket) GetSize() (v int) {
+	v = Amf0SizeString(r.CommandName) + Amf0SizeNumber() + Amf0SizeNullOrUndefined()
+	v += Amf0SizeBoolean() + Amf0SizeNumber()
+	return
+}
+func (r *PausePacket) Encode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if err = codec.WriteString(r.CommandName); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TransactionId); err != nil {
+		return
+	}
+	if err = r.CommandObject.Write(codec); err != nil {
+		return
+	}
+	if err = codec.WriteBoolean(r.IsPause); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TimeMs); err != nil {
+		return
+	}
+	return
+}
+
+/**
+* 4.2.7. seek
+* The client sends the seek command to seek the offset (in milliseconds) within a media file or playlist.
+*/
+type SeekPacket struct {
+	CommandName string
+	TransactionId float64
+	CommandObject *Amf0Any // Null
+	// the number of milliseconds to seek into the playlist.
+	Milliseconds float64
+}
+func NewSeekPacket() (*SeekPacket) {
+	r := &SeekPacket{}
+	r.CommandName = AMF0_COMMAND_SEEK
+	r.CommandObject = NewAmf0Null()
+	return r
+}
+// Decoder
+func (r *SeekPacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.CommandName != AMF0_COMMAND_SEEK {
+		return Error{code:ERROR_RTMP_AMF0_DECODE, desc:fmt.Sprintf("amf0 decode name failed. expect=%v, actual=%v", AMF0_COMMAND_SEEK, r.CommandName)}
+	}
+
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+	if err = r.CommandObject.Read(codec); err != nil {
+		return
+	}
+	if r.Milliseconds, err = codec.ReadNumber(); err != nil {
+		return
+	}
+
+	return
+}
+// Encoder
+func (r *SeekPacket) GetPerferCid() (v int) {
+	return RTMP_CID_OverStream
+}
+func (r *SeekPacket) GetMessageType() (v byte) {
+	return RTMP_MSG_AMF0CommandMessage
+}
+func (r *SeekPacket) GetSize() (v int) {
+	return Amf0SizeString(r.CommandName) + Amf0SizeNumber() + Amf0SizeNullOrUndefined() + Amf0SizeNumber()
+}
+func (r *SeekPacket) Encode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if err = codec.WriteString(r.CommandName); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TransactionId); err != nil {
+		return
+	}
+	if err = r.CommandObject.Write(codec); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.Milliseconds); err != nil {
+		return
+	}
+	return
+}
+
 /**
 * FMLE start publish: ReleaseStream/PublishStream
 */
@@ -1304,6 +1977,34 @@ func (r *FMLEStartPacket) Decode(s *Buffer) (err error) {
 	return
 }
 
+// Encoder
+func (r *FMLEStartPacket) GetPerferCid() (v int) {
+	return RTMP_CID_OverConnection
+}
+func (r *FMLEStartPacket) GetMessageType() (v byte) {
+	return RTMP_MSG_AMF0CommandMessage
+}
+func (r *FMLEStartPacket) GetSize() (v int) {
+	return Amf0SizeString(r.CommandName) + Amf0SizeNumber() + Amf0SizeNullOrUndefined() + Amf0SizeString(r.StreamName)
+}
+func (r *FMLEStartPacket) Encode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if err = codec.WriteString(r.CommandName); err != nil {
+		return
+	}
+	if err = codec.WriteNumber(r.TransactionId); err != nil {
+		return
+	}
+	if err = r.CommandObject.Write(codec); err != nil {
+		return
+	}
+	if err = codec.WriteString(r.StreamName); err != nil {
+		return
+	}
+	return
+}
+
 /**
 * response for SrsFMLEStartPacket.
 */
@@ -1323,6 +2024,30 @@ func NewFMLEStartResPacket(transaction_id float64) (*FMLEStartResPacket) {
 	r.Args = NewAmf0Undefined()
 	return r
 }
+// Decoder
+func (r *FMLEStartResPacket) Decode(s *Buffer) (err error) {
+	codec := NewAmf0Codec(s)
+
+	if r.CommandName, err = codec.ReadString(); err != nil {
+		return
+	}
+	if r.CommandName != AMF0_COMMAND_RESULT {
+		return Error{code:ERROR_RTMP_AMF0_DECODE, desc:fmt.Sprintf("amf0 decode name failed. expect=%v, actual=%v", AMF0_COMMAND_RESULT, r.CommandName)}
+	}
+	if r.TransactionId, err = codec.ReadNumber(); err != nil {
+		return
+	}
+	if err = r.CommandObject.Read(codec); err != nil {
+		return
+	}
+	// the args is optional, undefined or null.
+	if !s.Empty() {
+		if err = r.Args.Read(codec); err != nil {
+			return
+		}
+	}
+	return
+}
 // Encoder
 func (r *FMLEStartResPacket) GetPerferCid() (v int) {
 	return RTMP_CID_OverConnection
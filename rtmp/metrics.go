@@ -0,0 +1,387 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+* the source of stats, for instance, the Server or Protocol.
+ */
+type StatsSource interface {
+	Stats() (stats Stats)
+	Done() (<-chan struct{})
+}
+
+/**
+* the stats of stream, aggregated by the connections of vhost/app/stream.
+ */
+type StreamStats struct {
+	Vhost string
+	App string
+	Stream string
+	// the connections in LogStatePublish and LogStatePlay.
+	Publishers int
+	Players int
+	RecvBytes uint64
+	SendBytes uint64
+	// the sum of kbps of connections.
+	RecvKbps Kbps
+	SendKbps Kbps
+	// the frames received from publishers.
+	RecvFrames FrameStats
+}
+
+/**
+* the counters of connections, the messages key is "direction/type".
+ */
+type metrics_counters struct {
+	recv_bytes uint64
+	send_bytes uint64
+	messages map[string]uint64
+	frames map[string]uint64
+	queue_overflows uint64
+	queue_dropped_audio uint64
+	queue_dropped_video uint64
+}
+func new_metrics_counters() (*metrics_counters) {
+	r := &metrics_counters{}
+	r.messages = map[string]uint64{}
+	r.frames = map[string]uint64{}
+	return r
+}
+
+func (r *metrics_counters) add(stats *Stats) {
+	r.recv_bytes += stats.RecvBytes
+	r.send_bytes += stats.SendBytes
+	for k, v := range stats.RecvMessages {
+		r.messages["recv/" + k] += v
+	}
+	for k, v := range stats.SendMessages {
+		r.messages["send/" + k] += v
+	}
+	r.frames["recv/audio"] += stats.RecvFrames.Audio
+	r.frames["recv/video"] += stats.RecvFrames.Video
+	r.frames["recv/keyframe"] += stats.RecvFrames.KeyFrames
+	r.frames["send/audio"] += stats.SendFrames.Audio
+	r.frames["send/video"] += stats.SendFrames.Video
+	r.frames["send/keyframe"] += stats.SendFrames.KeyFrames
+	r.queue_overflows += stats.SendQueue.Overflows
+	r.queue_dropped_audio += stats.SendQueue.DroppedAudio
+	r.queue_dropped_video += stats.SendQueue.DroppedVideo
+}
+
+func (r *metrics_counters) copy() (*metrics_counters) {
+	v := *r
+	v.messages = map[string]uint64{}
+	for k, n := range r.messages {
+		v.messages[k] = n
+	}
+	v.frames = map[string]uint64{}
+	for k, n := range r.frames {
+		v.frames[k] = n
+	}
+	return &v
+}
+
+/**
+* the metrics of the live connections, which is a http.Handler
+* to serve the prometheus text exposition, for example:
+* 		metrics := rtmp.NewMetrics()
+* 		http.Handle("/metrics", metrics)
+* 		// for each connection.
+* 		metrics.Register(server)
+* the connection is unregistered when done, and its counters are kept,
+* so the counters never decrease.
+ */
+type Metrics struct {
+	lock *sync.Mutex
+	sources map[StatsSource]bool
+	// the counters of the closed connections.
+	closed *metrics_counters
+}
+func NewMetrics() (*Metrics) {
+	r := &Metrics{}
+	r.lock = &sync.Mutex{}
+	r.sources = map[StatsSource]bool{}
+	r.closed = new_metrics_counters()
+	return r
+}
+
+/**
+* register the connection, which is unregistered when source.Done().
+ */
+func (r *Metrics) Register(source StatsSource) {
+	r.lock.Lock()
+	r.sources[source] = true
+	r.lock.Unlock()
+
+	go func() {
+		<- source.Done()
+
+		stats := source.Stats()
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		delete(r.sources, source)
+		r.closed.add(&stats)
+	}()
+}
+
+/**
+* get the stats of the live connections, sorted by id.
+ */
+func (r *Metrics) Connections() (conns []Stats) {
+	conns, _ = r.snapshot()
+	return
+}
+
+/**
+* get the stats of live connections and the counters of closed connections,
+* the connection is counted once, either live or closed.
+ */
+func (r *Metrics) snapshot() (conns []Stats, closed *metrics_counters) {
+	r.lock.Lock()
+	sources := make([]StatsSource, 0, len(r.sources))
+	for source := range r.sources {
+		sources = append(sources, source)
+	}
+	closed = r.closed.copy()
+	r.lock.Unlock()
+
+	for _, source := range sources {
+		conns = append(conns, source.Stats())
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Id < conns[j].Id
+	})
+	return
+}
+
+/**
+* get the stats of streams, aggregated by the live connections,
+* sorted by vhost/app/stream. the connection without stream is ignored.
+ */
+func (r *Metrics) Streams() (streams []StreamStats) {
+	return aggregate_streams(r.Connections())
+}
+
+func aggregate_streams(conns []Stats) (streams []StreamStats) {
+	index := map[string]int{}
+	for _, conn := range conns {
+		if conn.Stream == "" {
+			continue
+		}
+
+		key := conn.Vhost + "/" + conn.App + "/" + conn.Stream
+		i, ok := index[key]
+		if !ok {
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, StreamStats{Vhost:conn.Vhost, App:conn.App, Stream:conn.Stream})
+		}
+
+		stream := &streams[i]
+		switch conn.State {
+		case LogStatePublish:
+			stream.Publishers++
+			stream.RecvFrames.Audio += conn.RecvFrames.Audio
+			stream.RecvFrames.Video += conn.RecvFrames.Video
+			stream.RecvFrames.KeyFrames += conn.RecvFrames.KeyFrames
+			if conn.RecvFrames.KeyFrameInterval > stream.RecvFrames.KeyFrameInterval {
+				stream.RecvFrames.KeyFrameInterval = conn.RecvFrames.KeyFrameInterval
+			}
+		case LogStatePlay:
+			stream.Players++
+		}
+
+		stream.RecvBytes += conn.RecvBytes
+		stream.SendBytes += conn.SendBytes
+		stream.RecvKbps.Kbps10s += conn.RecvKbps.Kbps10s
+		stream.RecvKbps.Kbps30s += conn.RecvKbps.Kbps30s
+		stream.RecvKbps.Kbps300s += conn.RecvKbps.Kbps300s
+		stream.SendKbps.Kbps10s += conn.SendKbps.Kbps10s
+		stream.SendKbps.Kbps30s += conn.SendKbps.Kbps30s
+		stream.SendKbps.Kbps300s += conn.SendKbps.Kbps300s
+	}
+
+	sort.Slice(streams, func(i, j int) bool {
+		a, b := &streams[i], &streams[j]
+		if a.Vhost != b.Vhost {
+			return a.Vhost < b.Vhost
+		}
+		if a.App != b.App {
+			return a.App < b.App
+		}
+		return a.Stream < b.Stream
+	})
+	return
+}
+
+/**
+* serve the prometheus text exposition format 0.0.4.
+ */
+func (r *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conns, counters := r.snapshot()
+
+	var rtt_seconds float64
+	var rtt_count int
+	queued := 0
+	for i := range conns {
+		conn := &conns[i]
+		counters.add(conn)
+		queued += conn.SendQueue.Queued
+		if conn.Rtt > 0 {
+			rtt_seconds += conn.Rtt.Seconds()
+			rtt_count++
+		}
+	}
+
+	var b bytes.Buffer
+	e := metrics_encoder{b:&b}
+
+	e.family("rtmp_connections", "gauge", "The live rtmp connections.")
+	e.sample("rtmp_connections", nil, len(conns))
+	e.family("rtmp_recv_bytes_total", "counter", "The bytes received from peers.")
+	e.sample("rtmp_recv_bytes_total", nil, counters.recv_bytes)
+	e.family("rtmp_send_bytes_total", "counter", "The bytes sent to peers.")
+	e.sample("rtmp_send_bytes_total", nil, counters.send_bytes)
+
+	e.family("rtmp_messages_total", "counter", "The rtmp messages by direction and type.")
+	for _, k := range sorted_keys(counters.messages) {
+		direction, message_type := split_metrics_key(k)
+		e.sample("rtmp_messages_total", []string{"direction", direction, "type", message_type}, counters.messages[k])
+	}
+	e.family("rtmp_frames_total", "counter", "The audio, video and key frames by direction.")
+	for _, k := range sorted_keys(counters.frames) {
+		direction, kind := split_metrics_key(k)
+		e.sample("rtmp_frames_total", []string{"direction", direction, "kind", kind}, counters.frames[k])
+	}
+
+	e.family("rtmp_send_queue_depth", "gauge", "The messages in send queues.")
+	e.sample("rtmp_send_queue_depth", nil, queued)
+	e.family("rtmp_send_queue_overflows_total", "counter", "The times of send queue overflow.")
+	e.sample("rtmp_send_queue_overflows_total", nil, counters.queue_overflows)
+	e.family("rtmp_send_queue_dropped_total", "counter", "The frames dropped by send queue overflow policy.")
+	e.sample("rtmp_send_queue_dropped_total", []string{"kind", "audio"}, counters.queue_dropped_audio)
+	e.sample("rtmp_send_queue_dropped_total", []string{"kind", "video"}, counters.queue_dropped_video)
+
+	if rtt_count > 0 {
+		e.family("rtmp_rtt_seconds_avg", "gauge", "The average round trip time of connections measured by ping.")
+		e.sample("rtmp_rtt_seconds_avg", nil, rtt_seconds / float64(rtt_count))
+	}
+
+	streams := aggregate_streams(conns)
+	e.family("rtmp_stream_publishers", "gauge", "The publishers of stream.")
+	for _, s := range streams {
+		e.sample("rtmp_stream_publishers", stream_labels(&s), s.Publishers)
+	}
+	e.family("rtmp_stream_players", "gauge", "The players of stream.")
+	for _, s := range streams {
+		e.sample("rtmp_stream_players", stream_labels(&s), s.Players)
+	}
+	e.family("rtmp_stream_recv_kbps", "gauge", "The recv kbps of stream over the window.")
+	for _, s := range streams {
+		e.kbps("rtmp_stream_recv_kbps", stream_labels(&s), s.RecvKbps)
+	}
+	e.family("rtmp_stream_send_kbps", "gauge", "The send kbps of stream over the window.")
+	for _, s := range streams {
+		e.kbps("rtmp_stream_send_kbps", stream_labels(&s), s.SendKbps)
+	}
+	e.family("rtmp_stream_keyframe_interval_seconds", "gauge", "The keyframe interval of stream from publisher.")
+	for _, s := range streams {
+		e.sample("rtmp_stream_keyframe_interval_seconds", stream_labels(&s), s.RecvFrames.KeyFrameInterval.Seconds())
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func stream_labels(s *StreamStats) ([]string) {
+	return []string{"vhost", s.Vhost, "app", s.App, "stream", s.Stream}
+}
+
+// split the "direction/name" key of counters.
+func split_metrics_key(k string) (string, string) {
+	if i := strings.Index(k, "/"); i >= 0 {
+		return k[:i], k[i + 1:]
+	}
+	return "", k
+}
+
+func sorted_keys(m map[string]uint64) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+/**
+* the encoder of prometheus text exposition.
+ */
+type metrics_encoder struct {
+	b *bytes.Buffer
+}
+
+func (r *metrics_encoder) family(name, metric_type, help string) {
+	fmt.Fprintf(r.b, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(r.b, "# TYPE %v %v\n", name, metric_type)
+}
+
+/**
+* write the sample, the labels is the name and value pairs.
+ */
+func (r *metrics_encoder) sample(name string, labels []string, value interface {}) {
+	r.b.WriteString(name)
+	if len(labels) > 0 {
+		r.b.WriteString("{")
+		for i := 0; i + 1 < len(labels); i += 2 {
+			if i > 0 {
+				r.b.WriteString(",")
+			}
+			fmt.Fprintf(r.b, "%v=\"%v\"", labels[i], escape_label_value(labels[i + 1]))
+		}
+		r.b.WriteString("}")
+	}
+	fmt.Fprintf(r.b, " %v\n", value)
+}
+
+func (r *metrics_encoder) kbps(name string, labels []string, v Kbps) {
+	r.sample(name, append(labels[:len(labels):len(labels)], "window", "10s"), v.Kbps10s)
+	r.sample(name, append(labels[:len(labels):len(labels)], "window", "30s"), v.Kbps30s)
+	r.sample(name, append(labels[:len(labels):len(labels)], "window", "300s"), v.Kbps300s)
+}
+
+// escape the backslash, double-quote and line feed of label value.
+func escape_label_value(v string) (string) {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return v
+}
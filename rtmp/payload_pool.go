@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+/**
+* the size classes of payload pool, the power of 2,
+* from 2^7=128B to 2^24=16MB, for the PayloadLength is 3bytes.
+*/
+const payload_pool_min_shift = 7
+const payload_pool_max_shift = 24
+
+var payload_pools [payload_pool_max_shift + 1]sync.Pool
+
+/**
+* the pooled payload buffer, shared by the copies of message,
+* return to pool when the last reference released.
+*/
+type payload_buffer struct {
+	b []byte
+	refs int32
+	shift int
+}
+
+// get the size class of the payload size.
+func payload_pool_shift(size int) (shift int) {
+	if size <= 0 {
+		return payload_pool_min_shift
+	}
+	if shift = bits.Len(uint(size - 1)); shift < payload_pool_min_shift {
+		shift = payload_pool_min_shift
+	}
+	return
+}
+
+/**
+* alloc payload buffer from pool, with 1 reference,
+* the b of buffer is size bytes, whose content is not zero.
+*/
+func alloc_payload(size int) (r *payload_buffer) {
+	shift := payload_pool_shift(size)
+	if shift > payload_pool_max_shift {
+		return &payload_buffer{b:make([]byte, size), refs:1, shift:shift}
+	}
+
+	if v, ok := payload_pools[shift].Get().(*payload_buffer); ok {
+		r = v
+	} else {
+		r = &payload_buffer{b:make([]byte, 1 << uint(shift)), shift:shift}
+	}
+
+	r.b = r.b[:size]
+	r.refs = 1
+	return
+}
+
+func (r *payload_buffer) ref() {
+	atomic.AddInt32(&r.refs, 1)
+}
+
+func (r *payload_buffer) unref() {
+	if atomic.AddInt32(&r.refs, -1) != 0 {
+		return
+	}
+
+	if r.shift > payload_pool_max_shift {
+		return
+	}
+	r.b = r.b[:cap(r.b)]
+	payload_pools[r.shift].Put(r)
+}
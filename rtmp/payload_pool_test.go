@@ -0,0 +1,173 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"testing"
+)
+
+func TestPayloadPoolRefs(t *testing.T) {
+	msg := NewMessage()
+	msg.payload_ref = alloc_payload(1000)
+	msg.Payload = msg.payload_ref.b
+	if len(msg.Payload) != 1000 || cap(msg.Payload) != 1024 {
+		t.Fatalf("expect len=1000 cap=1024, actual len=%v cap=%v", len(msg.Payload), cap(msg.Payload))
+	}
+
+	ref := msg.payload_ref
+	copy := msg.Copy()
+	if ref.refs != 2 {
+		t.Fatalf("expect refs=2, actual=%v", ref.refs)
+	}
+
+	msg.Release()
+	if msg.Payload != nil || ref.refs != 1 {
+		t.Fatalf("expect released, refs=%v", ref.refs)
+	}
+	// release twice is ignored.
+	msg.Release()
+	if ref.refs != 1 {
+		t.Fatalf("expect refs=1, actual=%v", ref.refs)
+	}
+
+	copy.Release()
+	if ref.refs != 0 {
+		t.Fatalf("expect refs=0, actual=%v", ref.refs)
+	}
+
+	// unpooled message is never released.
+	msg = new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01})
+	msg.Release()
+	if msg.Payload == nil {
+		t.Fatal("unpooled payload should not be released")
+	}
+}
+
+func TestPayloadPoolShift(t *testing.T) {
+	for _, c := range []struct{ size, shift int }{
+		{0, 7}, {1, 7}, {128, 7}, {129, 8}, {4096, 12}, {4097, 13}, {0xFFFFFF, 24},
+	} {
+		if v := payload_pool_shift(c.size); v != c.shift {
+			t.Fatalf("size=%v expect shift=%v, actual=%v", c.size, c.shift, v)
+		}
+	}
+}
+
+/**
+* encode one GOP of a 5Mbps publisher in the default 128B chunks,
+* 2s at 25fps with a 100KB keyframe, and 44.1kHz AAC audio.
+ */
+func encode_publisher_gop(b *testing.B, enc *protocol) (gop []byte, count int) {
+	const bitrate = 5 * 1000 * 1000 / 8
+	const keyframe = 100 * 1024
+	const audio = 370
+	const nb_video = 50
+	const nb_audio = 86
+
+	inter := (bitrate * 2 - keyframe - audio * nb_audio) / (nb_video - 1)
+
+	var iovs [][]byte
+	var headers []byte
+	send := func(message_type byte, cid int, timestamp uint64, size int) {
+		msg := NewMessage()
+		msg.Header.MessageType = message_type
+		msg.Header.PayloadLength = uint32(size)
+		msg.Header.StreamId = 1
+		msg.Header.Timestamp = timestamp
+		msg.Payload = make([]byte, size)
+		msg.PerferCid = cid
+
+		v, h, err := enc.encode_chunks(msg, iovs[:0], headers[:0])
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, iov := range v {
+			gop = append(gop, iov...)
+		}
+		iovs, headers = v, h
+		count++
+	}
+
+	for i := 0; i < nb_video; i++ {
+		size := inter
+		if i == 0 {
+			size = keyframe
+		}
+		send(RTMP_MSG_VideoMessage, RTMP_CID_Video, uint64(i * 40), size)
+
+		for j := i * nb_audio / nb_video; j < (i + 1) * nb_audio / nb_video; j++ {
+			send(RTMP_MSG_AudioMessage, RTMP_CID_Audio, uint64(j * 23), audio)
+		}
+	}
+	return
+}
+
+/**
+* benchmark the receive path of a 5Mbps publisher, each op receives 2s of stream,
+* report the allocations with and without the payload pool.
+ */
+func BenchmarkRecvPublisher5Mbps(b *testing.B) {
+	for _, pool := range []bool{false, true} {
+		name := "make"
+		if pool {
+			name = "pool"
+		}
+		b.Run(name, func(b *testing.B) {
+			benchmark_recv_publisher(b, pool)
+		})
+	}
+}
+
+func benchmark_recv_publisher(b *testing.B, pool bool) {
+	p, client := new_handshaked_protocol(b)
+	defer client.Close()
+	defer p.Destroy()
+	p.SetPayloadPool(pool)
+
+	v, err := NewProtocol(client)
+	if err != nil {
+		b.Fatal(err)
+	}
+	gop, count := encode_publisher_gop(b, v.(*protocol))
+
+	go func() {
+		for {
+			if _, err := client.Write(gop); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(gop)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < count; j++ {
+			msg, err := p.RecvMessage()
+			if err != nil {
+				b.Fatal(err)
+			}
+			msg.Release()
+		}
+	}
+}
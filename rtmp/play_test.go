@@ -0,0 +1,166 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestPlayStreamEvents(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "vod", "tcUrl", "rtmp://127.0.0.1/vod")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "movie.flv"))
+
+	responses := replay_session(t, c.b, 11, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_Play, "movie.flv")
+		if err := s.StreamIsRecorded(1); err != nil {
+			t.Error(err)
+		}
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+		}
+		if err := s.StreamDry(1); err != nil {
+			t.Error(err)
+		}
+		if err := s.StreamEOF(1); err != nil {
+			t.Error(err)
+		}
+	})
+
+	assert_responses(t, responses, []string{
+		`cid=3 sid=0 "_result",2,null,1`,
+		"cid=2 sid=0 UserControl(4,1)",
+		"cid=2 sid=0 UserControl(0,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Reset",description:"Playing and resetting stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Start",description:"Started playing stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "|RtmpSampleAccess",false,false`,
+		`cid=5 sid=1 "onStatus",{code:"NetStream.Data.Start"}`,
+		"cid=2 sid=0 UserControl(2,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.UnpublishNotify",description:"The stream is now unpublished.",details:"stream",clientid:"ASAICiss"}`,
+		"cid=2 sid=0 UserControl(1,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Stop",description:"Stopped playing stream.",details:"stream",clientid:"ASAICiss"}`,
+	})
+}
+
+func TestPausePacketCodec(t *testing.T) {
+	p := new_protocol(NewSocket(nil))
+
+	pause := NewPausePacket()
+	pause.IsPause, pause.TimeMs = true, 10000
+	seek := NewSeekPacket()
+	seek.Milliseconds = 30000
+
+	for _, pkt := range []Encoder{pause, seek} {
+		_, msg, err := p.EncodeMessage(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := DecodePacket(p, msg.Header, msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(v, pkt) {
+			t.Errorf("expect %+v, actual %+v", pkt, v)
+		}
+	}
+}
+
+func TestPlayPauseAndSeek(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "vod", "tcUrl", "rtmp://127.0.0.1/vod")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "movie.flv"))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PAUSE, 0.0, nil, true, 10000.0))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PAUSE, 0.0, nil, false, 10000.0))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_SEEK, 0.0, nil, 30000.0))
+
+	var controls []string
+	responses := replay_session(t, c.b, 16, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_Play, "movie.flv")
+		if err := s.StartPlay(1); err != nil {
+			t.Error(err)
+		}
+
+		for len(controls) < 3 {
+			msg, err := s.Protocol().RecvMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pkt, err := s.Protocol().DecodeMessage(msg)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			switch pkt := pkt.(type) {
+			case *PausePacket:
+				controls = append(controls, fmt.Sprintf("pause(%v,%v)", pkt.IsPause, pkt.TimeMs))
+				err = s.OnPlayPause(msg.Header.StreamId, pkt.IsPause)
+			case *SeekPacket:
+				controls = append(controls, fmt.Sprintf("seek(%v)", pkt.Milliseconds))
+				err = s.OnPlaySeek(msg.Header.StreamId, pkt.Milliseconds)
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	})
+
+	if fmt.Sprint(controls) != "[pause(true,10000) pause(false,10000) seek(30000)]" {
+		t.Errorf("controls %v", controls)
+	}
+
+	play := []string{
+		"cid=2 sid=0 UserControl(0,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Reset",description:"Playing and resetting stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Play.Start",description:"Started playing stream.",details:"stream",clientid:"ASAICiss"}`,
+		`cid=5 sid=1 "|RtmpSampleAccess",false,false`,
+		`cid=5 sid=1 "onStatus",{code:"NetStream.Data.Start"}`,
+	}
+	expect := []string{`cid=3 sid=0 "_result",2,null,1`}
+	expect = append(expect, play...)
+	expect = append(expect,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Pause.Notify",description:"Paused stream."}`,
+		"cid=2 sid=0 UserControl(1,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Unpause.Notify",description:"Unpaused stream."}`,
+		"cid=2 sid=0 UserControl(0,1)",
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Seek.Notify",description:"Seeking 30000 (stream ID: 1).",details:"stream",clientid:"ASAICiss"}`,
+	)
+	expect = append(expect, play...)
+	assert_responses(t, responses, expect)
+}
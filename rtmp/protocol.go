@@ -22,10 +22,13 @@
 package rtmp
 
 import (
+	"context"
 	"math"
+	"net"
 	"reflect"
 	"sync"
-	"runtime"
+	"sync/atomic"
+	"time"
 )
 
 /**
@@ -71,6 +74,10 @@ type protocol struct {
 	requests map[float64]string
 	// peer in
 	chunkStreams map[int]*ChunkStream
+	// the bytes of payload allocated for the partial messages.
+	partial_bytes int
+	// the limits of protocol stack, the value is *Limits.
+	limits atomic.Value
 	// the bytes read from underlayer tcp connection,
 	// used for parse to RTMP message or packets.
 	buffer *Buffer
@@ -81,38 +88,163 @@ type protocol struct {
 	// peer out
 	// output chunk stream chunk size.
 	outChunkSize uint32
+	// the output rate limit, and the Set Peer Bandwidth of peer.
+	out_bandwidth *send_bandwidth
 	// bytes cache, size is RTMP_MAX_FMT0_HEADER_SIZE
 	outHeaderFmt0 *Buffer
 	// bytes cache, size is RTMP_MAX_FMT3_HEADER_SIZE
 	outHeaderFmt3 *Buffer
+	// the cache for the send goroutine, the messages of batch,
+	// the iovecs and the chunk headers to writev.
+	out_msgs []*Message
+	out_iovs net.Buffers
+	out_headers []byte
 	// use channel to store the decoded message, or messages to encode,
 	// for user can use select to determinate the event of message(incoming or outgoing)
-	// message channel lock, to stop protocol
-	msg_in_lock *sync.Mutex
-	msg_out_lock *sync.Mutex
-	// input/output error
-	msg_io_err error
 	// message input queue, received message from connection.
 	msg_in_queue chan *Message
-	// message output queue, message to send over connection
-	msg_out_queue chan *Message
+	// whether alloc the payload of received message from pool, 0 or 1.
+	payload_pool int32
+	// the max payload size of aggregate message to send, 0 to never aggregate.
+	out_aggregate_size int32
+	// message output queue, message to send over connection,
+	// the send goroutine pop the message of highest priority.
+	msg_out_queue *send_queue
+	/**
+	* closed when the protocol stack is destroyed or input/output failed,
+	* all goroutines blocking on the queues must select it to quit.
+	 */
+	msg_io_done chan struct{}
+	// to close the msg_io_done and connection only once.
+	msg_io_once *sync.Once
+	// the input/output error, the first error which closed the stack.
+	// the value is protocol_error, nil when stack alive.
+	msg_io_err atomic.Value
+	// wait for the message pump goroutines to quit.
+	msg_io_wait *sync.WaitGroup
+	// lock for requests, which maybe accessed by send and decode.
+	requests_lock *sync.Mutex
+	// the logger, the value is logger_holder.
+	logger atomic.Value
+	// the context of log, the value is *LogContext, copy on write.
+	log_ctx atomic.Value
+	// lock to update the log_ctx.
+	log_ctx_lock *sync.Mutex
+	// when the protocol stack created.
+	created time.Time
+	// the counters of received and sent messages.
+	recv_stats *message_stats
+	send_stats *message_stats
+	// the round trip time in time.Duration, 0 when unknown.
+	rtt int64
+	// the keepalive by ping, and the pings wait for response.
+	keepalive *keepalive
+	// the buffer length in ms of player, key is the stream id.
+	buffer_lengths map[uint32]uint32
+	buffer_lengths_lock *sync.Mutex
+	// the send queue follows the buffer length when fps is not 0.
+	buffer_queue_fps int
+	buffer_queue_policy int
+}
+
+// wrapper for logger, for the atomic.Value requires the same concrete type.
+type logger_holder struct {
+	logger Logger
+}
+
+// wrapper for error, for the atomic.Value requires the same concrete type.
+type protocol_error struct {
+	err error
 }
 
 /**
 * destroy the protocol stack, close channels, stop goroutines.
  */
 func (r *protocol) Destroy() {
-	r.msg_in_lock.Lock()
-	r.msg_out_lock.Lock()
-	defer r.msg_out_lock.Unlock()
-	defer r.msg_in_lock.Unlock()
+	r.close(Error{code:ERROR_GO_PROTOCOL_DESTROYED, desc:"protocol stack destroyed"})
+
+	// wait for the recv/send goroutines to quit.
+	r.msg_io_wait.Wait()
+}
+
+/**
+* close the stack by err, wakeup all goroutines and close the connection.
+* only the first error is kept, the others are ignored.
+ */
+func (r *protocol) close(err error) {
+	r.msg_io_once.Do(func(){
+		if v, ok := err.(Error); ok && (v.code == ERROR_GO_PROTOCOL_DESTROYED || v.code == ERROR_SOCKET_CLOSED) {
+			r.info("connection closed, %v", err)
+		} else {
+			r.warn("connection closed, %v", err)
+		}
+
+		r.msg_io_err.Store(protocol_error{err:err})
+		close(r.msg_io_done)
+
+		// wakeup the goroutines blocking on reading or writing.
+		r.conn.Close()
+	})
+}
+
+func (r *protocol) Done() (<-chan struct{}) {
+	return r.msg_io_done
+}
+
+func (r *protocol) Err() (err error) {
+	if v, ok := r.msg_io_err.Load().(protocol_error); ok {
+		err = v.err
+	}
+	return
+}
+
+func (r *protocol) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = null_logger{}
+	}
+	r.logger.Store(logger_holder{logger:logger})
+}
 
-	if r.msg_io_err == nil {
-		r.msg_io_err = Error{code:ERROR_GO_PROTOCOL_DESTROYED, desc:"protocol stack destroyed"}
+func (r *protocol) LogContext() (*LogContext) {
+	return r.log_ctx.Load().(*LogContext)
+}
+
+func (r *protocol) UpdateLogContext(update func(ctx *LogContext)) {
+	r.log_ctx_lock.Lock()
+	defer r.log_ctx_lock.Unlock()
+
+	ctx := *r.LogContext()
+	update(&ctx)
+	r.log_ctx.Store(&ctx)
+}
+
+// whether the log level is enabled, to avoid formatting the trace logs.
+func (r *protocol) log_enabled(level int) (bool) {
+	return r.logger.Load().(logger_holder).logger.Enabled(level)
+}
+
+func (r *protocol) log(level int, format string, v ...interface {}) {
+	logger := r.logger.Load().(logger_holder).logger
+	if logger.Enabled(level) {
+		logger.Log(level, r.LogContext(), format, v...)
 	}
+}
+func (r *protocol) trace(format string, v ...interface {}) {
+	r.log(LogLevelTrace, format, v...)
+}
+func (r *protocol) info(format string, v ...interface {}) {
+	r.log(LogLevelInfo, format, v...)
+}
+func (r *protocol) warn(format string, v ...interface {}) {
+	r.log(LogLevelWarn, format, v...)
+}
+
+func (r *protocol) SetRecvTimeout(timeout time.Duration) {
+	r.conn.SetRecvTimeout(timeout)
+}
 
-	close(r.msg_in_queue)
-	close(r.msg_out_queue)
+func (r *protocol) SetSendTimeout(timeout time.Duration) {
+	r.conn.SetSendTimeout(timeout)
 }
 
 func (r *protocol) MessageInputChannel() (chan *Message) {
@@ -125,42 +257,95 @@ func (r *protocol) MessageInputChannel() (chan *Message) {
 * send messages in msg_out_queue over connection
  */
 func (r *protocol) start_message_pump_goroutines() {
+	r.msg_io_wait.Add(3)
 	go r.recv_msg_goroutine()
 	go r.send_msg_goroutine()
+	go r.keepalive_goroutine()
 }
 func (r *protocol) recv_msg_goroutine() {
-	for r.msg_io_err == nil {
-		r.do_recv_msg_goroutine()
+	defer r.msg_io_wait.Done()
+
+	for {
+		msg, err := r.do_recv_msg_goroutine_job()
+		if err != nil {
+			r.close(err)
+			return
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		// demux the aggregate message, user never got it, so the stats count the sub-messages.
+		msgs := []*Message{msg}
+		if msg.Header.IsAggregate() {
+			if msgs, err = demux_aggregate(msg); err != nil {
+				r.close(err)
+				return
+			}
+			for _, msg = range msgs {
+				r.recv_stats.on_message(msg)
+			}
+		}
+
+		for _, msg = range msgs {
+			select {
+			case r.msg_in_queue <- msg:
+			case <- r.msg_io_done:
+				return
+			}
+		}
 	}
 }
 func (r *protocol) send_msg_goroutine() {
-	for r.msg_io_err == nil {
-		r.do_send_msg_goroutine()
-	}
-}
-func (r *protocol) do_recv_msg_goroutine() {
-	r.msg_in_lock.Lock()
-	defer r.msg_in_lock.Unlock()
+	defer r.msg_io_wait.Done()
 
-	if r.msg_io_err != nil {
-		return
-	}
+	for {
+		var msg *Message
+		if msg = r.msg_out_queue.pop(r.msg_io_done); msg == nil {
+			return
+		}
 
-	r.msg_io_err = r.do_recv_msg_goroutine_job()
-}
-func (r *protocol) do_send_msg_goroutine() {
-	r.msg_out_lock.Lock()
-	defer r.msg_out_lock.Unlock()
+		// batch the queued messages, to sendout by one writev,
+		// when the rate is limited, only batch the payload of available tokens,
+		// so the batch and aggregate still work when the tokens are enough.
+		msgs := append(r.out_msgs[:0], msg)
+		quota, limited := r.out_bandwidth.bucket.available(time.Now())
+		for batched := len(msg.Payload); len(msgs) < RTMP_MAX_SEND_BATCH && (!limited || batched < quota); {
+			if msg = r.msg_out_queue.try_pop(); msg == nil {
+				break
+			}
+			msgs = append(msgs, msg)
+			batched += len(msg.Payload)
+		}
 
-	if r.msg_io_err != nil {
-		return
-	}
+		// the stats count the messages sent by user, before muxed to aggregate messages.
+		for _, msg = range msgs {
+			r.send_stats.on_message(msg)
+		}
 
-	r.msg_io_err = r.do_send_msg_goroutine_job()
-}
-func (r *protocol) do_recv_msg_goroutine_job() (err error) {
-	var msg *Message
+		// mux the batched audio/video/data messages to aggregate messages.
+		if size := int(atomic.LoadInt32(&r.out_aggregate_size)); size > 0 && len(msgs) > 1 {
+			msgs = mux_aggregate(msgs, size)
+		}
+
+		if err := r.do_send_msg_goroutine_job(msgs); err != nil {
+			r.close(err)
+			return
+		}
 
+		// release the sent messages, never ref them.
+		for i, msg := range msgs {
+			if msg.sent != nil {
+				close(msg.sent)
+			}
+			msg.Release()
+			msgs[i] = nil
+		}
+		r.out_msgs = msgs
+	}
+}
+func (r *protocol) do_recv_msg_goroutine_job() (msg *Message, err error) {
 	if msg, err = r.recv_interlaced_message(); err != nil {
 		return
 	}
@@ -170,24 +355,80 @@ func (r *protocol) do_recv_msg_goroutine_job() (err error) {
 	}
 
 	if msg.ReceivedPayloadLength <= 0 || msg.Header.PayloadLength <= 0 {
-		return
+		return nil, nil
+	}
+
+	// the aggregate message is counted when demuxed.
+	if !msg.Header.IsAggregate() {
+		r.recv_stats.on_message(msg)
+	}
+	if r.log_enabled(LogLevelTrace) {
+		r.trace("recv message cid=%v, %v", msg.PerferCid, message_dump(msg))
 	}
 
 	if err = r.on_recv_message(msg); err != nil {
 		return
 	}
 
-	r.msg_in_queue <- msg
 	return
 }
-func (r *protocol) do_send_msg_goroutine_job() (err error) {
-	var msg *Message
-	var ok bool
-	if msg, ok = <- r.msg_out_queue; !ok {
-		err = Error{code:ERROR_GO_PROTOCOL_DESTROYED, desc:"protocol stack destroyed, cannot send"}
+/**
+* encode the msgs to chunks, then sendout all chunks by one writev.
+ */
+func (r *protocol) do_send_msg_goroutine_job(msgs []*Message) (err error) {
+	// the iovecs, the header and payload of chunks.
+	iovs := r.out_iovs[:0]
+	// all chunk headers are written in the headers cache.
+	headers := r.out_headers[:0]
+
+	for _, msg := range msgs {
+		if iovs, headers, err = r.encode_chunks(msg, iovs, headers); err != nil {
+			return
+		}
+
+		// the messages after SetChunkSize use the new chunk size.
+		if err = r.on_sent_message(msg); err != nil {
+			return
+		}
+	}
+
+	// wait for the tokens when the output rate is limited.
+	var size int
+	for _, iov := range iovs {
+		size += len(iov)
+	}
+	if wait := r.out_bandwidth.bucket.take(size, time.Now()); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.msg_io_done:
+			return r.Err()
+		}
+	}
+
+	bufs := iovs
+	if _, err = r.conn.WriteBuffers(&bufs); err != nil {
 		return
 	}
 
+	if r.log_enabled(LogLevelTrace) {
+		for _, msg := range msgs {
+			r.trace("send message cid=%v, %v", msg.PerferCid, message_dump(msg))
+		}
+	}
+
+	// reuse the cache, never ref the payloads.
+	for i := range iovs {
+		iovs[i] = nil
+	}
+	r.out_iovs, r.out_headers = iovs, headers
+	return
+}
+
+/**
+* encode the msg to chunks, append the chunk header and payload to iovs,
+* where the chunk headers are written in headers.
+ */
+func (r *protocol) encode_chunks(msg *Message, iovs net.Buffers, headers []byte) (net.Buffers, []byte, error) {
 	// always write the header event payload is empty.
 	msg.SentPayloadLength = -1
 	for len(msg.Payload) > msg.SentPayloadLength {
@@ -245,27 +486,25 @@ func (r *protocol) do_send_msg_goroutine_job() (err error) {
 			real_header = r.outHeaderFmt3.WrittenBytes()
 		}
 
-		// sendout header
-		if _, err = r.conn.Write(real_header); err != nil {
-			return
-		}
+		// cache the header, the headers maybe grow,
+		// it's ok for the iovs still ref the previous cached headers.
+		pos := len(headers)
+		headers = append(headers, real_header...)
+		iovs = append(iovs, headers[pos:len(headers):len(headers)])
 
-		// sendout payload
+		// the payload of chunk
 		if len(msg.Payload) > 0 {
 			payload_size := len(msg.Payload) - msg.SentPayloadLength
 			payload_size = int(math.Min(float64(r.outChunkSize), float64(payload_size)))
 
-			data := msg.Payload[msg.SentPayloadLength:msg.SentPayloadLength+payload_size]
-			if _, err = r.conn.Write(data); err != nil {
-				return
-			}
+			iovs = append(iovs, msg.Payload[msg.SentPayloadLength:msg.SentPayloadLength+payload_size])
 
 			// consume sendout bytes when not empty packet.
 			msg.SentPayloadLength += payload_size
 		}
 	}
 
-	return
+	return iovs, headers, nil
 }
 
 /**
@@ -274,17 +513,29 @@ func (r *protocol) do_send_msg_goroutine_job() (err error) {
 * specifies message.
 */
 func (r *protocol) RecvMessage() (msg *Message, err error) {
-	var ok bool
-	if msg, ok = <- r.msg_in_queue; ok {
+	return r.RecvMessageContext(context.Background())
+}
+
+func (r *protocol) RecvMessageContext(ctx context.Context) (msg *Message, err error) {
+	select {
+	case msg = <- r.msg_in_queue:
+		return
+	case <- r.msg_io_done:
+	case <- ctx.Done():
+		err = context_error(ctx)
 		return
 	}
 
-	if r.msg_io_err != nil {
-		err = r.msg_io_err
+	// the messages received before the stack closed.
+	select {
+	case msg = <- r.msg_in_queue:
 		return
+	default:
 	}
 
-	err = Error{code:ERROR_GO_PROTOCOL_DESTROYED, desc:"recv msg from destroyed stack"}
+	if err = r.Err(); err == nil {
+		err = Error{code:ERROR_GO_PROTOCOL_DESTROYED, desc:"recv msg from destroyed stack"}
+	}
 	return
 }
 
@@ -298,6 +549,12 @@ func (r *protocol) DecodeMessage(msg *Message) (pkt interface {}, err error) {
 	}
 
 	pkt, err = DecodePacket(r, msg.Header, msg.Payload)
+
+	if err != nil {
+		r.warn("decode message failed, %v, %v", err, message_dump(msg))
+	} else if pkt != nil && r.log_enabled(LogLevelTrace) {
+		r.trace("decode message to %T", pkt)
+	}
 	return
 }
 
@@ -305,6 +562,10 @@ func (r *protocol) DecodeMessage(msg *Message) (pkt interface {}, err error) {
 * expect a specified message by v, drop others util got specified one.
 */
 func (r *protocol) ExpectPacket(v interface {}) (msg *Message, err error) {
+	return r.ExpectPacketContext(context.Background(), v)
+}
+
+func (r *protocol) ExpectPacketContext(ctx context.Context, v interface {}) (msg *Message, err error) {
 	rv := reflect.ValueOf(v)
 	rt := reflect.TypeOf(v)
 	if rv.Kind() != reflect.Ptr {
@@ -321,7 +582,8 @@ func (r *protocol) ExpectPacket(v interface {}) (msg *Message, err error) {
 	}
 
 	for {
-		if msg, err = r.RecvMessage(); err != nil {
+		if msg, err = r.RecvMessageContext(ctx); err != nil {
+			err = r.close_by_context(ctx, err)
 			return
 		}
 		var pkt interface {}
@@ -329,6 +591,7 @@ func (r *protocol) ExpectPacket(v interface {}) (msg *Message, err error) {
 			return
 		}
 		if pkt == nil {
+			msg.Release()
 			continue
 		}
 
@@ -347,6 +610,8 @@ func (r *protocol) ExpectPacket(v interface {}) (msg *Message, err error) {
 			rv.Elem().Set(reflect.ValueOf(pkt))
 			return
 		}
+
+		msg.Release()
 	}
 
 	return
@@ -376,14 +641,42 @@ func (r *protocol) EncodeMessage(pkt Encoder) (cid int, msg *Message, err error)
 }
 
 func (r *protocol) SendPacket(pkt Encoder, stream_id uint32) (err error) {
-	var msg *Message = nil
+	_, err = r.send_packet(pkt, stream_id, false)
+	return
+}
+
+func (r *protocol) SendPacketSync(pkt Encoder, stream_id uint32) (err error) {
+	var msg *Message
+	if msg, err = r.send_packet(pkt, stream_id, true); err != nil {
+		return
+	}
+
+	select {
+	case <- msg.sent:
+		return
+	case <- r.msg_io_done:
+	}
 
+	// the message maybe sent before the stack closed.
+	select {
+	case <- msg.sent:
+		return
+	default:
+	}
+	return r.Err()
+}
+
+// encode the pkt to message and send it, the sent of message is closed when written if sync.
+func (r *protocol) send_packet(pkt Encoder, stream_id uint32, sync bool) (msg *Message, err error) {
 	// if pkt is encoder, encode packet to message.
 	var cid int
 	if cid, msg, err = r.EncodeMessage(pkt); err != nil {
 		return
 	}
 	msg.PerferCid = cid
+	if sync {
+		msg.sent = make(chan struct{})
+	}
 
 	if err = r.SendMessage(msg, stream_id); err != nil {
 		return
@@ -405,26 +698,129 @@ func (r *protocol) SendMessage(pkt *Message, stream_id uint32) (err error) {
 		msg.Header.StreamId = stream_id
 	}
 
-	defer func(){
-		if re := recover(); re != nil {
-			if _, ok := re.(runtime.Error); ok {
-				// write to closed channel
-				if err == nil {
-					err = r.msg_io_err
-				}
-				return
-			}
-			panic(re)
+	// never send to the destroyed stack.
+	select {
+	case <- r.msg_io_done:
+		return r.Err()
+	default:
+	}
+
+	if err = r.msg_out_queue.push(msg, r.msg_io_done); err == nil {
+		return
+	}
+
+	// disconnect when queue overflow.
+	if v, ok := err.(Error); ok && v.code == ERROR_GO_SEND_QUEUE_OVERFLOW {
+		r.close(err)
+	}
+	if r.Err() != nil {
+		err = r.Err()
+	}
+	return
+}
+
+func (r *protocol) SetLimits(limits *Limits) {
+	v := *limits
+	r.limits.Store(&v)
+}
+
+func (r *protocol) get_limits() (*Limits) {
+	return r.limits.Load().(*Limits)
+}
+
+func (r *protocol) SetPayloadPool(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&r.payload_pool, 1)
+	} else {
+		atomic.StoreInt32(&r.payload_pool, 0)
+	}
+}
+
+func (r *protocol) SetSendQueue(capacity int, policy int) {
+	r.msg_out_queue.set_policy(capacity, policy)
+}
+
+func (r *protocol) SetSendQueueByBufferLength(fps int, policy int) {
+	r.buffer_lengths_lock.Lock()
+	defer r.buffer_lengths_lock.Unlock()
+
+	r.buffer_queue_fps, r.buffer_queue_policy = fps, policy
+
+	// apply the longest buffer length of streams, if player already set it.
+	var length uint32
+	var ok bool
+	for _, v := range r.buffer_lengths {
+		if !ok || v > length {
+			length, ok = v, true
 		}
-	}()
+	}
+	if ok {
+		r.apply_buffer_length(length)
+	}
+}
+
+/**
+* set the send queue by the buffer length in ms of player,
+* when SetSendQueueByBufferLength, the buffer_lengths_lock is held.
+ */
+func (r *protocol) apply_buffer_length(length uint32) {
+	if r.buffer_queue_fps <= 0 {
+		return
+	}
+
+	capacity := int(uint64(length) * uint64(r.buffer_queue_fps) / 1000)
+	if capacity < RTMP_MSG_CHANNEL_BUFFER {
+		capacity = RTMP_MSG_CHANNEL_BUFFER
+	}
+	r.msg_out_queue.set_policy(capacity, r.buffer_queue_policy)
+	r.trace("send queue by buffer length %vms, capacity=%v, policy=%v", length, capacity, r.buffer_queue_policy)
+}
+
+func (r *protocol) SetSendRate(kbps int) {
+	r.out_bandwidth.set_user_kbps(kbps)
+}
+
+func (r *protocol) EnforcePeerBandwidth(enabled bool) {
+	r.out_bandwidth.set_enforce(enabled)
+}
+
+func (r *protocol) PeerBandwidth() (bandwidth uint32, bw_type byte, ok bool) {
+	return r.out_bandwidth.get_peer_bandwidth()
+}
+
+func (r *protocol) SetAggregate(max_size int) {
+	if max_size < 0 {
+		max_size = 0
+	}
+	atomic.StoreInt32(&r.out_aggregate_size, int32(max_size))
+}
+
+func (r *protocol) SendQueueStats() (stats SendQueueStats) {
+	return r.msg_out_queue.get_stats()
+}
 
-	r.msg_out_queue <- msg
+func (r *protocol) Stats() (stats Stats) {
+	ctx := r.LogContext()
+	stats.Id, stats.RemoteAddr, stats.State = ctx.Id, ctx.RemoteAddr, ctx.State
+	stats.Vhost, stats.App, stats.Stream = ctx.Vhost, ctx.App, ctx.Stream
+	stats.Created = r.created
+
+	stats.RecvBytes, stats.SendBytes = r.conn.RecvBytes(), r.conn.SendBytes()
+	stats.RecvKbps, stats.SendKbps = r.conn.RecvKbps(), r.conn.SendKbps()
+
+	stats.RecvMessages, stats.RecvFrames = r.recv_stats.get()
+	stats.SendMessages, stats.SendFrames = r.send_stats.get()
+	stats.SendQueue = r.msg_out_queue.get_stats()
+	stats.Rtt = r.Rtt()
 	return
 }
 
 func (r *protocol) on_send_message(pkt Encoder) (err error) {
-	if pkt, ok := pkt.(*SetChunkSizePacket); ok {
-		r.outChunkSize = pkt.ChunkSize
+	r.requests_lock.Lock()
+	defer r.requests_lock.Unlock()
+
+	if pkt, ok := pkt.(*SetWindowAckSizePacket); ok {
+		r.out_bandwidth.on_ack_window(pkt.AcknowledgementWindowSize)
 		return
 	}
 
@@ -437,18 +833,55 @@ func (r *protocol) on_send_message(pkt Encoder) (err error) {
 		r.requests[pkt.TransactionId] = pkt.CommandName
 		return
 	}
+
+	if pkt, ok := pkt.(*FMLEStartPacket); ok {
+		r.requests[pkt.TransactionId] = pkt.CommandName
+		return
+	}
+	return
+}
+
+/**
+* when message sent over connection, in the send goroutine.
+* the chunk size must apply to the messages after the SetChunkSize.
+* the ping request is recorded when sent, the time in queue is not the rtt.
+ */
+func (r *protocol) on_sent_message(msg *Message) (err error) {
+	if msg.Header.IsUserControlMessage() {
+		pkt := NewUserControlPacket()
+		if err = pkt.Decode(NewRtmpStream(msg.Payload)); err != nil {
+			return
+		}
+		if pkt.EventType == PCUCPingRequest {
+			r.keepalive.on_ping(pkt.EventData, time.Now())
+		}
+		return
+	}
+
+	if !msg.Header.IsSetChunkSize() {
+		return
+	}
+
+	pkt := NewSetChunkSizePacket()
+	if err = pkt.Decode(NewRtmpStream(msg.Payload)); err != nil {
+		return
+	}
+	r.outChunkSize = pkt.ChunkSize
+
 	return
 }
 
 func (r *protocol) on_recv_message(msg *Message) (err error) {
-	// acknowledgement
+	// acknowledgement, never return for the SetChunkSize must be applied.
 	if r.inAckSize.ShouldAckRead(r.conn.RecvBytes()) {
-		return r.response_acknowledgement_message()
+		if err = r.response_acknowledgement_message(); err != nil {
+			return
+		}
 	}
 
 	// decode the msg if needed
 	var pkt interface {}
-	if msg.Header.IsSetChunkSize() || msg.Header.IsUserControlMessage() || msg.Header.IsWindowAcknowledgementSize() {
+	if msg.Header.IsSetChunkSize() || msg.Header.IsUserControlMessage() || msg.Header.IsWindowAcknowledgementSize() || msg.Header.IsSetPeerBandwidth() {
 		if pkt, err = r.DecodeMessage(msg); err != nil {
 			return
 		}
@@ -466,17 +899,98 @@ func (r *protocol) on_recv_message(msg *Message) (err error) {
 		return
 	}
 
+	if pkt, ok := pkt.(*SetPeerBandwidthPacket); ok {
+		return r.on_recv_peer_bandwidth(pkt)
+	}
+
+	if pkt, ok := pkt.(*UserControlPacket); ok {
+		return r.on_recv_user_control(pkt)
+	}
+
 	// TODO: FIXME: implements it
 
 	return
 }
 
+/**
+* 5.4.5. Set Peer Bandwidth (6)
+* The peer receiving this message SHOULD respond with a Window
+* Acknowledgement Size message if the window size is different from the
+* last one sent to the sender of this message.
+ */
+func (r *protocol) on_recv_peer_bandwidth(pkt *SetPeerBandwidthPacket) (err error) {
+	window, changed := r.out_bandwidth.on_peer_bandwidth(pkt.Bandwidth, pkt.BandwidthType)
+	r.trace("set peer bandwidth %v, type=%v, window=%v", pkt.Bandwidth, pkt.BandwidthType, window)
+	if !changed {
+		return
+	}
+
+	res := NewSetWindowAckSizePacket()
+	res.AcknowledgementWindowSize = window
+	return r.SendPacket(res, uint32(0))
+}
+
+func (r *protocol) on_recv_user_control(pkt *UserControlPacket) (err error) {
+	if pkt.EventType == PCUCSetBufferLength {
+		r.buffer_lengths_lock.Lock()
+		defer r.buffer_lengths_lock.Unlock()
+
+		r.buffer_lengths[pkt.EventData] = pkt.ExtraData
+		r.trace("set buffer length stream_id=%v, %vms", pkt.EventData, pkt.ExtraData)
+		r.apply_buffer_length(pkt.ExtraData)
+		return
+	}
+
+	return r.on_recv_ping(pkt)
+}
+
+func (r *protocol) BufferLength(stream_id uint32) (length time.Duration, ok bool) {
+	r.buffer_lengths_lock.Lock()
+	defer r.buffer_lengths_lock.Unlock()
+
+	var v uint32
+	if v, ok = r.buffer_lengths[stream_id]; ok {
+		length = time.Duration(v) * time.Millisecond
+	}
+	return
+}
+
+/**
+* convert the done ctx to error, ERROR_SOCKET_TIMEOUT when deadline exceeded,
+* or ERROR_GO_CONTEXT_CANCELED when canceled.
+ */
+func context_error(ctx context.Context) (err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		return Error{code:ERROR_SOCKET_TIMEOUT, desc:"context deadline exceeded"}
+	}
+	return Error{code:ERROR_GO_CONTEXT_CANCELED, desc:"context canceled"}
+}
+
+/**
+* close the stack by the error of ctx when ctx is done, for the handshake
+* or expect bound to ctx is aborted, so the stack is unusable, and the
+* message pump goroutines and connection should never leak.
+* @return the error of ctx when done, otherwise err.
+ */
+func (r *protocol) close_by_context(ctx context.Context, err error) (error) {
+	if ctx.Err() != nil {
+		err = context_error(ctx)
+		r.close(err)
+	}
+	return err
+}
+
 func (r *protocol) HistoryRequestName(transaction_id float64) (request_name string) {
+	r.requests_lock.Lock()
+	defer r.requests_lock.Unlock()
+
 	request_name, _ = r.requests[transaction_id]
 	return
 }
 
 func (r *protocol) recv_interlaced_message() (msg *Message, err error) {
+	defer recover_decode(&err, ERROR_RTMP_MESSAGE_DECODE)
+
 	var format byte
 	var bh_size, mh_size, cid int
 
@@ -488,6 +1002,9 @@ func (r *protocol) recv_interlaced_message() (msg *Message, err error) {
 	// get the cached chunk stream.
 	chunk, ok := r.chunkStreams[cid]
 	if !ok {
+		if err = r.get_limits().check_chunk_streams(len(r.chunkStreams) + 1); err != nil {
+			return
+		}
 		chunk = NewChunkStream(cid)
 		r.chunkStreams[cid] = chunk
 	}
@@ -497,6 +1014,12 @@ func (r *protocol) recv_interlaced_message() (msg *Message, err error) {
 		return
 	}
 
+	if r.log_enabled(LogLevelTrace) {
+		h := chunk.Header
+		r.trace("recv chunk fmt=%v, cid=%v, ts=%v, delta=%v, ext=%v, size=%v, type=%v, sid=%v",
+			format, cid, h.Timestamp, h.TimestampDelta, chunk.ExtendedTimestamp, h.PayloadLength, h.MessageType, h.StreamId)
+	}
+
 	// read msg payload from chunk stream.
 	if msg, err = r.read_message_payload(chunk, bh_size, mh_size); err != nil {
 		return
@@ -654,6 +1177,10 @@ func (r *protocol) read_message_header(chunk *ChunkStream, format byte) (mh_size
 				return
 			}
 
+			if err = r.get_limits().check_message_size(int(chunk.Header.PayloadLength)); err != nil {
+				return
+			}
+
 			chunk.Header.MessageType = r.buffer.ReadByte()
 
 			if format == RTMP_FMT_TYPE0 {
@@ -693,9 +1220,9 @@ func (r *protocol) read_message_header(chunk *ChunkStream, format byte) (mh_size
 		return
 	}
 
-	// copy header to msg
-	copy := *chunk.Header
-	chunk.Msg.Header = &copy
+	// copy header to msg, the header of msg is owned by the partial msg,
+	// so never alloc a new header for each chunk.
+	*chunk.Msg.Header = *chunk.Header
 
 	// increase the msg count, the chunk stream can accept fmt=1/2/3 message now.
 	chunk.MsgCount++
@@ -718,7 +1245,18 @@ func (r *protocol) read_message_payload(chunk *ChunkStream, bh_size int, mh_size
 
 	// create msg payload if not initialized
 	if chunk.Msg.Payload == nil {
-		chunk.Msg.Payload = make([]byte, chunk.Msg.Header.PayloadLength)
+		// the payload is allocated util the message got, check the total size.
+		if err = r.get_limits().check_partial_bytes(r.partial_bytes + int(chunk.Msg.Header.PayloadLength)); err != nil {
+			return
+		}
+		r.partial_bytes += int(chunk.Msg.Header.PayloadLength)
+
+		if atomic.LoadInt32(&r.payload_pool) != 0 {
+			chunk.Msg.payload_ref = alloc_payload(int(chunk.Msg.Header.PayloadLength))
+			chunk.Msg.Payload = chunk.Msg.payload_ref.b
+		} else {
+			chunk.Msg.Payload = make([]byte, chunk.Msg.Header.PayloadLength)
+		}
 	}
 
 	// read payload to buffer
@@ -733,6 +1271,7 @@ func (r *protocol) read_message_payload(chunk *ChunkStream, bh_size int, mh_size
 
 	// got entire RTMP message?
 	if chunk.Msg.ReceivedPayloadLength == len(chunk.Msg.Payload) {
+		r.partial_bytes -= len(chunk.Msg.Payload)
 		msg = chunk.Msg
 		chunk.Msg = nil
 		return
@@ -764,6 +1303,9 @@ func (r *MessageHeader) IsWindowAcknowledgementSize() (bool) {
 func (r *MessageHeader) IsSetChunkSize() (bool) {
 	return r.MessageType == RTMP_MSG_SetChunkSize
 }
+func (r *MessageHeader) IsSetPeerBandwidth() (bool) {
+	return r.MessageType == RTMP_MSG_SetPeerBandwidth
+}
 func (r *MessageHeader) IsUserControlMessage() (bool) {
 	return r.MessageType == RTMP_MSG_UserControlMessage
 }
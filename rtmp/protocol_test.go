@@ -0,0 +1,520 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// create a connected tcp pair over loopback, the server side and client side.
+func new_tcp_pair(t testing.TB) (server *net.TCPConn, client *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP:net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if client, err = net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = l.AcceptTCP(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// do the simple handshake as client.
+func client_simple_handshake(conn net.Conn) (err error) {
+	c0c1 := make([]byte, 1537)
+	c0c1[0] = 0x03
+	if _, err = conn.Write(c0c1); err != nil {
+		return
+	}
+
+	s0s1s2 := make([]byte, 3073)
+	if _, err = io.ReadFull(conn, s0s1s2); err != nil {
+		return
+	}
+
+	_, err = conn.Write(make([]byte, 1536))
+	return
+}
+
+// create a protocol stack which handshake with the client.
+func new_handshaked_protocol(t testing.TB) (p *protocol, client *net.TCPConn) {
+	var conn *net.TCPConn
+	conn, client = new_tcp_pair(t)
+
+	v, err := NewProtocol(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = v.(*protocol)
+
+	hs := make(chan error, 1)
+	go func() {
+		hs <- client_simple_handshake(client)
+	}()
+	if err = p.SimpleHandshake2Client(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <- hs; err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// run f, fail when not completed in timeout.
+func must_complete(t testing.TB, timeout time.Duration, desc string, f func()) {
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <- done:
+	case <- time.After(timeout):
+		t.Fatalf("%v not completed in %v", desc, timeout)
+	}
+}
+
+func assert_error_code(t testing.TB, err error, code int) {
+	if v, ok := err.(Error); !ok || v.code != code {
+		t.Fatalf("expect error code=%v, actual=%v", code, err)
+	}
+}
+
+func TestProtocolDestroyWhenRecvBlocking(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+
+	must_complete(t, 3 * time.Second, "destroy", p.Destroy)
+
+	select {
+	case <- p.Done():
+	default:
+		t.Fatal("done channel should be closed")
+	}
+	assert_error_code(t, p.Err(), ERROR_GO_PROTOCOL_DESTROYED)
+
+	_, err := p.RecvMessage()
+	assert_error_code(t, err, ERROR_GO_PROTOCOL_DESTROYED)
+
+	// the connection is closed by destroy.
+	client.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection should be closed, err=%v", err)
+	}
+
+	// destroy is reentrant.
+	p.Destroy()
+}
+
+func TestProtocolPeerClosed(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer p.Destroy()
+
+	// fmt=0, cid=3, timestamp=0, length=4, type=SetWindowAckSize, stream_id=0
+	chunk := []byte{0x03, 0, 0, 0, 0, 0, 4, RTMP_MSG_WindowAcknowledgementSize, 0, 0, 0, 0, 0, 0x26, 0x25, 0xa0}
+	if _, err := client.Write(chunk); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	must_complete(t, 3 * time.Second, "peer closed", func(){
+		<- p.Done()
+	})
+
+	// the message received before peer closed must not be lost.
+	msg, err := p.RecvMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Header.IsWindowAcknowledgementSize() {
+		t.Fatalf("invalid message type=%v", msg.Header.MessageType)
+	}
+
+	if _, err = p.RecvMessage(); err == nil || err != p.Err() {
+		t.Fatalf("recv should fail by the stack error, err=%v, stack=%v", err, p.Err())
+	}
+}
+
+func TestProtocolDestroyWhenSendBlocking(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+
+	// the peer never read, the send goroutine and the SendMessage will block.
+	sent := make(chan error, 1)
+	go func() {
+		for {
+			if err := p.SendMessage(new_av_message(RTMP_MSG_VideoMessage, 0, make([]byte, 64 * 1024)), 1); err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	must_complete(t, 3 * time.Second, "destroy", p.Destroy)
+
+	select {
+	case err := <- sent:
+		assert_error_code(t, err, ERROR_GO_PROTOCOL_DESTROYED)
+	case <- time.After(3 * time.Second):
+		t.Fatal("the blocking send should fail when destroyed")
+	}
+}
+
+func TestProtocolConcurrentSendDestroy(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+
+	// drop all data sent by server.
+	go io.Copy(io.Discard, client)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				pkt := NewOnBWDonePacket()
+				if err := p.SendPacket(pkt, 0); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	must_complete(t, 3 * time.Second, "destroy", p.Destroy)
+	must_complete(t, 3 * time.Second, "senders quit", wg.Wait)
+}
+
+func TestProtocolRecvTimeout(t *testing.T) {
+	conn, client := new_tcp_pair(t)
+	defer client.Close()
+
+	v, err := NewProtocol(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := v.(*protocol)
+	defer p.Destroy()
+
+	// the timeout applies to the handshake and the recv goroutine.
+	p.SetRecvTimeout(100 * time.Millisecond)
+	go client_simple_handshake(client)
+	if err = p.SimpleHandshake2Client(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the silent peer is dropped by the recv goroutine.
+	must_complete(t, 3 * time.Second, "recv timeout", func(){
+		<- p.Done()
+	})
+	assert_error_code(t, p.Err(), ERROR_SOCKET_TIMEOUT)
+
+	_, err = p.RecvMessage()
+	assert_error_code(t, err, ERROR_SOCKET_TIMEOUT)
+}
+
+func TestProtocolSendTimeout(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+	defer p.Destroy()
+
+	// the peer never read, the write timeout when the socket buffer is full.
+	p.SetSendTimeout(100 * time.Millisecond)
+	go func() {
+		for {
+			if err := p.SendMessage(new_av_message(RTMP_MSG_AMF0DataMessage, 0, make([]byte, 64 * 1024)), 1); err != nil {
+				return
+			}
+		}
+	}()
+
+	must_complete(t, 5 * time.Second, "send timeout", func(){
+		<- p.Done()
+	})
+	assert_error_code(t, p.Err(), ERROR_SOCKET_TIMEOUT)
+}
+
+func TestProtocolRecvMessageContext(t *testing.T) {
+	p, client := new_handshaked_protocol(t)
+	defer client.Close()
+	defer p.Destroy()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	_, err := p.RecvMessageContext(ctx)
+	assert_error_code(t, err, ERROR_SOCKET_TIMEOUT)
+
+	// the stack is alive after the recv aborted, user can recv again.
+	select {
+	case <- p.Done():
+		t.Fatalf("stack closed by recv, %v", p.Err())
+	default:
+	}
+
+	// fmt=0, cid=3, timestamp=0, length=4, type=SetWindowAckSize, stream_id=0
+	chunk := []byte{0x03, 0, 0, 0, 0, 0, 4, RTMP_MSG_WindowAcknowledgementSize, 0, 0, 0, 0, 0, 0x26, 0x25, 0xa0}
+	if _, err = client.Write(chunk); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 3 * time.Second)
+	defer cancel()
+	msg, err := p.RecvMessageContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Header.IsWindowAcknowledgementSize() {
+		t.Fatalf("invalid message type=%v", msg.Header.MessageType)
+	}
+
+	// the expect canceled, the stack is closed and the pump goroutines quit.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50 * time.Millisecond, cancel)
+	var pkt *ConnectAppPacket
+	_, err = p.ExpectPacketContext(ctx, &pkt)
+	assert_error_code(t, err, ERROR_GO_CONTEXT_CANCELED)
+	assert_error_code(t, p.Err(), ERROR_GO_CONTEXT_CANCELED)
+	must_complete(t, 3 * time.Second, "pump goroutines quit", func(){
+		p.msg_io_wait.Wait()
+	})
+}
+
+func TestServerHandshakeContext(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		new_ctx func() (context.Context, context.CancelFunc)
+		code int
+	} {
+		{"canceled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50 * time.Millisecond, cancel)
+			return ctx, cancel
+		}, ERROR_GO_CONTEXT_CANCELED},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50 * time.Millisecond)
+		}, ERROR_SOCKET_TIMEOUT},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server_conn, client_conn := net.Pipe()
+			defer client_conn.Close()
+
+			s, err := NewServer(server_conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Destroy()
+
+			// the client never send c0c1.
+			ctx, cancel := c.new_ctx()
+			defer cancel()
+			must_complete(t, 3 * time.Second, "handshake", func(){
+				err = s.HandshakeContext(ctx)
+			})
+			assert_error_code(t, err, c.code)
+
+			// the server is closed by the error of ctx, the peer got EOF.
+			assert_error_code(t, s.Err(), c.code)
+			must_complete(t, 3 * time.Second, "peer closed", func(){
+				if _, err := client_conn.Read(make([]byte, 1)); err == nil {
+					t.Error("expect peer closed")
+				}
+			})
+		})
+	}
+}
+
+func TestServerIdentifyContext(t *testing.T) {
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		serve_connect(t, s, NewRequest())
+
+		// the client never play or publish.
+		ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+		defer cancel()
+		_, _, err := s.IdentifyClientContext(ctx, 1)
+		for _, err := range []error{err, s.Err()} {
+			if v, ok := err.(Error); !ok || v.Code() != ERROR_SOCKET_TIMEOUT {
+				t.Errorf("expect timeout, actual %v", err)
+			}
+		}
+	})
+	defer close()
+
+	// the server is closed by the deadline, the client got the error.
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+	select {
+	case <-c.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("expect server closed")
+	}
+}
+
+/**
+* the send path before writev, write the header and payload of each chunk
+* by two write syscalls, used as the baseline of benchmark.
+ */
+func legacy_send_message(r *protocol, msg *Message) (err error) {
+	msg.SentPayloadLength = -1
+	for len(msg.Payload) > msg.SentPayloadLength {
+		msg.SentPayloadLength = int(math.Max(0, float64(msg.SentPayloadLength)))
+
+		var real_header []byte
+		if msg.SentPayloadLength <= 0 {
+			pheader := r.outHeaderFmt0.Reset()
+			pheader.WriteByte(0x00 | byte(msg.PerferCid & 0x3F))
+			pheader.WriteUInt24(uint32(msg.Header.Timestamp))
+			pheader.WriteUInt24(msg.Header.PayloadLength).WriteByte(msg.Header.MessageType).WriteUInt32Le(msg.Header.StreamId)
+			real_header = r.outHeaderFmt0.WrittenBytes()
+		} else {
+			pheader := r.outHeaderFmt3.Reset()
+			pheader.WriteByte(0xC0 | byte(msg.PerferCid & 0x3F))
+			real_header = r.outHeaderFmt3.WrittenBytes()
+		}
+
+		if _, err = r.conn.Write(real_header); err != nil {
+			return
+		}
+
+		payload_size := len(msg.Payload) - msg.SentPayloadLength
+		payload_size = int(math.Min(float64(r.outChunkSize), float64(payload_size)))
+		if _, err = r.conn.Write(msg.Payload[msg.SentPayloadLength:msg.SentPayloadLength+payload_size]); err != nil {
+			return
+		}
+		msg.SentPayloadLength += payload_size
+	}
+	return
+}
+
+// get the write syscalls of process, -1 if not supported(linux only).
+func write_syscalls() (int64) {
+	f, err := os.Open("/proc/self/io")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "syscw:") {
+			v, err := strconv.ParseInt(strings.TrimSpace(line[len("syscw:"):]), 10, 64)
+			if err != nil {
+				return -1
+			}
+			return v
+		}
+	}
+	return -1
+}
+
+/**
+* benchmark the send path, for a 100KB keyframe and a batch of 16 audio messages,
+* at the typical chunk sizes, report the throughput and write syscalls per op.
+ */
+func BenchmarkSendMessages(b *testing.B) {
+	cases := []struct {
+		name string
+		count int
+		size int
+		message_type byte
+	}{
+		{"keyframe-100KB", 1, 100 * 1024, RTMP_MSG_VideoMessage},
+		{"audio-16x256B", 16, 256, RTMP_MSG_AudioMessage},
+	}
+
+	for _, c := range cases {
+		for _, chunk_size := range []uint32{128, 4096, 60000} {
+			for _, writev := range []bool{false, true} {
+				path := "legacy"
+				if writev {
+					path = "writev"
+				}
+
+				b.Run(fmt.Sprintf("%v/chunk=%v/%v", c.name, chunk_size, path), func(b *testing.B) {
+					benchmark_send_messages(b, c.count, c.size, c.message_type, chunk_size, writev)
+				})
+			}
+		}
+	}
+}
+
+func benchmark_send_messages(b *testing.B, count int, size int, message_type byte, chunk_size uint32, writev bool) {
+	conn, client := new_tcp_pair(b)
+	defer client.Close()
+	defer conn.Close()
+
+	go io.Copy(io.Discard, client)
+
+	// the protocol without message pump goroutines, send in the benchmark goroutine,
+	// for both paths write the header caches of protocol.
+	p := new_protocol(NewSocket(conn))
+	p.outChunkSize = chunk_size
+
+	msgs := make([]*Message, count)
+	for i := range msgs {
+		msg := new_av_message(message_type, 0, make([]byte, size))
+		msg.Header.StreamId = 1
+		msgs[i] = msg
+	}
+
+	b.SetBytes(int64(count * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	syscalls := write_syscalls()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if writev {
+			err = p.do_send_msg_goroutine_job(msgs)
+		} else {
+			for _, msg := range msgs {
+				if err = legacy_send_message(p, msg); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	if syscalls >= 0 {
+		b.ReportMetric(float64(write_syscalls() - syscalls) / float64(b.N), "syscalls/op")
+	}
+}
@@ -0,0 +1,199 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"testing"
+)
+
+// recv and decode the next command of publish client.
+func recv_publish_command(t *testing.T, s Server) (msg *Message, pkt interface {}) {
+	for {
+		var err error
+		if msg, err = s.Protocol().RecvMessage(); err != nil {
+			t.Errorf("recv command failed, %v", err)
+			return
+		}
+		if !msg.Header.IsAmf0Command() {
+			continue
+		}
+		if pkt, err = s.Protocol().DecodeMessage(msg); err != nil {
+			t.Errorf("decode command failed, %v", err)
+			return
+		}
+		return
+	}
+}
+
+func TestFMLERepublish(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	publish := func(tid float64, stream string) {
+		c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_RELEASE_STREAM, tid, nil, stream))
+		c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_FC_PUBLISH, tid + 1, nil, stream))
+		c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, tid + 2, nil))
+		c.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, tid + 3, nil, stream, "live"))
+		c.send(RTMP_CID_Audio, RTMP_MSG_AudioMessage, 0, 1, aac_sequence_header)
+	}
+	publish(2.0, "livestream")
+	// OBS unpublish when stream key changed.
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_UNPUBLISH, 6.0, nil, "livestream"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_DELETE_STREAM, 7.0, nil, 1.0))
+	publish(8.0, "newstream")
+
+	var streams []string
+	responses := replay_session(t, c.b, 13, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+
+		for i := 0; i < 2; i++ {
+			_, stream, err := s.IdentifyClient(1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			streams = append(streams, stream)
+			if err = s.StartFMLEPublish(1); err != nil {
+				t.Error(err)
+				return
+			}
+			if i > 0 {
+				break
+			}
+
+			// the FCUnpublish, then deleteStream.
+			_, pkt := recv_publish_command(t, s)
+			if pkt, ok := pkt.(*FMLEStartPacket); !ok || pkt.CommandName != AMF0_COMMAND_UNPUBLISH {
+				t.Errorf("expect FCUnpublish, actual %+v", pkt)
+				return
+			} else if err = s.FMLEUnpublish(1, pkt.TransactionId); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, pkt = recv_publish_command(t, s); pkt == nil {
+				return
+			} else if pkt, ok := pkt.(*DeleteStreamPacket); !ok || pkt.StreamId != 1 {
+				t.Errorf("expect deleteStream, actual %+v", pkt)
+				return
+			}
+			if ctx := s.Protocol().LogContext(); ctx.Stream != "" || ctx.State != LogStateIdentify {
+				t.Errorf("log context %+v", ctx)
+			}
+		}
+	})
+
+	if len(streams) != 2 || streams[0] != "livestream" || streams[1] != "newstream" {
+		t.Errorf("streams %v", streams)
+	}
+	assert_responses(t, responses[:8], append(fmle_publish_responses,
+		`cid=5 sid=1 "onFCUnpublish",0,null,{code:"NetStream.Unpublish.Success",description:"Stop publishing stream."}`,
+		`cid=3 sid=0 "_result",6,null,undefined`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Unpublish.Success",description:"Stream is now unpublished.",clientid:"ASAICiss"}`,
+	))
+	assert_responses(t, responses[8:], []string{
+		`cid=3 sid=0 "_result",8,null,undefined`,
+		`cid=3 sid=0 "_result",9,null,undefined`,
+		`cid=3 sid=0 "_result",10,null,1`,
+		fmle_publish_responses[3],
+		fmle_publish_responses[4],
+	})
+}
+
+// the encoder starts publish by FCPublish, without releaseStream.
+func TestFMLEPublishByFCPublish(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_FC_PUBLISH, 2.0, nil, "livestream"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 3.0, nil))
+	c.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 4.0, nil, "livestream", "live"))
+	c.send(RTMP_CID_Audio, RTMP_MSG_AudioMessage, 0, 1, aac_sequence_header)
+
+	var av []conformance_av
+	responses := replay_session(t, c.b, 4, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+		}
+		av = recv_av_messages(t, s, 1)
+	})
+
+	assert_responses(t, responses, []string{
+		`cid=3 sid=0 "_result",2,null,undefined`,
+		`cid=3 sid=0 "_result",3,null,1`,
+		fmle_publish_responses[3],
+		fmle_publish_responses[4],
+	})
+	assert_av_messages(t, av, []conformance_av{{RTMP_MSG_AudioMessage, 0, 1, 4}})
+}
+
+func TestFlashRepublish(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 3.0, nil, "livestream", "live"))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_CLOSE_STREAM, 0.0, nil))
+	// publish again over the created stream.
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 4.0, nil, "newstream", "live"))
+
+	responses := replay_session(t, c.b, 4, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_FlashPublish, "livestream")
+		if err := s.StartFlashPublish(1); err != nil {
+			t.Error(err)
+		}
+
+		if _, pkt := recv_publish_command(t, s); pkt == nil {
+			return
+		} else if _, ok := pkt.(*CloseStreamPacket); !ok {
+			t.Errorf("expect closeStream, actual %+v", pkt)
+			return
+		}
+		if err := s.FlashUnpublish(1); err != nil {
+			t.Error(err)
+		}
+
+		assert_identify(t, s, CLIENT_TYPE_FlashPublish, "newstream")
+		if err := s.StartFlashPublish(1); err != nil {
+			t.Error(err)
+		}
+	})
+
+	publish_start := `cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Publish.Start",description:"Started publishing stream.",clientid:"ASAICiss"}`
+	assert_responses(t, responses, []string{
+		`cid=3 sid=0 "_result",2,null,1`,
+		publish_start,
+		`cid=5 sid=1 "onStatus",0,null,{level:"status",code:"NetStream.Unpublish.Success",description:"Stream is now unpublished.",clientid:"ASAICiss"}`,
+		publish_start,
+	})
+}
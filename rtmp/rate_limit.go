@@ -0,0 +1,213 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+* the token bucket to limit the output rate of connection,
+* the tokens are the bytes, refilled by rate, and the burst is one second of rate.
+* the bytes to send are taken even the tokens not enough, that is, the tokens
+* maybe negative, and the sender wait util the debt is refilled.
+*/
+type token_bucket struct {
+	lock *sync.Mutex
+	// the bytes per second, no limit when 0.
+	rate uint64
+	tokens float64
+	// when the tokens refilled.
+	refilled time.Time
+}
+func new_token_bucket() (*token_bucket) {
+	r := &token_bucket{}
+	r.lock = &sync.Mutex{}
+	return r
+}
+
+// set the rate in bytes per second, the tokens are reset to one second of rate.
+func (r *token_bucket) set_rate(rate uint64, now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.rate == rate {
+		return
+	}
+	r.rate, r.tokens, r.refilled = rate, float64(rate), now
+}
+
+// the bytes to send without wait, and whether the rate is limited.
+func (r *token_bucket) available(now time.Time) (n int, limited bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.rate == 0 {
+		return 0, false
+	}
+
+	tokens := r.tokens
+	if elapsed := now.Sub(r.refilled); elapsed > 0 {
+		tokens += elapsed.Seconds() * float64(r.rate)
+	}
+	if burst := float64(r.rate); tokens > burst {
+		tokens = burst
+	}
+	return int(tokens), true
+}
+
+// take n bytes, return the duration to wait before sending them.
+func (r *token_bucket) take(n int, now time.Time) (wait time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.rate == 0 {
+		return 0
+	}
+
+	// refill the tokens, never exceed the burst.
+	if elapsed := now.Sub(r.refilled); elapsed > 0 {
+		r.tokens += elapsed.Seconds() * float64(r.rate)
+		r.refilled = now
+	}
+	if burst := float64(r.rate); r.tokens > burst {
+		r.tokens = burst
+	}
+
+	if r.tokens -= float64(n); r.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-r.tokens / float64(r.rate) * float64(time.Second))
+}
+
+/**
+* the output bandwidth of connection, the rate set by user,
+* and the Set Peer Bandwidth of peer, @see Protocol.SetSendRate
+*/
+type send_bandwidth struct {
+	lock *sync.Mutex
+	// the kbps set by user, no limit when 0.
+	user_kbps int
+	// whether to limit the rate by peer bandwidth.
+	enforce bool
+	// the limit of peer in effect, in bytes, and the limit type.
+	peer_bandwidth uint32
+	peer_bandwidth_type byte
+	has_peer_bandwidth bool
+	// the window ack size sent to peer.
+	ack_window uint32
+	bucket *token_bucket
+}
+func new_send_bandwidth() (*send_bandwidth) {
+	r := &send_bandwidth{}
+	r.lock = &sync.Mutex{}
+	r.bucket = new_token_bucket()
+	return r
+}
+
+func (r *send_bandwidth) set_user_kbps(kbps int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.user_kbps = kbps
+	r.update_rate()
+}
+
+func (r *send_bandwidth) set_enforce(enforce bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.enforce = enforce
+	r.update_rate()
+}
+
+// the window ack size is sent to peer.
+func (r *send_bandwidth) on_ack_window(size uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.ack_window = size
+}
+
+/**
+* apply the Set Peer Bandwidth of peer.
+* 5.4.5. Set Peer Bandwidth (6)
+* 	0 - Hard: The peer SHOULD limit its output bandwidth to the
+* 	indicated window size.
+* 	1 - Soft: The peer SHOULD limit its output bandwidth to the the
+* 	window indicated in this message or the limit already in effect,
+* 	whichever is smaller.
+* 	2 - Dynamic: If the previous Limit Type was Hard, treat this message
+* 	as though it was marked Hard, otherwise ignore this message.
+* the unknown limit type is ignored.
+* @return the window in effect, and whether it's different from the
+* 	window ack size sent to peer, which should be responsed, the window
+* 	is taken as sent, so the next Set Peer Bandwidth never response it again.
+*/
+func (r *send_bandwidth) on_peer_bandwidth(bandwidth uint32, bw_type byte) (window uint32, changed bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	switch bw_type {
+	case PeerBandwidthHard:
+		r.peer_bandwidth = bandwidth
+	case PeerBandwidthSoft:
+		if !r.has_peer_bandwidth || bandwidth < r.peer_bandwidth {
+			r.peer_bandwidth = bandwidth
+		}
+	case PeerBandwidthDynamic:
+		if !r.has_peer_bandwidth || r.peer_bandwidth_type != PeerBandwidthHard {
+			return r.peer_bandwidth, false
+		}
+		r.peer_bandwidth, bw_type = bandwidth, PeerBandwidthHard
+	default:
+		return r.peer_bandwidth, false
+	}
+	r.peer_bandwidth_type, r.has_peer_bandwidth = bw_type, true
+	r.update_rate()
+
+	if r.peer_bandwidth == r.ack_window {
+		return r.peer_bandwidth, false
+	}
+	r.ack_window = r.peer_bandwidth
+	return r.peer_bandwidth, true
+}
+
+func (r *send_bandwidth) get_peer_bandwidth() (bandwidth uint32, bw_type byte, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.peer_bandwidth, r.peer_bandwidth_type, r.has_peer_bandwidth
+}
+
+// the rate is the lower one of user and peer, in bytes per second,
+// the window of peer is approximated as the bytes per second, @see Protocol.EnforcePeerBandwidth
+func (r *send_bandwidth) update_rate() {
+	rate := uint64(r.user_kbps) * 1000 / 8
+	if peer := uint64(r.peer_bandwidth); r.enforce && r.has_peer_bandwidth && peer > 0 {
+		if rate == 0 || peer < rate {
+			rate = peer
+		}
+	}
+	r.bucket.set_rate(rate, time.Now())
+}
@@ -0,0 +1,189 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := new_token_bucket()
+	if wait := b.take(1 << 20, now); wait != 0 {
+		t.Errorf("expect no limit, wait %v", wait)
+	}
+
+	if _, limited := b.available(now); limited {
+		t.Error("expect not limited")
+	}
+
+	// the burst is one second of rate.
+	b.set_rate(1000, now)
+	if n, limited := b.available(now); n != 1000 || !limited {
+		t.Errorf("expect available 1000, actual %v, limited=%v", n, limited)
+	}
+	if wait := b.take(1000, now); wait != 0 {
+		t.Errorf("expect burst, wait %v", wait)
+	}
+	if wait := b.take(500, now); wait != 500 * time.Millisecond {
+		t.Errorf("expect wait 500ms, actual %v", wait)
+	}
+	if n, _ := b.available(now.Add(time.Second)); n != 500 {
+		t.Errorf("expect available 500 after the debt, actual %v", n)
+	}
+
+	// the debt is refilled, then the tokens never exceed the burst.
+	if wait := b.take(500, now.Add(time.Second)); wait != 0 {
+		t.Errorf("expect refilled, wait %v", wait)
+	}
+	if wait := b.take(1500, now.Add(10 * time.Second)); wait != 500 * time.Millisecond {
+		t.Errorf("expect wait 500ms, actual %v", wait)
+	}
+}
+
+func TestSendBandwidth(t *testing.T) {
+	b := new_send_bandwidth()
+	for i, c := range []struct {
+		bandwidth uint32
+		bw_type byte
+		window uint32
+		changed bool
+	}{
+		// the dynamic is ignored when no hard limit.
+		{2500000, PeerBandwidthDynamic, 0, false},
+		{1000000, PeerBandwidthHard, 1000000, true},
+		// the soft only lower the limit.
+		{2000000, PeerBandwidthSoft, 1000000, false},
+		{500000, PeerBandwidthSoft, 500000, true},
+		// the dynamic is ignored when the last is soft.
+		{800000, PeerBandwidthDynamic, 500000, false},
+		{3000000, PeerBandwidthHard, 3000000, true},
+		// the dynamic is hard when the last is hard.
+		{2000000, PeerBandwidthDynamic, 2000000, true},
+		// the window is taken as sent, never response again.
+		{2000000, PeerBandwidthHard, 2000000, false},
+		// the unknown limit type is ignored.
+		{100000, PeerBandwidthDynamic + 1, 2000000, false},
+	} {
+		window, changed := b.on_peer_bandwidth(c.bandwidth, c.bw_type)
+		if window != c.window || changed != c.changed {
+			t.Errorf("#%v expect window=%v changed=%v, actual window=%v changed=%v", i, c.window, c.changed, window, changed)
+		}
+	}
+	if bandwidth, bw_type, ok := b.get_peer_bandwidth(); bandwidth != 2000000 || bw_type != PeerBandwidthHard || !ok {
+		t.Errorf("peer bandwidth %v, type=%v, ok=%v", bandwidth, bw_type, ok)
+	}
+
+	// the lower of user and enforced peer bandwidth.
+	b.set_user_kbps(8000)
+	if b.bucket.rate != 1000000 {
+		t.Errorf("expect user rate, actual %v", b.bucket.rate)
+	}
+	b.set_enforce(true)
+	if b.on_peer_bandwidth(500000, PeerBandwidthHard); b.bucket.rate != 500000 {
+		t.Errorf("expect peer rate, actual %v", b.bucket.rate)
+	}
+}
+
+func TestSetPeerBandwidthUnknownType(t *testing.T) {
+	// the unknown limit type is decoded, then ignored by the stack.
+	pkt := NewSetPeerBandwidthPacket()
+	if err := pkt.Decode(NewRtmpStream([]byte{0x00, 0x01, 0x86, 0xa0, 0x05})); err != nil {
+		t.Fatal(err)
+	}
+	if pkt.Bandwidth != 100000 || pkt.BandwidthType != 5 {
+		t.Errorf("bandwidth %v, type %v", pkt.Bandwidth, pkt.BandwidthType)
+	}
+
+	p := new_protocol(NewSocket(nil))
+	if err := p.on_recv_peer_bandwidth(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := p.PeerBandwidth(); ok {
+		t.Error("expect the unknown limit type ignored")
+	}
+}
+
+func TestPeerBandwidth(t *testing.T) {
+	const bandwidth = 100000
+	acked := make(chan uint32, 1)
+	elapsed := make(chan time.Duration, 1)
+	tc_url, close := serve_rtmp(t, "live", func(s Server) {
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.SetPeerBandwidth(bandwidth, PeerBandwidthHard); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// the client response the window, and the publish is limited by the bandwidth.
+		var start time.Time
+		for nb_frames := 0; nb_frames < 4; {
+			msg, err := s.Protocol().RecvMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			pkt, _ := s.Protocol().DecodeMessage(msg)
+			if pkt, ok := pkt.(*SetWindowAckSizePacket); ok {
+				acked <- pkt.AcknowledgementWindowSize
+			}
+			if msg.Header.IsVideo() {
+				if nb_frames++; nb_frames == 1 {
+					start = time.Now()
+				}
+			}
+		}
+		elapsed <- time.Since(start)
+	})
+	defer close()
+
+	c := dial_client(t, tc_url)
+	defer c.Destroy()
+	c.Protocol().EnforcePeerBandwidth(true)
+
+	stream_id, err := c.Publish("livestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-acked; v != bandwidth {
+		t.Errorf("expect window %v, actual %v", bandwidth, v)
+	}
+	if v, bw_type, ok := c.Protocol().PeerBandwidth(); v != bandwidth || bw_type != PeerBandwidthHard || !ok {
+		t.Errorf("peer bandwidth %v, type=%v, ok=%v", v, bw_type, ok)
+	}
+
+	// the burst is one second, then 50KB each 500ms.
+	for i := 0; i < 4; i++ {
+		if err = c.Protocol().SendMessage(new_av_message(RTMP_MSG_VideoMessage, uint64(i * 40), conformance_frame(i == 0, 50000)), stream_id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := <-elapsed; v < 900 * time.Millisecond {
+		t.Errorf("expect limited by peer bandwidth, elapsed %v", v)
+	}
+}
@@ -0,0 +1,228 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+/**
+* replay the session to server, the serve runs the server, then destroy the server
+* at once, return all messages got by client until the connection closed.
+ */
+func replay_and_destroy(t *testing.T, session []byte, serve func(s Server)) (responses []string) {
+	server_conn, client_conn := net.Pipe()
+	defer client_conn.Close()
+
+	s, err := NewServer(server_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		if err := replay_handshake(client_conn, session); err != nil {
+			return
+		}
+
+		parser := new_protocol(NewSocket(client_conn))
+		for {
+			msg, err := parser.do_recv_msg_goroutine_job()
+			if err != nil {
+				return
+			}
+			if msg != nil {
+				responses = append(responses, render_message(msg))
+			}
+		}
+	}()
+
+	must_complete(t, 3 * time.Second, "serve", func() {
+		defer s.Destroy()
+		if err := s.Handshake(); err != nil {
+			t.Error(err)
+			return
+		}
+		serve(s)
+	})
+
+	select {
+	case <- done:
+	case <- time.After(3 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	return
+}
+
+// the last response got by client before closed.
+func assert_last_response(t *testing.T, responses []string, expect string) {
+	if len(responses) == 0 || responses[len(responses) - 1] != expect {
+		t.Errorf("expect last response\n%v\nactual %v", expect, responses)
+	}
+}
+
+func TestRejectConnectApp(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+
+	responses := replay_session(t, c.b, 2, func(s Server) {
+		req := NewRequest()
+		if err := s.ConnectApp(req); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := s.RejectConnectApp(req, "invalid token"); err != nil {
+			t.Error(err)
+		}
+		if err := s.RedirectConnectApp(req, "rtmp://192.168.1.12/live"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	assert_responses(t, responses, []string{
+		`cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"invalid token"}`,
+		`cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"RTMP 302 Redirect",ex:{code:302,redirect:"rtmp://192.168.1.12/live"}}`,
+	})
+}
+
+func TestRejectPublish(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_RELEASE_STREAM, 2.0, nil, "livestream"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_FC_PUBLISH, 3.0, nil, "livestream"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 4.0, nil))
+	c.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 5.0, nil, "livestream", "live"))
+
+	responses := replay_session(t, c.b, 4, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.RejectPublish(1, "stream is busy"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	assert_responses(t, responses, []string{
+		fmle_publish_responses[0],
+		fmle_publish_responses[1],
+		fmle_publish_responses[2],
+		`cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Publish.BadName",description:"stream is busy",clientid:"ASAICiss"}`,
+	})
+}
+
+func TestRejectPlay(t *testing.T) {
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	c.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "nostream"))
+
+	responses := replay_session(t, c.b, 2, func(s Server) {
+		if err := s.ConnectApp(NewRequest()); err != nil {
+			t.Error(err)
+			return
+		}
+		assert_identify(t, s, CLIENT_TYPE_Play, "nostream")
+		if err := s.RejectPlay(1, "stream not found"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	assert_responses(t, responses, []string{
+		`cid=3 sid=0 "_result",2,null,1`,
+		`cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Play.StreamNotFound",description:"stream not found",details:"stream",clientid:"ASAICiss"}`,
+	})
+}
+
+func TestRejectThenDestroy(t *testing.T) {
+	connect := new_seed_session()
+	connect.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", "rtmp://127.0.0.1/live")))
+
+	publish := new_seed_session()
+	publish.raw(connect.b[len(publish.b):]...)
+	publish.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	publish.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 3.0, nil, "livestream", "live"))
+
+	play := new_seed_session()
+	play.raw(connect.b[len(play.b):]...)
+	play.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 2.0, nil))
+	play.send(RTMP_CID_OverStream, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PLAY, 3.0, nil, "livestream"))
+
+	// the rejection is written before the connection closed.
+	for i := 0; i < 20; i++ {
+		responses := replay_and_destroy(t, connect.b, func(s Server) {
+			req := NewRequest()
+			if err := s.ConnectApp(req); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := s.RejectConnectApp(req, "invalid token"); err != nil {
+				t.Error(err)
+			}
+		})
+		assert_last_response(t, responses, `cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"invalid token"}`)
+
+		responses = replay_and_destroy(t, connect.b, func(s Server) {
+			req := NewRequest()
+			if err := s.ConnectApp(req); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := s.RedirectConnectApp(req, "rtmp://192.168.1.12/live"); err != nil {
+				t.Error(err)
+			}
+		})
+		assert_last_response(t, responses, `cid=3 sid=0 "_error",1,null,{level:"error",code:"NetConnection.Connect.Rejected",description:"RTMP 302 Redirect",ex:{code:302,redirect:"rtmp://192.168.1.12/live"}}`)
+
+		responses = replay_and_destroy(t, publish.b, func(s Server) {
+			if err := s.ConnectApp(NewRequest()); err != nil {
+				t.Error(err)
+				return
+			}
+			assert_identify(t, s, CLIENT_TYPE_FlashPublish, "livestream")
+			if err := s.RejectPublish(1, "stream is busy"); err != nil {
+				t.Error(err)
+			}
+		})
+		assert_last_response(t, responses, `cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Publish.BadName",description:"stream is busy",clientid:"ASAICiss"}`)
+
+		responses = replay_and_destroy(t, play.b, func(s Server) {
+			if err := s.ConnectApp(NewRequest()); err != nil {
+				t.Error(err)
+				return
+			}
+			assert_identify(t, s, CLIENT_TYPE_Play, "livestream")
+			if err := s.RejectPlay(1, "stream not found"); err != nil {
+				t.Error(err)
+			}
+		})
+		assert_last_response(t, responses, `cid=5 sid=1 "onStatus",0,null,{level:"error",code:"NetStream.Play.StreamNotFound",description:"stream not found",details:"stream",clientid:"ASAICiss"}`)
+	}
+}
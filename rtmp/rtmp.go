@@ -22,17 +22,21 @@
 package rtmp
 
 import (
+	"context"
 	"net"
 	"net/url"
 	"strings"
 	"strconv"
 	"fmt"
+	"time"
 )
 
 const (
 	CodecAMF0 = 0
 	CodecAMF3 = 3
 	DefaultPort = 1935
+	// the default vhost, used when the vhost of request is not configured.
+	DefaultVhost = "__defaultVhost__"
 	// 5.6. Set Peer Bandwidth (6)
 	// the Limit type field:
 	// hard (0), soft (1), or dynamic (2)
@@ -67,9 +71,14 @@ const SCODE_StreamReset = "NetStream.Play.Reset"
 const SCODE_StreamStart = "NetStream.Play.Start"
 const SCODE_StreamPause = "NetStream.Pause.Notify"
 const SCODE_StreamUnpause = "NetStream.Unpause.Notify"
+const SCODE_StreamSeek = "NetStream.Seek.Notify"
+const SCODE_StreamNotFound = "NetStream.Play.StreamNotFound"
+const SCODE_PublishBadName = "NetStream.Publish.BadName"
 const SCODE_PublishStart = "NetStream.Publish.Start"
 const SCODE_DataStart = "NetStream.Data.Start"
 const SCODE_UnpublishSuccess = "NetStream.Unpublish.Success"
+const SCODE_StreamStop = "NetStream.Play.Stop"
+const SCODE_StreamUnpublishNotify = "NetStream.Play.UnpublishNotify"
 
 // FMLE
 const AMF0_COMMAND_ON_FC_PUBLISH = "onFCPublish"
@@ -107,7 +116,23 @@ type Request struct {
 	Vhost string
 	Port string
 	App string
+	// the stream name without params.
 	Stream string
+	/**
+	* the query params of tcUrl, for example, the token of
+	* 	rtmp://ip:port/app?vhost=request_vhost&token=xxx
+	 */
+	Param url.Values
+	/**
+	* the query params of stream name, for example, the key of
+	* 	livestream?key=xxx
+	 */
+	StreamParams url.Values
+	/**
+	* the ids of servers which forwarded the stream, in order,
+	* carried by FORWARD_MARKER of connect object, @see Forwarder
+	 */
+	ForwardedBy []string
 }
 func NewRequest() (*Request) {
 	r := &Request{}
@@ -119,6 +144,19 @@ func NewRequest() (*Request) {
 func (r *Request) StreamUrl() (string) {
 	return fmt.Sprintf("%v/%v/%v", r.Vhost, r.App, r.Stream)
 }
+
+/**
+* parse the stream name of PlayPacket or PublishPacket,
+* set the Stream without params, and the StreamParams.
+* @param stream the stream name with params, for example, "livestream?key=xxx"
+ */
+func (r *Request) ParseStream(stream string) {
+	r.Stream, r.StreamParams = stream, url.Values{}
+	if pos := strings.Index(stream, "?"); pos >= 0 {
+		r.Stream = stream[:pos]
+		r.StreamParams, _ = url.ParseQuery(stream[pos + 1:])
+	}
+}
 func (r *Request) discovery_app() (err error) {
 	// parse ...vhost... to ?vhost=
 	var v string = r.TcUrl
@@ -148,15 +186,14 @@ func (r *Request) discovery_app() (err error) {
 
 	// discovery vhost from query.
 	query := u.Query()
+	r.Param = query
 	for k, _ := range query {
 		if strings.ToLower(k) == "vhost" && query.Get(k) != "" {
 			r.Vhost = query.Get(k)
 		}
 	}
 
-	// resolve the vhost from config
-	// TODO: FIXME: implements it
-	// TODO: discovery the params of vhost.
+	// the vhost is resolved from config by server ConnectApp.
 
 	if r.Schema = strings.Trim(r.Schema, "/\n\r "); r.Schema == ""{
 		return Error{code:ERROR_RTMP_REQ_TCURL, desc:fmt.Sprintf("discovery schema failed. tcUrl=%v", r.TcUrl)}
@@ -183,14 +220,62 @@ type Server interface {
 	 */
 	Destroy()
 	/**
+	* the done channel is closed when the connection is dead,
+	* and Err() to get the error which closed it, @see Protocol.Done()
+	 */
+	Done() (<-chan struct{})
+	Err() (err error)
+	/**
 	* get the underlayer protocol stack sdk.
 	 */
 	Protocol() (Protocol)
 	/**
+	* set the logger of connection, @see Protocol.SetLogger()
+	* the log context is updated by server, the vhost/app/stream and state.
+	 */
+	SetLogger(logger Logger)
+	/**
+	* get the stats of connection, @see Protocol.Stats()
+	 */
+	Stats() (stats Stats)
+	/**
+	* set the keepalive by ping, @see Protocol.SetKeepalive()
+	 */
+	SetKeepalive(interval time.Duration, max_missed int)
+	/**
+	* set the authenticator, invoked by ConnectApp, StartPlay and Start*Publish,
+	* which reject the client by RejectConnectApp, RejectPlay and RejectPublish,
+	* and return the error of authenticator. nil to disable the auth.
+	* for example, SetAuthenticator(NewStaticKeyAuthenticator("key", "secret"))
+	 */
+	SetAuthenticator(auth Authenticator)
+	/**
+	* set the config of server, the vhost is resolved by ConnectApp,
+	* the DefaultVhost is used when vhost not configured, and reject the client
+	* with ERROR_RTMP_VHOST_NOT_FOUND when both not found.
+	* the ConnectApp sends the ack window and peer bandwidth of vhost, and set the
+	* default chunk size, user should not set them again when configured.
+	* the StartPlay and StartXXXPublish reject the client type not allowed by vhost.
+	* nil to ignore the config.
+	* @remark user should set the config before ConnectApp, for example,
+	* 		the ConfigFile.Config() for the new connection.
+	 */
+	SetConfig(c *Config)
+	/**
+	* get the vhost config resolved by ConnectApp, nil when no config,
+	* for example, the AppConfig of req.App.
+	 */
+	Vhost() (*VhostConfig)
+	/**
 	* handshake with client, try complex handshake first, use simple if failed.
 	 */
 	Handshake() (err error)
 	/**
+	* handshake with ctx, which failed with ERROR_SOCKET_TIMEOUT when ctx deadline exceeded,
+	* or ERROR_GO_CONTEXT_CANCELED when ctx canceled, and the server is closed by the error.
+	 */
+	HandshakeContext(ctx context.Context) (err error)
+	/**
 	* expect client send the connect app request,
 	* @param req set and parse data to the request
 	 */
@@ -207,6 +292,20 @@ type Server interface {
 	 */
 	SetPeerBandwidth(bandwidth uint32, bw_type byte) (err error)
 	/**
+	* set the output chunk size, send SetChunkSize to client,
+	* the messages sent after it use the new chunk size.
+	* @param chunk_size in [RTMP_MIN_CHUNK_SIZE, RTMP_MAX_CHUNK_SIZE], for example, 4096
+	* @remark it's protocol control message, maybe sent before the queued commands,
+	* 		which are chunked by the new size also.
+	 */
+	SetChunkSize(chunk_size uint32) (err error)
+	/**
+	* set the default output chunk size of server,
+	* which is sent right after ReponseConnectApp, ignore if 0.
+	* @param chunk_size in [RTMP_MIN_CHUNK_SIZE, RTMP_MAX_CHUNK_SIZE], for example, 60000
+	 */
+	SetDefaultChunkSize(chunk_size uint32) (err error)
+	/**
 	* response the client connect app request
 	* @param req the request data genereated by ConnectApp
 	* @param server_ip the ip of server to send to client, ignore if "".
@@ -217,6 +316,21 @@ type Server interface {
 	 */
 	ReponseConnectApp(req *Request, server_ip string, extra_data []map[string]string) (err error)
 	/**
+	* reject the client connect app request, for example, the auth failed,
+	* send _error(NetConnection.Connect.Rejected) with the reason as description,
+	* it returns when the response is written, then user can close the connection.
+	* @param req the request data genereated by ConnectApp
+	* @param reason the description to client, for example, "invalid token"
+	 */
+	RejectConnectApp(req *Request, reason string) (err error)
+	/**
+	* redirect the client to another server, the client should connect to the tc_url,
+	* send _error(NetConnection.Connect.Rejected) with ex.code=302 and ex.redirect=tc_url.
+	* @param tc_url the tcUrl to redirect to, for example, "rtmp://192.168.1.12/live"
+	* @remark it returns when the response is written, then user can close the connection.
+	 */
+	RedirectConnectApp(req *Request, tc_url string) (err error)
+	/**
 	* call client onBWDone() method
 	 */
 	CallOnBWDone() (err error)
@@ -227,23 +341,84 @@ type Server interface {
 	* 		CLIENT_TYPE_FMLEPublish the client is publish client use FMLE schema, for example, the adobe FMLE
 	* 		CLIENT_TYPE_FlashPublish the client is publish client use Flash schema, for example, the Flash publish.
 	* @param stream_id the stream id used to response the CreateStream() request
+	* @return the stream_name with params, the Request of ConnectApp is updated by
+	* 		Request.ParseStream(stream_name), @see Request.Stream and Request.StreamParams
 	 */
 	IdentifyClient(stream_id uint32) (client_type string, stream_name string, err error)
 	/**
+	* identify the client with ctx, @see IdentifyClient and HandshakeContext
+	* @remark the server is closed by the error of ctx when canceled or deadline exceeded.
+	 */
+	IdentifyClientContext(ctx context.Context, stream_id uint32) (client_type string, stream_name string, err error)
+	/**
 	* start the play/publish stream service engine
 	 */
 	StartPlay(stream_id uint32) (err error)
 	StartFlashPublish(stream_id uint32) (err error)
 	StartFMLEPublish(stream_id uint32) (err error)
 	/**
-	* send a ping request to client.
+	* reject the identified publish client, send onStatus(NetStream.Publish.BadName),
+	* for the FMLE client, the FCPublish, createStream and publish are responsed before it.
+	* it returns when the response is written, then user can close the connection.
+	* @param reason the description to client, for example, "stream is busy"
+	 */
+	RejectPublish(stream_id uint32, reason string) (err error)
+	/**
+	* reject the identified play client, send onStatus(NetStream.Play.StreamNotFound),
+	* it returns when the response is written, then user can close the connection.
+	 */
+	RejectPlay(stream_id uint32, reason string) (err error)
+	/**
+	* response the FCUnpublish of FMLE publish client,
+	* send onFCUnpublish(NetStream.Unpublish.Success), the _result and onStatus(NetStream.Unpublish.Success).
+	* user can IdentifyClient again, for the client may republish without reconnect,
+	* for example, OBS sends FCUnpublish, deleteStream, then releaseStream to publish again.
+	* @param unpublish_tid the transaction id of FCUnpublish, the FMLEStartPacket.TransactionId
+	 */
+	FMLEUnpublish(stream_id uint32, unpublish_tid float64) (err error)
+	/**
+	* response the closeStream of flash publish client,
+	* send onStatus(NetStream.Unpublish.Success), user can IdentifyClient again.
+	 */
+	FlashUnpublish(stream_id uint32) (err error)
+	/**
+	* notify the player the end of stream, for example, the end of VOD file,
+	* send the StreamEOF event and onStatus(NetStream.Play.Stop).
+	 */
+	StreamEOF(stream_id uint32) (err error)
+	/**
+	* notify the player no more data, for example, the publisher gone idle or unpublished,
+	* send the StreamDry event and onStatus(NetStream.Play.UnpublishNotify).
+	 */
+	StreamDry(stream_id uint32) (err error)
+	/**
+	* notify the player the stream is recorded, for example, the VOD file,
+	* send the StreamIsRecorded event, generally before StartPlay.
+	 */
+	StreamIsRecorded(stream_id uint32) (err error)
+	/**
+	* response the PausePacket of play client,
+	* when pause, send onStatus(NetStream.Pause.Notify) and StreamEOF,
+	* when unpause, send onStatus(NetStream.Unpause.Notify) and StreamBegin.
+	* @param is_pause the PausePacket.IsPause
+	 */
+	OnPlayPause(stream_id uint32, is_pause bool) (err error)
+	/**
+	* response the SeekPacket of play client, send onStatus(NetStream.Seek.Notify),
+	* then the StreamBegin and onStatus(NetStream.Play.Reset/Start) as StartPlay.
+	* @param milliseconds the SeekPacket.Milliseconds
+	 */
+	OnPlaySeek(stream_id uint32, milliseconds float64) (err error)
+	/**
+	* send a ping request to client, the ping response updates the Protocol.Rtt().
 	* @param timestamp the timestamp in seconds. for example, uint32(time.Now().Unix())
 	 */
 	Ping(timestamp uint32) (err error)
 }
-func NewServer(conn *net.TCPConn) (Server, error) {
+func NewServer(conn net.Conn) (Server, error) {
 	var err error
 	r := &server{}
+	r.req = NewRequest()
 	if r.protocol, err = NewProtocol(conn); err != nil {
 		return r, err
 	}
@@ -252,23 +427,92 @@ func NewServer(conn *net.TCPConn) (Server, error) {
 
 type server struct {
 	protocol Protocol
+	// the default out chunk size, sent after connect app response, 0 to ignore.
+	default_chunk_size uint32
+	// the CLIENT_TYPE_* identified, the last one when client republish.
+	client_type string
+	// the FCPublish is identified and responsed, the FMLE publish never expect it.
+	fc_published bool
+	// the request of ConnectApp, the stream is parsed when identified.
+	req *Request
+	// the authenticator, nil to disable.
+	auth Authenticator
+	// the config of server, nil to ignore.
+	config *Config
+	// the vhost config resolved by ConnectApp, nil when no config.
+	vhost *VhostConfig
 }
 
 func (r *server) Destroy() {
 	r.protocol.Destroy()
 }
 
+func (r *server) Done() (<-chan struct{}) {
+	return r.protocol.Done()
+}
+
+func (r *server) Err() (err error) {
+	return r.protocol.Err()
+}
+
 func (r *server) Protocol() (Protocol) {
 	return r.protocol
 }
 
+func (r *server) SetLogger(logger Logger) {
+	r.protocol.SetLogger(logger)
+}
+
+func (r *server) SetAuthenticator(auth Authenticator) {
+	r.auth = auth
+}
+
+func (r *server) SetConfig(c *Config) {
+	r.config = c
+}
+
+func (r *server) Vhost() (*VhostConfig) {
+	return r.vhost
+}
+
+func (r *server) Stats() (stats Stats) {
+	return r.protocol.Stats()
+}
+
+func (r *server) SetKeepalive(interval time.Duration, max_missed int) {
+	r.protocol.SetKeepalive(interval, max_missed)
+}
+
+// update the state of log context.
+func (r *server) update_state(state string) {
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.State = state
+	})
+}
+
+// log info with the context of connection.
+func (r *server) info(format string, v ...interface {}) {
+	r.protocol.(*protocol).info(format, v...)
+}
+
+// log warn with the context of connection.
+func (r *server) warn(format string, v ...interface {}) {
+	r.protocol.(*protocol).warn(format, v...)
+}
+
 func (r *server) Handshake() (err error) {
+	return r.HandshakeContext(context.Background())
+}
+
+func (r *server) HandshakeContext(ctx context.Context) (err error) {
 	// TODO: FIXME: try complex then simple handshake.
-	err = r.protocol.SimpleHandshake2Client()
+	err = r.protocol.SimpleHandshake2ClientContext(ctx)
 	return
 }
 
 func (r *server) ConnectApp(req *Request) (err error) {
+	r.update_state(LogStateConnect)
+
 	//var msg *Message
 	var pkt *ConnectAppPacket
 	if _, err = r.protocol.ExpectPacket(&pkt); err != nil {
@@ -289,8 +533,67 @@ func (r *server) ConnectApp(req *Request) (err error) {
 	if v, ok := pkt.CommandObject.GetPropertyNumber("objectEncoding"); ok {
 		req.ObjectEncoding = int(v)
 	}
+	if v, ok := pkt.CommandObject.GetPropertyString(FORWARD_MARKER); ok && v != "" {
+		req.ForwardedBy = strings.Split(v, ",")
+	}
+
+	if err = req.discovery_app(); err != nil {
+		return
+	}
+	r.req = req
 
-	return req.discovery_app()
+	if r.config != nil {
+		if r.vhost = r.config.Vhost(req.Vhost); r.vhost == nil {
+			err = Error{code:ERROR_RTMP_VHOST_NOT_FOUND, desc:fmt.Sprintf("vhost %v not found", req.Vhost)}
+			if err := r.RejectConnectApp(req, "vhost not found"); err != nil {
+				return err
+			}
+			return
+		}
+		req.Vhost = r.vhost.Name
+	}
+
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.Vhost, ctx.App = req.Vhost, req.App
+	})
+	r.info("connect app, tcUrl=%v, pageUrl=%v, swfUrl=%v, objectEncoding=%v", req.TcUrl, req.PageUrl, req.SwfUrl, req.ObjectEncoding)
+
+	if r.vhost != nil {
+		if err = r.apply_vhost(r.vhost); err != nil {
+			return
+		}
+	}
+
+	if r.auth == nil {
+		return
+	}
+	if err = r.auth.OnConnect(req); err != nil {
+		if err := r.RejectConnectApp(req, auth_error_desc(err)); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// apply the config of vhost, send the ack window and peer bandwidth, set the chunk size and send rate.
+func (r *server) apply_vhost(vhost *VhostConfig) (err error) {
+	if vhost.AckWindow > 0 {
+		if err = r.SetWindowAckSize(vhost.AckWindow); err != nil {
+			return
+		}
+	}
+	if vhost.PeerBandwidth > 0 {
+		if err = r.SetPeerBandwidth(vhost.PeerBandwidth, vhost.PeerBandwidthType); err != nil {
+			return
+		}
+	}
+	if vhost.ChunkSize > 0 {
+		r.default_chunk_size = vhost.ChunkSize
+	}
+	if vhost.SendRate > 0 {
+		r.protocol.SetSendRate(int(vhost.SendRate))
+	}
+	return
 }
 
 func (r *server) SetWindowAckSize(ack_size uint32) (err error) {
@@ -303,6 +606,27 @@ func (r *server) SetPeerBandwidth(bandwidth uint32, bw_type byte) (err error) {
 	return r.protocol.SendPacket(&pkt, uint32(0))
 }
 
+func (r *server) SetChunkSize(chunk_size uint32) (err error) {
+	if err = ValidateChunkSize(chunk_size); err != nil {
+		return
+	}
+
+	pkt := NewSetChunkSizePacket()
+	pkt.ChunkSize = chunk_size
+	return r.protocol.SendPacket(pkt, uint32(0))
+}
+
+func (r *server) SetDefaultChunkSize(chunk_size uint32) (err error) {
+	if chunk_size != 0 {
+		if err = ValidateChunkSize(chunk_size); err != nil {
+			return
+		}
+	}
+
+	r.default_chunk_size = chunk_size
+	return
+}
+
 func (r *server) ReponseConnectApp(req *Request, server_ip string, extra_data []map[string]string) (err error) {
 	data := NewAmf0EcmaArray()
 	data.Set("version", NewAmf0(SIG_FMS_VER))
@@ -320,7 +644,45 @@ func (r *server) ReponseConnectApp(req *Request, server_ip string, extra_data []
 	pkt.InfoSet(SLEVEL, SLEVEL_Status).InfoSet(SCODE, SCODE_ConnectSuccess).InfoSet(SDESC, "Connection succeeded")
 	pkt.InfoSet("objectEncoding", float64(req.ObjectEncoding)).InfoSet("data", data)
 
-	return r.protocol.SendPacket(pkt, uint32(0))
+	if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+		return
+	}
+
+	// set the default out chunk size.
+	if r.default_chunk_size > 0 {
+		if err = r.SetChunkSize(r.default_chunk_size); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (r *server) RejectConnectApp(req *Request, reason string) (err error) {
+	r.warn("reject connect app, tcUrl=%v, %v", req.TcUrl, reason)
+
+	pkt := NewConnectAppErrorPacket()
+	pkt.InfoSet(SLEVEL, SLEVEL_Error).InfoSet(SCODE, SCODE_ConnectRejected).InfoSet(SDESC, reason)
+	if err = r.protocol.SendPacketSync(pkt, uint32(0)); err != nil {
+		return
+	}
+	return
+}
+
+func (r *server) RedirectConnectApp(req *Request, tc_url string) (err error) {
+	r.info("redirect connect app, tcUrl=%v, to %v", req.TcUrl, tc_url)
+
+	ex := NewAmf0Object()
+	ex.Set("code", NewAmf0(float64(302)))
+	ex.Set("redirect", NewAmf0(tc_url))
+
+	pkt := NewConnectAppErrorPacket()
+	pkt.InfoSet(SLEVEL, SLEVEL_Error).InfoSet(SCODE, SCODE_ConnectRejected).InfoSet(SDESC, "RTMP 302 Redirect")
+	pkt.InfoSet("ex", ex)
+	if err = r.protocol.SendPacketSync(pkt, uint32(0)); err != nil {
+		return
+	}
+	return
 }
 
 func (r *server) CallOnBWDone() (err error) {
@@ -329,10 +691,23 @@ func (r *server) CallOnBWDone() (err error) {
 }
 
 func (r *server) IdentifyClient(stream_id uint32) (client_type string, stream_name string, err error) {
+	return r.IdentifyClientContext(context.Background(), stream_id)
+}
+
+func (r *server) IdentifyClientContext(ctx context.Context, stream_id uint32) (client_type string, stream_name string, err error) {
+	r.update_state(LogStateIdentify)
+	defer func() {
+		if err == nil {
+			r.on_identified(client_type, stream_name)
+		} else {
+			err = r.protocol.(*protocol).close_by_context(ctx, err)
+		}
+	}()
+
 	client_type = CLIENT_TYPE_Unknown
 	for {
 		var msg *Message
-		if msg, err = r.protocol.RecvMessage(); err != nil {
+		if msg, err = r.protocol.RecvMessageContext(ctx); err != nil {
 			return
 		}
 
@@ -346,18 +721,31 @@ func (r *server) IdentifyClient(stream_id uint32) (client_type string, stream_na
 		}
 
 		if pkt, ok := pkt.(*CreateStreamPacket); ok {
-			return r.identify_create_stream_client(pkt, stream_id)
+			return r.identify_create_stream_client(ctx, pkt, stream_id)
 		}
-		if pkt, ok := pkt.(*FMLEStartPacket); ok {
+		// the FMLE publish starts by releaseStream or FCPublish, ignore the FCUnpublish of last publish.
+		if pkt, ok := pkt.(*FMLEStartPacket); ok && pkt.CommandName != AMF0_COMMAND_UNPUBLISH {
 			return r.identify_fmle_publish_client(pkt)
 		}
 		if pkt, ok := pkt.(*PlayPacket); ok {
 			return r.identify_play_client(pkt)
 		}
+		// the flash republish over the created stream.
+		if pkt, ok := pkt.(*PublishPacket); ok {
+			return r.identify_flash_publish_client(pkt)
+		}
 	}
 	return
 }
-func (r *server) identify_create_stream_client(req *CreateStreamPacket, stream_id uint32) (client_type string, stream_name string, err error) {
+func (r *server) on_identified(client_type string, stream_name string) {
+	r.client_type = client_type
+	r.req.ParseStream(stream_name)
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.Stream = r.req.Stream
+	})
+	r.info("identify client, type=%v, stream=%v", client_type, stream_name)
+}
+func (r *server) identify_create_stream_client(ctx context.Context, req *CreateStreamPacket, stream_id uint32) (client_type string, stream_name string, err error) {
 	pkt := NewCreateStreamResPacket(req.TransactionId, float64(stream_id))
 	if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
 		return
@@ -365,7 +753,7 @@ func (r *server) identify_create_stream_client(req *CreateStreamPacket, stream_i
 
 	for {
 		var msg *Message
-		if msg, err = r.protocol.RecvMessage(); err != nil {
+		if msg, err = r.protocol.RecvMessageContext(ctx); err != nil {
 			return
 		}
 
@@ -400,8 +788,9 @@ func (r *server) identify_flash_publish_client(req *PublishPacket) (client_type
 func (r *server) identify_fmle_publish_client(req *FMLEStartPacket) (client_type string, stream_name string, err error) {
 	client_type = CLIENT_TYPE_FMLEPublish
 	stream_name = req.StreamName
+	r.fc_published = req.CommandName == AMF0_COMMAND_FC_PUBLISH
 
-	// releaseStream response
+	// releaseStream or FCPublish response
 	if (true) {
 		pkt := NewFMLEStartResPacket(req.TransactionId)
 		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
@@ -412,6 +801,18 @@ func (r *server) identify_fmle_publish_client(req *FMLEStartPacket) (client_type
 }
 
 func (r *server) StartPlay(stream_id uint32) (err error) {
+	if err = r.auth_play(stream_id); err != nil {
+		return
+	}
+
+	r.update_state(LogStatePlay)
+	r.info("start play, stream_id=%v", stream_id)
+
+	return r.response_play(stream_id)
+}
+
+// response the play or seek, the StreamBegin and onStatus.
+func (r *server) response_play(stream_id uint32) (err error) {
 	// StreamBegin
 	if true {
 		pkt := &UserControlPacket{EventType:PCUCStreamBegin, EventData:stream_id}
@@ -460,6 +861,13 @@ func (r *server) StartPlay(stream_id uint32) (err error) {
 }
 
 func (r *server) StartFlashPublish(stream_id uint32) (err error) {
+	if err = r.auth_publish(stream_id); err != nil {
+		return
+	}
+
+	r.update_state(LogStatePublish)
+	r.info("start flash publish, stream_id=%v", stream_id)
+
 	// publish response onStatus(NetStream.Publish.Start)
 	if true {
 		pkt := NewOnStatusCallPacket()
@@ -473,9 +881,44 @@ func (r *server) StartFlashPublish(stream_id uint32) (err error) {
 }
 
 func (r *server) StartFMLEPublish(stream_id uint32) (err error) {
+	if err = r.fmle_publish_requests(stream_id); err != nil {
+		return
+	}
+	if err = r.auth_publish(stream_id); err != nil {
+		return
+	}
+
+	r.update_state(LogStatePublish)
+	r.info("start FMLE publish, stream_id=%v", stream_id)
+
+	// publish response onFCPublish(NetStream.Publish.Start)
+	if true {
+		pkt := NewOnStatusCallPacket()
+		pkt.CommandName = AMF0_COMMAND_ON_FC_PUBLISH
+		pkt.Set(SCODE, SCODE_PublishStart).Set(SDESC, "Started publishing stream.")
+		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+			return
+		}
+	}
+	// publish response onStatus(NetStream.Publish.Start)
+	if true {
+		pkt := NewOnStatusCallPacket()
+		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_PublishStart).Set(SDESC, "Started publishing stream.").Set(SCLIENT_ID, SIG_CLIENT_ID)
+		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+/**
+* the FCPublish, createStream and publish requests of FMLE, before the publish response.
+* the FCPublish is not expected when the client is identified by it.
+ */
+func (r *server) fmle_publish_requests(stream_id uint32) (err error) {
 	// FCPublish
 	var fc_publish_tid float64
-	if true {
+	if !r.fc_published {
 		var pkt *FMLEStartPacket
 		if _, err = r.protocol.ExpectPacket(&pkt); err != nil {
 			return
@@ -483,7 +926,7 @@ func (r *server) StartFMLEPublish(stream_id uint32) (err error) {
 		fc_publish_tid = pkt.TransactionId
 	}
 	// FCPublish response
-	if (true) {
+	if !r.fc_published {
 		pkt := NewFMLEStartResPacket(fc_publish_tid)
 		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
 			return
@@ -514,19 +957,169 @@ func (r *server) StartFMLEPublish(stream_id uint32) (err error) {
 			return
 		}
 	}
-	// publish response onFCPublish(NetStream.Publish.Start)
+	return
+}
+
+func (r *server) FMLEUnpublish(stream_id uint32, unpublish_tid float64) (err error) {
+	r.info("FMLE unpublish, stream_id=%v", stream_id)
+	defer r.on_unpublished()
+
+	// publish response onFCUnpublish(NetStream.Unpublish.Success)
 	if true {
 		pkt := NewOnStatusCallPacket()
-		pkt.CommandName = AMF0_COMMAND_ON_FC_PUBLISH
-		pkt.Set(SCODE, SCODE_PublishStart).Set(SDESC, "Started publishing stream.")
+		pkt.CommandName = AMF0_COMMAND_ON_FC_UNPUBLISH
+		pkt.Set(SCODE, SCODE_UnpublishSuccess).Set(SDESC, "Stop publishing stream.")
 		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
 			return
 		}
 	}
-	// publish response onStatus(NetStream.Publish.Start)
+	// FCUnpublish response
+	if true {
+		pkt := NewFMLEStartResPacket(unpublish_tid)
+		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+			return
+		}
+	}
+	// publish response onStatus(NetStream.Unpublish.Success)
 	if true {
 		pkt := NewOnStatusCallPacket()
-		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_PublishStart).Set(SDESC, "Started publishing stream.").Set(SCLIENT_ID, SIG_CLIENT_ID)
+		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_UnpublishSuccess).Set(SDESC, "Stream is now unpublished.").Set(SCLIENT_ID, SIG_CLIENT_ID)
+		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *server) FlashUnpublish(stream_id uint32) (err error) {
+	r.info("flash unpublish, stream_id=%v", stream_id)
+	defer r.on_unpublished()
+
+	// publish response onStatus(NetStream.Unpublish.Success)
+	pkt := NewOnStatusCallPacket()
+	pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_UnpublishSuccess).Set(SDESC, "Stream is now unpublished.").Set(SCLIENT_ID, SIG_CLIENT_ID)
+	if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+		return
+	}
+	return
+}
+
+// the stream is unpublished, the client maybe identify again.
+func (r *server) on_unpublished() {
+	r.protocol.UpdateLogContext(func(ctx *LogContext) {
+		ctx.Stream = ""
+		ctx.State = LogStateIdentify
+	})
+}
+
+// check the client type allowed by vhost, and auth the play client, reject it when failed.
+func (r *server) auth_play(stream_id uint32) (err error) {
+	if err = r.check_client_type(); err == nil && r.auth != nil {
+		err = r.auth.OnPlay(r.req)
+	}
+	if err != nil {
+		if err := r.RejectPlay(stream_id, auth_error_desc(err)); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// check the client type allowed by vhost, and auth the publish client, reject it when failed.
+func (r *server) auth_publish(stream_id uint32) (err error) {
+	if err = r.check_client_type(); err == nil && r.auth != nil {
+		err = r.auth.OnPublish(r.req)
+	}
+	if err != nil {
+		if err := r.reject_publish(stream_id, auth_error_desc(err)); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// check whether the identified client type is allowed by vhost.
+func (r *server) check_client_type() (err error) {
+	if r.vhost == nil || r.vhost.AllowClient(r.client_type) {
+		return
+	}
+	return Error{code:ERROR_RTMP_ACCESS_DENIED, desc:fmt.Sprintf("client type %v not allowed", r.client_type)}
+}
+
+func (r *server) RejectPublish(stream_id uint32, reason string) (err error) {
+	if r.client_type == CLIENT_TYPE_FMLEPublish {
+		if err = r.fmle_publish_requests(stream_id); err != nil {
+			return
+		}
+	}
+	return r.reject_publish(stream_id, reason)
+}
+
+// response the publish request with onStatus(NetStream.Publish.BadName)
+func (r *server) reject_publish(stream_id uint32, reason string) (err error) {
+	r.warn("reject publish, stream_id=%v, %v", stream_id, reason)
+
+	// publish response onStatus(NetStream.Publish.BadName)
+	pkt := NewOnStatusCallPacket()
+	pkt.Set(SLEVEL, SLEVEL_Error).Set(SCODE, SCODE_PublishBadName).Set(SDESC, reason).Set(SCLIENT_ID, SIG_CLIENT_ID)
+	if err = r.protocol.SendPacketSync(pkt, stream_id); err != nil {
+		return
+	}
+	return
+}
+
+func (r *server) RejectPlay(stream_id uint32, reason string) (err error) {
+	r.warn("reject play, stream_id=%v, %v", stream_id, reason)
+
+	// play response onStatus(NetStream.Play.StreamNotFound)
+	pkt := NewOnStatusCallPacket()
+	pkt.Set(SLEVEL, SLEVEL_Error).Set(SCODE, SCODE_StreamNotFound).Set(SDESC, reason)
+	pkt.Set(SDETAILS, "stream").Set(SCLIENT_ID, SIG_CLIENT_ID)
+	if err = r.protocol.SendPacketSync(pkt, stream_id); err != nil {
+		return
+	}
+	return
+}
+
+func (r *server) StreamEOF(stream_id uint32) (err error) {
+	r.info("stream eof, stream_id=%v", stream_id)
+
+	// StreamEOF
+	if true {
+		pkt := &UserControlPacket{EventType:PCUCStreamEOF, EventData:stream_id}
+		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+			return
+		}
+	}
+
+	// onStatus(NetStream.Play.Stop)
+	if true {
+		pkt := NewOnStatusCallPacket()
+		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_StreamStop).Set(SDESC, "Stopped playing stream.")
+		pkt.Set(SDETAILS, "stream").Set(SCLIENT_ID, SIG_CLIENT_ID)
+		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *server) StreamDry(stream_id uint32) (err error) {
+	r.info("stream dry, stream_id=%v", stream_id)
+
+	// StreamDry
+	if true {
+		pkt := &UserControlPacket{EventType:PCUCStreamDry, EventData:stream_id}
+		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+			return
+		}
+	}
+
+	// onStatus(NetStream.Play.UnpublishNotify)
+	if true {
+		pkt := NewOnStatusCallPacket()
+		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_StreamUnpublishNotify).Set(SDESC, "The stream is now unpublished.")
+		pkt.Set(SDETAILS, "stream").Set(SCLIENT_ID, SIG_CLIENT_ID)
 		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
 			return
 		}
@@ -534,6 +1127,74 @@ func (r *server) StartFMLEPublish(stream_id uint32) (err error) {
 	return
 }
 
+func (r *server) StreamIsRecorded(stream_id uint32) (err error) {
+	// StreamIsRecorded
+	pkt := &UserControlPacket{EventType:PCUCStreamIsRecorded, EventData:stream_id}
+	if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+		return
+	}
+	return
+}
+
+func (r *server) OnPlayPause(stream_id uint32, is_pause bool) (err error) {
+	r.info("play pause=%v, stream_id=%v", is_pause, stream_id)
+
+	if is_pause {
+		// onStatus(NetStream.Pause.Notify)
+		if true {
+			pkt := NewOnStatusCallPacket()
+			pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_StreamPause).Set(SDESC, "Paused stream.")
+			if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+				return
+			}
+		}
+
+		// StreamEOF
+		if true {
+			pkt := &UserControlPacket{EventType:PCUCStreamEOF, EventData:stream_id}
+			if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	// onStatus(NetStream.Unpause.Notify)
+	if true {
+		pkt := NewOnStatusCallPacket()
+		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_StreamUnpause).Set(SDESC, "Unpaused stream.")
+		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+			return
+		}
+	}
+
+	// StreamBegin
+	if true {
+		pkt := &UserControlPacket{EventType:PCUCStreamBegin, EventData:stream_id}
+		if err = r.protocol.SendPacket(pkt, uint32(0)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *server) OnPlaySeek(stream_id uint32, milliseconds float64) (err error) {
+	r.info("play seek to %vms, stream_id=%v", milliseconds, stream_id)
+
+	// onStatus(NetStream.Seek.Notify)
+	if true {
+		pkt := NewOnStatusCallPacket()
+		pkt.Set(SLEVEL, SLEVEL_Status).Set(SCODE, SCODE_StreamSeek)
+		pkt.Set(SDESC, fmt.Sprintf("Seeking %v (stream ID: %v).", int64(milliseconds), stream_id))
+		pkt.Set(SDETAILS, "stream").Set(SCLIENT_ID, SIG_CLIENT_ID)
+		if err = r.protocol.SendPacket(pkt, stream_id); err != nil {
+			return
+		}
+	}
+
+	return r.response_play(stream_id)
+}
+
 func (r *server) Ping(timestamp uint32) (err error) {
 	// ping client
 	pkt := NewUserControlPacket()
@@ -0,0 +1,357 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+)
+
+/**
+* the overflow policy of the send queue, when the audio/video messages
+* queued reach the capacity, for instance, the link of player is slow.
+*/
+const (
+	// block the SendMessage util the queue has space.
+	SendQueueOverflowBlock = iota
+	// drop the non-keyframe video, block when no video to drop.
+	SendQueueOverflowDropFrame
+	// drop the queued audio/video and the video util the next keyframe.
+	SendQueueOverflowDropToKeyframe
+	// disconnect the peer, SendMessage failed with ERROR_GO_SEND_QUEUE_OVERFLOW.
+	SendQueueOverflowDisconnect
+)
+
+/**
+* the priority class of the message to send, the less the higher priority.
+* 3.5. Video message
+* These messages are large and can delay the sending of other type of
+* messages. To avoid such a situation, the video message is assigned
+* the lowest priority.
+*/
+const (
+	send_priority_control = iota
+	send_priority_command
+	send_priority_audio
+	send_priority_video
+	send_priority_count
+)
+
+/**
+* the counters of the send queue.
+*/
+type SendQueueStats struct {
+	// the messages in queue.
+	Queued int
+	// the max audio/video messages in queue.
+	Capacity int
+	// the times of queue overflow.
+	Overflows uint64
+	// the audio/video messages dropped by overflow policy.
+	DroppedAudio uint64
+	DroppedVideo uint64
+}
+
+/**
+* the send scheduler, the send goroutine always pop the message of highest priority,
+* that is, protocol control > commands > audio > video.
+* the protocol control and commands are never dropped or blocked,
+* the capacity and overflow policy only apply to audio and video.
+*/
+type send_queue struct {
+	lock *sync.Mutex
+	queues [send_priority_count][]*Message
+	// the audio/video messages in queue.
+	nb_av int
+	capacity int
+	policy int
+	// for SendQueueOverflowDropToKeyframe, drop the video util keyframe.
+	wait_keyframe bool
+	// notify the send goroutine the message is ready, cap is 1.
+	ready chan struct{}
+	// closed and renew to wakeup the blocking producers, when queue got space.
+	space chan struct{}
+	nb_space_waiters int
+	stats SendQueueStats
+}
+func new_send_queue(capacity int, policy int) (*send_queue) {
+	r := &send_queue{}
+	r.lock = &sync.Mutex{}
+	r.capacity = capacity
+	r.policy = policy
+	r.ready = make(chan struct{}, 1)
+	r.space = make(chan struct{})
+	return r
+}
+
+func (r *send_queue) set_policy(capacity int, policy int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.capacity, r.policy = capacity, policy
+	r.wakeup_producers()
+}
+
+func (r *send_queue) get_stats() (stats SendQueueStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats = r.stats
+	stats.Capacity = r.capacity
+	for _, q := range r.queues {
+		stats.Queued += len(q)
+	}
+	return
+}
+
+/**
+* push the msg to queue, the msg maybe dropped by the overflow policy.
+* block when queue is full and policy is SendQueueOverflowBlock,
+* return the error of ERROR_GO_PROTOCOL_DESTROYED when done.
+ */
+func (r *send_queue) push(msg *Message, done <-chan struct{}) (err error) {
+	priority := send_priority(msg)
+
+	r.lock.Lock()
+	for {
+		// control and command never drop or block.
+		if priority < send_priority_audio {
+			break
+		}
+
+		// drop all video util keyframe.
+		if r.wait_keyframe && msg.Header.IsVideo() {
+			if !is_video_keyframe(msg) {
+				r.stats.DroppedVideo++
+				r.lock.Unlock()
+				msg.Release()
+				return
+			}
+			r.wait_keyframe = false
+		}
+
+		if r.nb_av < r.capacity {
+			break
+		}
+
+		r.stats.Overflows++
+		if r.policy == SendQueueOverflowDisconnect {
+			r.lock.Unlock()
+			return Error{code:ERROR_GO_SEND_QUEUE_OVERFLOW, desc:fmt.Sprintf("send queue overflow, capacity=%v", r.capacity)}
+		}
+
+		if r.policy == SendQueueOverflowDropFrame {
+			if msg.Header.IsVideo() && !is_video_keyframe(msg) {
+				r.stats.DroppedVideo++
+				r.lock.Unlock()
+				msg.Release()
+				return
+			}
+			if r.drop_oldest_video_frame() {
+				break
+			}
+		}
+
+		if r.policy == SendQueueOverflowDropToKeyframe {
+			r.drop_queued_frames()
+			if msg.Header.IsVideo() && !is_video_keyframe(msg) {
+				r.wait_keyframe = true
+				r.stats.DroppedVideo++
+				r.lock.Unlock()
+				msg.Release()
+				return
+			}
+			if r.nb_av < r.capacity {
+				break
+			}
+		}
+
+		// wait for space.
+		space := r.space
+		r.nb_space_waiters++
+		r.lock.Unlock()
+
+		select {
+		case <- space:
+		case <- done:
+			r.lock.Lock()
+			r.nb_space_waiters--
+			r.lock.Unlock()
+			return Error{code:ERROR_GO_PROTOCOL_DESTROYED, desc:"protocol stack destroyed, cannot send"}
+		}
+
+		r.lock.Lock()
+		r.nb_space_waiters--
+	}
+
+	r.queues[priority] = append(r.queues[priority], msg)
+	if priority >= send_priority_audio {
+		r.nb_av++
+	}
+	r.lock.Unlock()
+
+	// notify the send goroutine.
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+	return
+}
+
+/**
+* pop the message of highest priority, block when queue is empty,
+* return nil when done.
+ */
+func (r *send_queue) pop(done <-chan struct{}) (msg *Message) {
+	for {
+		if msg = r.try_pop(); msg != nil {
+			return
+		}
+
+		select {
+		case <- r.ready:
+		case <- done:
+			return nil
+		}
+	}
+}
+
+func (r *send_queue) try_pop() (msg *Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for priority, q := range r.queues {
+		if len(q) <= 0 {
+			continue
+		}
+
+		msg = q[0]
+		q[0] = nil
+		r.queues[priority] = q[1:]
+
+		if priority >= send_priority_audio {
+			r.nb_av--
+			r.wakeup_producers()
+		}
+		return
+	}
+	return
+}
+
+// wakeup the producers blocking for space.
+func (r *send_queue) wakeup_producers() {
+	if r.nb_space_waiters <= 0 {
+		return
+	}
+	close(r.space)
+	r.space = make(chan struct{})
+}
+
+// drop the oldest non-keyframe video in queue, return false when not found.
+func (r *send_queue) drop_oldest_video_frame() (dropped bool) {
+	q := r.queues[send_priority_video]
+	for i, msg := range q {
+		if !msg.Header.IsVideo() || is_video_keyframe(msg) {
+			continue
+		}
+
+		r.queues[send_priority_video] = append(q[:i], q[i+1:]...)
+		q[len(q) - 1] = nil
+		r.nb_av--
+		msg.Release()
+		r.stats.DroppedVideo++
+		return true
+	}
+	return false
+}
+
+// drop all queued audio/video frames, except the sequence headers.
+func (r *send_queue) drop_queued_frames() {
+	for _, priority := range []int{send_priority_audio, send_priority_video} {
+		var kept []*Message
+		for _, msg := range r.queues[priority] {
+			if is_sequence_header(msg) || (!msg.Header.IsAudio() && !msg.Header.IsVideo()) {
+				kept = append(kept, msg)
+				continue
+			}
+
+			if msg.Header.IsAudio() {
+				r.stats.DroppedAudio++
+			} else {
+				r.stats.DroppedVideo++
+			}
+			r.nb_av--
+			msg.Release()
+		}
+		r.queues[priority] = kept
+	}
+}
+
+/**
+* get the priority class of msg.
+* @remark the user control message is in the command class, for the stream events,
+* 		for example, StreamBegin and StreamEOF, must keep the order with the onStatus.
+ */
+func send_priority(msg *Message) (int) {
+	h := msg.Header
+	switch {
+	case h.IsUserControlMessage():
+		return send_priority_command
+	case h.MessageType >= RTMP_MSG_SetChunkSize && h.MessageType <= RTMP_MSG_EdgeAndOriginServerCommand:
+		return send_priority_control
+	case h.IsAudio():
+		return send_priority_audio
+	case h.IsVideo() || h.IsAggregate():
+		return send_priority_video
+	}
+	return send_priority_command
+}
+
+/**
+* whether the video msg is keyframe, the FLV video tag:
+* 	FrameType UB[4], 1 = key frame (for AVC, a seekable frame)
+* 	CodecID UB[4], 7 = AVC
+*/
+func is_video_keyframe(msg *Message) (bool) {
+	if !msg.Header.IsVideo() || len(msg.Payload) < 1 {
+		return false
+	}
+	return (msg.Payload[0] >> 4) & 0x0F == 1
+}
+
+/**
+* whether the msg is the AVC or AAC sequence header, which must never be dropped.
+* 	AVC: CodecID=7, AVCPacketType=0
+* 	AAC: SoundFormat=10, AACPacketType=0
+*/
+func is_sequence_header(msg *Message) (bool) {
+	if len(msg.Payload) < 2 {
+		return false
+	}
+	if msg.Header.IsVideo() {
+		return msg.Payload[0] & 0x0F == 7 && msg.Payload[1] == 0
+	}
+	if msg.Header.IsAudio() {
+		return (msg.Payload[0] >> 4) & 0x0F == 10 && msg.Payload[1] == 0
+	}
+	return false
+}
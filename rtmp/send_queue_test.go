@@ -0,0 +1,207 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendQueuePriority(t *testing.T) {
+	q := new_send_queue(10, SendQueueOverflowBlock)
+	done := make(chan struct{})
+
+	video := new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x27, 0x01})
+	audio := new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01})
+	command := new_av_message(RTMP_MSG_AMF0CommandMessage, 0, nil)
+	control := new_av_message(RTMP_MSG_SetChunkSize, 0, nil)
+
+	for _, msg := range []*Message{video, audio, command, control} {
+		if err := q.push(msg, done); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expect := range []*Message{control, command, audio, video} {
+		if msg := q.pop(done); msg != expect {
+			t.Fatalf("expect message type=%v, actual=%v", expect.Header.MessageType, msg.Header.MessageType)
+		}
+	}
+
+	close(done)
+	if msg := q.pop(done); msg != nil {
+		t.Fatal("pop should return nil when done")
+	}
+}
+
+func TestSendQueueStreamEventOrder(t *testing.T) {
+	q := new_send_queue(10, SendQueueOverflowBlock)
+	done := make(chan struct{})
+
+	// the onStatus(NetStream.Play.Start) then StreamBegin, the chunk size is sent first.
+	on_status := new_av_message(RTMP_MSG_AMF0CommandMessage, 0, nil)
+	stream_begin := new_av_message(RTMP_MSG_UserControlMessage, 0, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x01})
+	control := new_av_message(RTMP_MSG_SetChunkSize, 0, nil)
+
+	for _, msg := range []*Message{on_status, stream_begin, control} {
+		if err := q.push(msg, done); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the stream events never jump ahead of the onStatus.
+	for _, expect := range []*Message{control, on_status, stream_begin} {
+		if msg := q.pop(done); msg != expect {
+			t.Fatalf("expect message type=%v, actual=%v", expect.Header.MessageType, msg.Header.MessageType)
+		}
+	}
+}
+
+func TestSendQueueDropFrame(t *testing.T) {
+	q := new_send_queue(2, SendQueueOverflowDropFrame)
+	done := make(chan struct{})
+
+	keyframe := new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x17, 0x01})
+	interframe := new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x27, 0x01})
+	q.push(keyframe, done)
+	q.push(interframe, done)
+
+	// full, the non-keyframe is dropped.
+	q.push(new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x27, 0x01}), done)
+	// full, the queued non-keyframe is dropped for the keyframe.
+	keyframe2 := new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x17, 0x01})
+	q.push(keyframe2, done)
+	// control message never dropped.
+	q.push(new_av_message(RTMP_MSG_UserControlMessage, 0, nil), done)
+
+	stats := q.get_stats()
+	if stats.DroppedVideo != 2 || stats.Queued != 3 || stats.Overflows != 2 {
+		t.Fatalf("invalid stats %+v", stats)
+	}
+	q.pop(done)
+	if q.pop(done) != keyframe || q.pop(done) != keyframe2 {
+		t.Fatal("keyframes should be kept")
+	}
+}
+
+func TestSendQueueDropToKeyframe(t *testing.T) {
+	q := new_send_queue(3, SendQueueOverflowDropToKeyframe)
+	done := make(chan struct{})
+
+	sh := new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x17, 0x00})
+	q.push(sh, done)
+	q.push(new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}), done)
+	q.push(new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x27, 0x01}), done)
+
+	// overflow, drop the queued frames and video util keyframe.
+	q.push(new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x27, 0x01}), done)
+	q.push(new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x27, 0x01}), done)
+	audio := new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01})
+	q.push(audio, done)
+	keyframe := new_av_message(RTMP_MSG_VideoMessage, 0, []byte{0x17, 0x01})
+	q.push(keyframe, done)
+
+	stats := q.get_stats()
+	if stats.DroppedVideo != 3 || stats.DroppedAudio != 1 || stats.Queued != 3 {
+		t.Fatalf("invalid stats %+v", stats)
+	}
+	if q.pop(done) != audio || q.pop(done) != sh || q.pop(done) != keyframe {
+		t.Fatal("sequence header and keyframe should be kept")
+	}
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	q := new_send_queue(1, SendQueueOverflowDisconnect)
+	done := make(chan struct{})
+
+	q.push(new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}), done)
+	err := q.push(new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}), done)
+	assert_error_code(t, err, ERROR_GO_SEND_QUEUE_OVERFLOW)
+}
+
+func TestSendQueueBlock(t *testing.T) {
+	q := new_send_queue(1, SendQueueOverflowBlock)
+	done := make(chan struct{})
+
+	q.push(new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}), done)
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.push(new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}), done)
+	}()
+
+	// the push is still pending after a while without pop.
+	select {
+	case <- pushed:
+		t.Fatal("push should block when full")
+	case <- time.After(50 * time.Millisecond):
+	}
+
+	// the push completes when the queue is popped.
+	if msg := q.try_pop(); msg == nil {
+		t.Fatal("expect queued message")
+	}
+	select {
+	case err := <- pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <- time.After(3 * time.Second):
+		t.Fatal("push should complete after pop")
+	}
+
+	go func() {
+		pushed <- q.push(new_av_message(RTMP_MSG_AudioMessage, 0, []byte{0xaf, 0x01}), done)
+	}()
+	close(done)
+	assert_error_code(t, <- pushed, ERROR_GO_PROTOCOL_DESTROYED)
+}
+
+func TestSendQueueByBufferLength(t *testing.T) {
+	p := new_protocol(NewSocket(nil))
+	set_buffer_length := func(length uint32) {
+		pkt := NewUserControlPacket()
+		pkt.EventType, pkt.EventData, pkt.ExtraData = PCUCSetBufferLength, 1, length
+		if err := p.on_recv_user_control(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert_queue := func(capacity int, policy int) {
+		if q := p.msg_out_queue; q.capacity != capacity || q.policy != policy {
+			t.Errorf("expect capacity=%v policy=%v, actual capacity=%v policy=%v", capacity, policy, q.capacity, q.policy)
+		}
+	}
+
+	// disabled, the buffer length never changes the queue.
+	set_buffer_length(3000)
+	assert_queue(RTMP_MSG_CHANNEL_BUFFER, SendQueueOverflowBlock)
+
+	// applied to the buffer length already set.
+	p.SetSendQueueByBufferLength(73, SendQueueOverflowDropToKeyframe)
+	assert_queue(219, SendQueueOverflowDropToKeyframe)
+
+	// follow the buffer length, at least RTMP_MSG_CHANNEL_BUFFER.
+	set_buffer_length(10000)
+	assert_queue(730, SendQueueOverflowDropToKeyframe)
+	set_buffer_length(0)
+	assert_queue(RTMP_MSG_CHANNEL_BUFFER, SendQueueOverflowDropToKeyframe)
+}
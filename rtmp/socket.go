@@ -23,31 +23,185 @@ package rtmp
 
 import (
 	"net"
-	"fmt"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+/**
+* a time long ago, set as deadline to wakeup the blocking io.
+ */
+var socket_deadline_past = time.Unix(1, 0)
+
 // socket to read or write data.
 type Socket struct {
-	conn *net.TCPConn
+	conn net.Conn
 	recv_bytes uint64
 	send_bytes uint64
+	// the kbps sampler of read and write.
+	recv_kbps *kbps_sampler
+	send_kbps *kbps_sampler
+	// lock for the timeout and deadline,
+	// which maybe set by user goroutine when io goroutine is blocking.
+	lock *sync.Mutex
+	/**
+	* the idle timeout of read/write,
+	* that is, the max duration of a single read/write, never timeout when 0.
+	 */
+	recv_timeout time.Duration
+	send_timeout time.Duration
+	// the absolute deadline of read and write, for example, from the context.
+	// no deadline when zero.
+	deadline time.Time
 }
-func NewSocket(conn *net.TCPConn) (*Socket) {
+func NewSocket(conn net.Conn) (*Socket) {
 	r := &Socket{}
 	r.conn = conn
+	r.lock = &sync.Mutex{}
+	r.recv_kbps = new_kbps_sampler()
+	r.send_kbps = new_kbps_sampler()
 	return r
 }
 
+// the address of peer, empty if unknown.
+func (r *Socket) RemoteAddr() (string) {
+	if r.conn == nil || r.conn.RemoteAddr() == nil {
+		return ""
+	}
+	return r.conn.RemoteAddr().String()
+}
+
 func (r *Socket) RecvBytes() (uint64) {
-	return r.recv_bytes
+	return atomic.LoadUint64(&r.recv_bytes)
 }
 
 func (r *Socket) SendBytes() (uint64) {
-	return r.send_bytes
+	return atomic.LoadUint64(&r.send_bytes)
+}
+
+// the kbps of read over the sliding windows.
+func (r *Socket) RecvKbps() (Kbps) {
+	return r.recv_kbps.get(time.Now())
+}
+
+// the kbps of write over the sliding windows.
+func (r *Socket) SendKbps() (Kbps) {
+	return r.send_kbps.get(time.Now())
+}
+
+/**
+* close the underlayer connection, the blocking io will fail.
+ */
+func (r *Socket) Close() (err error) {
+	return r.conn.Close()
+}
+
+/**
+* set the idle timeout of read, the read failed with ERROR_SOCKET_TIMEOUT
+* when no data received in timeout. never timeout when 0.
+ */
+func (r *Socket) SetRecvTimeout(timeout time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.recv_timeout = timeout
+}
+
+/**
+* set the idle timeout of write, the write failed with ERROR_SOCKET_TIMEOUT
+* when no data sent in timeout. never timeout when 0.
+ */
+func (r *Socket) SetSendTimeout(timeout time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.send_timeout = timeout
+}
+
+/**
+* set the absolute deadline of read and write, zero to clear it.
+ */
+func (r *Socket) SetDeadline(deadline time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.deadline = deadline
+	// apply to the blocking io.
+	r.conn.SetDeadline(deadline)
+}
+
+/**
+* interrupt the blocking read and write, which will fail with ERROR_SOCKET_TIMEOUT.
+* user can restore the socket by SetDeadline(time.Time{}).
+ */
+func (r *Socket) Interrupt() {
+	r.SetDeadline(socket_deadline_past)
+}
+
+/**
+* apply the ctx to the socket, the deadline of ctx is used as the io deadline,
+* and the blocking io is interrupted when ctx is canceled.
+* user must call the returned stop func when the io is done, to clear the deadline.
+ */
+func (r *Socket) WatchContext(ctx context.Context) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		r.SetDeadline(deadline)
+	}
+
+	if ctx.Done() == nil {
+		return func() {
+			r.SetDeadline(time.Time{})
+		}
+	}
+
+	done := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		defer close(exited)
+		select {
+		case <- ctx.Done():
+			r.Interrupt()
+		case <- done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<- exited
+		r.SetDeadline(time.Time{})
+	}
+}
+
+// get the deadline by the idle timeout and the absolute deadline.
+func (r *Socket) io_deadline(timeout time.Duration) (deadline time.Time) {
+	deadline = r.deadline
+	if timeout <= 0 {
+		return
+	}
+
+	if idle := time.Now().Add(timeout); deadline.IsZero() || idle.Before(deadline) {
+		deadline = idle
+	}
+	return
+}
+
+// convert the timeout error to ERROR_SOCKET_TIMEOUT
+func socket_timeout_error(err error, desc string) (error) {
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return Error{code:ERROR_SOCKET_TIMEOUT, desc:desc}
+	}
+	return err
 }
 
 func (r *Socket) Read(b []byte) (n int, err error) {
+	r.lock.Lock()
+	err = r.conn.SetReadDeadline(r.io_deadline(r.recv_timeout))
+	r.lock.Unlock()
+	if err != nil {
+		return
+	}
+
 	if n, err = r.conn.Read(b); err != nil {
+		err = socket_timeout_error(err, "read timeout")
 		return
 	}
 
@@ -66,7 +220,8 @@ func (r *Socket) Read(b []byte) (n int, err error) {
 	}
 
 	if n > 0 {
-		r.recv_bytes += uint64(n)
+		atomic.AddUint64(&r.recv_bytes, uint64(n))
+		r.recv_kbps.add(time.Now(), uint64(n))
 	}
 
 	return
@@ -74,8 +229,16 @@ func (r *Socket) Read(b []byte) (n int, err error) {
 
 func (r *Socket) Write(b []byte) (n int, err error) {
 	for n < len(b) {
+		r.lock.Lock()
+		err = r.conn.SetWriteDeadline(r.io_deadline(r.send_timeout))
+		r.lock.Unlock()
+		if err != nil {
+			return
+		}
+
 		var nb_written int
 		if nb_written, err = r.conn.Write(b[n:]); err != nil {
+			err = socket_timeout_error(err, "write timeout")
 			return
 		}
 
@@ -93,14 +256,33 @@ func (r *Socket) Write(b []byte) (n int, err error) {
 			return
 		}
 
-		r.send_bytes += uint64(nb_written)
+		atomic.AddUint64(&r.send_bytes, uint64(nb_written))
+		r.send_kbps.add(time.Now(), uint64(nb_written))
 		n += nb_written
+	}
 
-		if n < len(b) {
-			// TODO: FIXME: remove following
-			fmt.Printf("write partially, len(b)=%v, n=%v, nb_written=%v\n", len(b), n, nb_written)
-		}
+	return
+}
+
+/**
+* write all bufs by one writev, the bufs is consumed.
+ */
+func (r *Socket) WriteBuffers(bufs *net.Buffers) (n int64, err error) {
+	r.lock.Lock()
+	err = r.conn.SetWriteDeadline(r.io_deadline(r.send_timeout))
+	r.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	n, err = bufs.WriteTo(r.conn)
+	if n > 0 {
+		atomic.AddUint64(&r.send_bytes, uint64(n))
+		r.send_kbps.add(time.Now(), uint64(n))
 	}
 
+	if err != nil {
+		err = socket_timeout_error(err, "write timeout")
+	}
 	return
 }
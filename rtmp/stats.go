@@ -0,0 +1,260 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**
+* the kbps of connection, the average over the sliding windows.
+ */
+type Kbps struct {
+	Kbps10s int
+	Kbps30s int
+	Kbps300s int
+}
+
+// the max sliding window of kbps, in seconds.
+const kbps_max_window = 300
+
+/**
+* the kbps sampler, which counts the bytes of each second in a ring,
+* to calc the kbps over any window less than kbps_max_window.
+ */
+type kbps_sampler struct {
+	lock *sync.Mutex
+	// the bytes of each second, indexed by the unix second.
+	buckets [kbps_max_window]uint64
+	// the unix second of bucket, the bucket is stale when not match.
+	seconds [kbps_max_window]int64
+	// when the sampler created, the window never exceed the age.
+	created time.Time
+}
+func new_kbps_sampler() (*kbps_sampler) {
+	r := &kbps_sampler{}
+	r.lock = &sync.Mutex{}
+	r.created = time.Now()
+	return r
+}
+
+func (r *kbps_sampler) add(now time.Time, n uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	second := now.Unix()
+	index := int(second % kbps_max_window)
+	if r.seconds[index] != second {
+		r.seconds[index] = second
+		r.buckets[index] = 0
+	}
+	r.buckets[index] += n
+}
+
+/**
+* get the kbps in the window, in seconds.
+* the window is the age of sampler if younger than window.
+ */
+func (r *kbps_sampler) kbps(now time.Time, window int) (int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if window > kbps_max_window {
+		window = kbps_max_window
+	}
+
+	// sum the buckets in (now - window, now].
+	second := now.Unix()
+	var bytes uint64
+	for i := 0; i < window; i++ {
+		index := int((second - int64(i)) % kbps_max_window)
+		if r.seconds[index] == second - int64(i) {
+			bytes += r.buckets[index]
+		}
+	}
+
+	// the seconds sampled, never exceed the age of sampler.
+	duration := int64(window)
+	if age := second - r.created.Unix() + 1; age < duration {
+		duration = age
+	}
+	if duration < 1 {
+		duration = 1
+	}
+	return int(bytes * 8 / 1000 / uint64(duration))
+}
+
+func (r *kbps_sampler) get(now time.Time) (v Kbps) {
+	v.Kbps10s = r.kbps(now, 10)
+	v.Kbps30s = r.kbps(now, 30)
+	v.Kbps300s = r.kbps(now, 300)
+	return
+}
+
+/**
+* the counters of audio/video frames.
+ */
+type FrameStats struct {
+	Audio uint64
+	Video uint64
+	// the video keyframes, except the sequence header.
+	KeyFrames uint64
+	/**
+	* the interval of the last two keyframes, by the timestamp of messages,
+	* that is, the gop duration. zero when less than two keyframes.
+	 */
+	KeyFrameInterval time.Duration
+}
+
+/**
+* the counters of messages in one direction, updated by the io goroutine,
+* and read by the user goroutine, so it's locked.
+ */
+type message_stats struct {
+	lock *sync.Mutex
+	// the messages, indexed by the message type.
+	messages [256]uint64
+	frames FrameStats
+	// the timestamp of last keyframe.
+	keyframe_timestamp uint64
+	has_keyframe bool
+}
+func new_message_stats() (*message_stats) {
+	r := &message_stats{}
+	r.lock = &sync.Mutex{}
+	return r
+}
+
+func (r *message_stats) on_message(msg *Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.messages[msg.Header.MessageType]++
+
+	if msg.Header.IsAudio() {
+		r.frames.Audio++
+	}
+	if !msg.Header.IsVideo() {
+		return
+	}
+
+	r.frames.Video++
+	if !is_video_keyframe(msg) || is_sequence_header(msg) {
+		return
+	}
+
+	r.frames.KeyFrames++
+	if timestamp := msg.Header.Timestamp; r.has_keyframe && timestamp > r.keyframe_timestamp {
+		r.frames.KeyFrameInterval = time.Duration(timestamp - r.keyframe_timestamp) * time.Millisecond
+	}
+	r.keyframe_timestamp = msg.Header.Timestamp
+	r.has_keyframe = true
+}
+
+// get the messages by the type name, and the frames.
+func (r *message_stats) get() (messages map[string]uint64, frames FrameStats) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	messages = map[string]uint64{}
+	for message_type, v := range r.messages {
+		if v > 0 {
+			messages[message_type_name(byte(message_type))] = v
+		}
+	}
+	return messages, r.frames
+}
+
+/**
+* get the name of message type, for the stats and metrics.
+* for example, "audio", "video" and "amf0_command", or "type_N" for unknown type.
+ */
+func message_type_name(message_type byte) (string) {
+	switch message_type {
+	case RTMP_MSG_SetChunkSize:
+		return "set_chunk_size"
+	case RTMP_MSG_AbortMessage:
+		return "abort"
+	case RTMP_MSG_Acknowledgement:
+		return "acknowledgement"
+	case RTMP_MSG_UserControlMessage:
+		return "user_control"
+	case RTMP_MSG_WindowAcknowledgementSize:
+		return "window_ack_size"
+	case RTMP_MSG_SetPeerBandwidth:
+		return "set_peer_bandwidth"
+	case RTMP_MSG_EdgeAndOriginServerCommand:
+		return "edge_origin_command"
+	case RTMP_MSG_AudioMessage:
+		return "audio"
+	case RTMP_MSG_VideoMessage:
+		return "video"
+	case RTMP_MSG_AMF3DataMessage:
+		return "amf3_data"
+	case RTMP_MSG_AMF3SharedObject:
+		return "amf3_shared_object"
+	case RTMP_MSG_AMF3CommandMessage:
+		return "amf3_command"
+	case RTMP_MSG_AMF0DataMessage:
+		return "amf0_data"
+	case RTMP_MSG_AMF0SharedObject:
+		return "amf0_shared_object"
+	case RTMP_MSG_AMF0CommandMessage:
+		return "amf0_command"
+	case RTMP_MSG_AggregateMessage:
+		return "aggregate"
+	}
+	return fmt.Sprintf("type_%v", message_type)
+}
+
+/**
+* the stats of connection, the snapshot when Stats() called.
+ */
+type Stats struct {
+	// the id of connection, @see LogContext
+	Id uint64
+	RemoteAddr string
+	// the vhost/app/stream, empty util known.
+	Vhost string
+	App string
+	Stream string
+	// the LogState* of connection.
+	State string
+	// when the connection created.
+	Created time.Time
+	RecvBytes uint64
+	SendBytes uint64
+	RecvKbps Kbps
+	SendKbps Kbps
+	// the messages by the type name, @see message_type_name
+	// the aggregate messages muxed or demuxed by stack are counted as the sub-messages.
+	RecvMessages map[string]uint64
+	SendMessages map[string]uint64
+	RecvFrames FrameStats
+	SendFrames FrameStats
+	// the queue depth and dropped frames of send queue.
+	SendQueue SendQueueStats
+	// the round trip time measured by ping, zero when unknown.
+	Rtt time.Duration
+}
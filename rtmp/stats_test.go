@@ -0,0 +1,214 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2014 winlin
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies of
+// the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS
+// FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR
+// COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER
+// IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN
+// CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package rtmp
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKbpsSampler(t *testing.T) {
+	r := new_kbps_sampler()
+	now := time.Unix(10000, 0)
+	r.created = now
+
+	// 1000kbps in 10s.
+	for i := 0; i < 10; i++ {
+		r.add(now.Add(time.Duration(i) * time.Second), 125000)
+	}
+	now = now.Add(9 * time.Second)
+	if v := r.get(now); v.Kbps10s != 1000 || v.Kbps30s != 1000 || v.Kbps300s != 1000 {
+		t.Errorf("kbps %+v", v)
+	}
+
+	// idle for 20s.
+	if v := r.get(now.Add(20 * time.Second)); v.Kbps10s != 0 || v.Kbps30s != 333 || v.Kbps300s != 333 {
+		t.Errorf("kbps %+v", v)
+	}
+
+	// the stale bucket of ring must be ignored.
+	if v := r.get(now.Add(kbps_max_window * time.Second)); v.Kbps10s != 0 || v.Kbps300s != 0 {
+		t.Errorf("kbps %+v", v)
+	}
+}
+
+func TestMessageStatsFrames(t *testing.T) {
+	r := new_message_stats()
+	video := func(timestamp uint64, payload []byte) {
+		r.on_message(new_av_message(RTMP_MSG_VideoMessage, timestamp, payload))
+	}
+
+	video(0, avc_sequence_header)
+	video(0, conformance_frame(true, 10))
+	video(40, conformance_frame(false, 10))
+	video(2000, conformance_frame(true, 10))
+
+	r.on_message(new_av_message(RTMP_MSG_AudioMessage, 0, aac_sequence_header))
+
+	messages, frames := r.get()
+	if messages["video"] != 4 || messages["audio"] != 1 || len(messages) != 2 {
+		t.Errorf("messages %v", messages)
+	}
+	if frames.Video != 4 || frames.Audio != 1 || frames.KeyFrames != 2 || frames.KeyFrameInterval != 2 * time.Second {
+		t.Errorf("frames %+v", frames)
+	}
+
+	if message_type_name(RTMP_MSG_AMF0CommandMessage) != "amf0_command" || message_type_name(0x20) != "type_32" {
+		t.Error("message type name")
+	}
+}
+
+func TestStatsPublish(t *testing.T) {
+	tc_url := "rtmp://127.0.0.1/live"
+
+	c := new_seed_session()
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CONNECT, 1.0, seed_amf0_object(
+		"app", "live", "tcUrl", tc_url)))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_RELEASE_STREAM, 2.0, nil, "livestream"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_FC_PUBLISH, 3.0, nil, "livestream"))
+	c.send(RTMP_CID_OverConnection, RTMP_MSG_AMF0CommandMessage, 0, 0, seed_amf0(AMF0_COMMAND_CREATE_STREAM, 4.0, nil))
+	c.send(RTMP_CID_OverConnection2, RTMP_MSG_AMF0CommandMessage, 0, 1, seed_amf0(AMF0_COMMAND_PUBLISH, 5.0, nil, "livestream", "live"))
+	c.send(RTMP_CID_Audio, RTMP_MSG_AudioMessage, 0, 1, aac_sequence_header)
+	c.send(RTMP_CID_Video, RTMP_MSG_VideoMessage, 0, 1, avc_sequence_header)
+	c.send(RTMP_CID_Video, RTMP_MSG_VideoMessage, 0, 1, conformance_frame(true, 1000))
+	c.send(RTMP_CID_Video, RTMP_MSG_VideoMessage, 40, 1, conformance_frame(false, 1000))
+	c.send(RTMP_CID_Video, RTMP_MSG_VideoMessage, 4000, 1, conformance_frame(true, 1000))
+
+	var server Server
+	replay_session(t, c.b, 9, func(s Server) {
+		server = s
+		serve_connect(t, s, NewRequest())
+		assert_identify(t, s, CLIENT_TYPE_FMLEPublish, "livestream")
+		if err := s.StartFMLEPublish(1); err != nil {
+			t.Error(err)
+		}
+		recv_av_messages(t, s, 5)
+	})
+
+	// all responses are sent.
+	stats := server.Stats()
+
+	if stats.Id == 0 || stats.Vhost != "127.0.0.1" || stats.App != "live" || stats.Stream != "livestream" || stats.State != LogStatePublish {
+		t.Errorf("stats context %+v", stats)
+	}
+	if stats.RecvBytes < 3000 || stats.SendBytes == 0 || stats.RecvKbps.Kbps10s == 0 || stats.Created.IsZero() {
+		t.Errorf("stats bytes %+v", stats)
+	}
+	if stats.RecvMessages["amf0_command"] != 5 || stats.RecvMessages["video"] != 4 || stats.SendMessages["amf0_command"] != 7 {
+		t.Errorf("stats messages recv=%v, send=%v", stats.RecvMessages, stats.SendMessages)
+	}
+	if f := stats.RecvFrames; f.Audio != 1 || f.Video != 4 || f.KeyFrames != 2 || f.KeyFrameInterval != 4 * time.Second {
+		t.Errorf("stats frames %+v", f)
+	}
+}
+
+// the source of stats for metrics.
+type mock_stats_source struct {
+	stats Stats
+	done chan struct{}
+}
+
+func (r *mock_stats_source) Stats() (Stats) {
+	return r.stats
+}
+
+func (r *mock_stats_source) Done() (<-chan struct{}) {
+	return r.done
+}
+
+func TestMetricsHandler(t *testing.T) {
+	publisher := &mock_stats_source{done:make(chan struct{})}
+	publisher.stats = Stats{Id:1, Vhost:"__defaultVhost__", App:"live", Stream:"livestream", State:LogStatePublish,
+		RecvBytes:1000, RecvKbps:Kbps{800, 700, 600}, RecvMessages:map[string]uint64{"video":10, "audio":20},
+		RecvFrames:FrameStats{Audio:20, Video:10, KeyFrames:2, KeyFrameInterval:2 * time.Second}}
+	player := &mock_stats_source{done:make(chan struct{})}
+	player.stats = Stats{Id:2, Vhost:"__defaultVhost__", App:"live", Stream:"livestream", State:LogStatePlay,
+		SendBytes:900, SendKbps:Kbps{800, 700, 600}, SendMessages:map[string]uint64{"video":9},
+		SendQueue:SendQueueStats{Queued:3, DroppedVideo:1}, Rtt:20 * time.Millisecond}
+	idle := &mock_stats_source{done:make(chan struct{})}
+	idle.stats = Stats{Id:3, App:"live\"\n", RecvBytes:100}
+
+	m := NewMetrics()
+	m.Register(publisher)
+	m.Register(player)
+	m.Register(idle)
+
+	streams := m.Streams()
+	if len(streams) != 1 || streams[0].Publishers != 1 || streams[0].Players != 1 || streams[0].SendKbps.Kbps10s != 800 {
+		t.Errorf("streams %+v", streams)
+	}
+
+	scrape := func() (string) {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		if v := w.Header().Get("Content-Type"); !strings.HasPrefix(v, "text/plain; version=0.0.4") {
+			t.Errorf("content type %v", v)
+		}
+		return w.Body.String()
+	}
+
+	body := scrape()
+	for _, expect := range []string{
+		"# TYPE rtmp_connections gauge\nrtmp_connections 3\n",
+		"rtmp_recv_bytes_total 1100\n",
+		"rtmp_send_bytes_total 900\n",
+		`rtmp_messages_total{direction="recv",type="audio"} 20` + "\n",
+		`rtmp_messages_total{direction="send",type="video"} 9` + "\n",
+		`rtmp_frames_total{direction="recv",kind="keyframe"} 2` + "\n",
+		"rtmp_send_queue_depth 3\n",
+		`rtmp_send_queue_dropped_total{kind="video"} 1` + "\n",
+		"rtmp_rtt_seconds_avg 0.02\n",
+		`rtmp_stream_players{vhost="__defaultVhost__",app="live",stream="livestream"} 1` + "\n",
+		`rtmp_stream_recv_kbps{vhost="__defaultVhost__",app="live",stream="livestream",window="30s"} 700` + "\n",
+		`rtmp_stream_keyframe_interval_seconds{vhost="__defaultVhost__",app="live",stream="livestream"} 2` + "\n",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("metrics not found: %v\n%v", expect, body)
+		}
+	}
+
+	// the counters of closed connection are kept.
+	close(publisher.done)
+	must_complete(t, 3 * time.Second, "unregister", func() {
+		for len(m.Connections()) != 2 {
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	body = scrape()
+	for _, expect := range []string{
+		"rtmp_connections 2\n",
+		"rtmp_recv_bytes_total 1100\n",
+		`rtmp_frames_total{direction="recv",kind="keyframe"} 2` + "\n",
+		`rtmp_stream_publishers{vhost="__defaultVhost__",app="live",stream="livestream"} 0` + "\n",
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("metrics not found: %v\n%v", expect, body)
+		}
+	}
+
+	if v := escape_label_value("a\\b\"c\nd"); v != `a\\b\"c\nd` {
+		t.Errorf("escape %v", v)
+	}
+}